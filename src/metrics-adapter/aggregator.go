@@ -0,0 +1,186 @@
+package metricsadapter
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	tdigest "github.com/caio/go-tdigest"
+)
+
+// window holds the samples of one series since the last rollup.
+type window struct {
+	metric Metric
+
+	count     int
+	min, max  float64
+	sum       float64
+	last      float64
+	timestamp float64
+	digest    *tdigest.TDigest
+}
+
+// Aggregator rolls up series sampled at a high rate into a few series per
+// window, so that bursts between two emits show up without emitting every
+// sample. A series sampled as garden.numGoroutines is emitted as
+//
+//	garden.numGoroutines.min
+//	garden.numGoroutines.max
+//	garden.numGoroutines.mean
+//	garden.numGoroutines.last
+//	garden.numGoroutines.p50, .p90, .p99, ...
+//
+// with the percentiles estimated from a t-digest of the samples, and the
+// timestamp of the last sample. Series that are not rolled up are emitted
+// with their last sample under their own name, as is metrics_adapter.up
+// always: whether a target is up is a state alerts match on, not a level.
+type Aggregator struct {
+	percentiles []float64
+	compression uint32
+	prefixes    []string
+
+	mu      sync.Mutex
+	windows map[string]*window
+	order   []string
+}
+
+func NewAggregator(cfg AggregationConfig) *Aggregator {
+	return &Aggregator{
+		percentiles: cfg.Percentiles,
+		compression: cfg.Compression,
+		prefixes:    cfg.Metrics,
+		windows:     map[string]*window{},
+	}
+}
+
+// Reconfigure applies a new config to the current window and the ones after
+// it. The samples so far are kept for the series that are rolled up, or not,
+// either way.
+func (a *Aggregator) Reconfigure(cfg AggregationConfig) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.percentiles, a.compression, a.prefixes = cfg.Percentiles, cfg.Compression, cfg.Metrics
+
+	var order []string
+	for _, key := range a.order {
+		w := a.windows[key]
+		if (w.digest != nil) != a.rolledUp(w.metric.Metric) {
+			delete(a.windows, key)
+			continue
+		}
+		order = append(order, key)
+	}
+	a.order = order
+}
+
+// Add adds the samples of a series to the current window.
+func (a *Aggregator) Add(series Series) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, metric := range series.Series {
+		key := seriesKey(metric)
+		w, ok := a.windows[key]
+		if !ok {
+			w = &window{metric: metric, min: math.Inf(1), max: math.Inf(-1)}
+			if a.rolledUp(metric.Metric) {
+				// only fails for a compression below 1
+				w.digest, _ = tdigest.New(tdigest.Compression(a.compression))
+			}
+			a.windows[key] = w
+			a.order = append(a.order, key)
+		}
+
+		for _, point := range metric.Points {
+			w.add(point[0], point[1])
+		}
+	}
+}
+
+// Rollup returns the rollups of the current window and starts a new one.
+func (a *Aggregator) Rollup() Series {
+	a.mu.Lock()
+	windows, order := a.windows, a.order
+	a.windows, a.order = map[string]*window{}, nil
+	a.mu.Unlock()
+
+	var rollups Series
+	for _, key := range order {
+		w := windows[key]
+		if w.count == 0 {
+			continue
+		}
+
+		host, tags, ts := w.metric.Host, w.metric.Tags, int64(w.timestamp)
+		name := w.metric.Metric
+		if w.digest == nil {
+			rollups.Series = append(rollups.Series, newMetric(name, ts, w.last, host, tags...))
+			continue
+		}
+
+		rollups.Series = append(rollups.Series,
+			newMetric(name+".min", ts, w.min, host, tags...),
+			newMetric(name+".max", ts, w.max, host, tags...),
+			newMetric(name+".mean", ts, w.sum/float64(w.count), host, tags...),
+			newMetric(name+".last", ts, w.last, host, tags...),
+		)
+		for _, p := range a.percentiles {
+			rollups.Series = append(rollups.Series, newMetric(name+"."+percentileName(p), ts, w.digest.Quantile(p), host, tags...))
+		}
+	}
+
+	return rollups
+}
+
+// Samples tells whether a collector of metrics starting with the prefixes
+// collects any that are rolled up, which are the only ones worth sampling.
+func (a *Aggregator) Samples(prefixes []string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		for _, rolledUp := range a.prefixes {
+			if strings.HasPrefix(prefix, rolledUp) || strings.HasPrefix(rolledUp, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *Aggregator) rolledUp(name string) bool {
+	return name != upMetric && hasPrefix(name, a.prefixes)
+}
+
+func (w *window) add(timestamp, value float64) {
+	w.count++
+	w.min = math.Min(w.min, value)
+	w.max = math.Max(w.max, value)
+	w.sum += value
+	if timestamp >= w.timestamp {
+		w.last, w.timestamp = value, timestamp
+	}
+	if w.digest != nil {
+		w.digest.Add(value)
+	}
+}
+
+// seriesKey identifies a series by its name, host and tags in any order.
+func seriesKey(metric Metric) string {
+	tags := append([]string{}, metric.Tags...)
+	sort.Strings(tags)
+	return metric.Metric + "\x00" + metric.Host + "\x00" + strings.Join(tags, "\x00")
+}
+
+// percentileName names a percentile like p50, p99 or p99_9.
+func percentileName(p float64) string {
+	// rounded, 0.999*100 is not quite 99.9
+	percent := math.Round(p*100*1e4) / 1e4
+	return "p" + strings.Replace(strconv.FormatFloat(percent, 'f', -1, 64), ".", "_", 1)
+}
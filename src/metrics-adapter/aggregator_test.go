@@ -0,0 +1,159 @@
+package metricsadapter_test
+
+import (
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Aggregator", func() {
+	var (
+		cfg        metricsadapter.AggregationConfig
+		aggregator *metricsadapter.Aggregator
+	)
+
+	sample := func(name string, ts, value float64, tags ...string) metricsadapter.Series {
+		if tags == nil {
+			tags = []string{}
+		}
+		return metricsadapter.Series{Series: metricsadapter.Metrics{{
+			Metric: name,
+			Points: metricsadapter.MetricPoints{{ts, value}},
+			Host:   "cactus",
+			Tags:   tags,
+		}}}
+	}
+
+	values := func(series metricsadapter.Series) map[string]float64 {
+		byName := map[string]float64{}
+		for _, metric := range series.Series {
+			byName[metric.Metric] = metric.Points[0][1]
+		}
+		return byName
+	}
+
+	BeforeEach(func() {
+		cfg = metricsadapter.AggregationConfig{Percentiles: []float64{0.5, 0.999}, Compression: 100}
+	})
+
+	JustBeforeEach(func() {
+		aggregator = metricsadapter.NewAggregator(cfg)
+	})
+
+	It("rolls the samples of a window up into min, max, mean, last and percentiles", func() {
+		for i := 1; i <= 100; i++ {
+			aggregator.Add(sample("garden.numGoroutines", float64(1000+i), float64(i)))
+		}
+		// a burst between two emits
+		aggregator.Add(sample("garden.numGoroutines", 1101, 10000))
+		aggregator.Add(sample("garden.numGoroutines", 1102, 50))
+
+		rollup := aggregator.Rollup()
+		Expect(rollup.Series).To(HaveLen(6))
+		for _, metric := range rollup.Series {
+			Expect(metric.Host).To(Equal("cactus"))
+			Expect(metric.Points[0][0]).To(Equal(1102.0))
+		}
+
+		v := values(rollup)
+		Expect(v["garden.numGoroutines.min"]).To(Equal(1.0))
+		Expect(v["garden.numGoroutines.max"]).To(Equal(10000.0))
+		Expect(v["garden.numGoroutines.mean"]).To(BeNumerically("~", (5050+10000+50)/102.0, 1e-9))
+		Expect(v["garden.numGoroutines.last"]).To(Equal(50.0))
+		Expect(v["garden.numGoroutines.p50"]).To(BeNumerically("~", 50, 2))
+		Expect(v["garden.numGoroutines.p99_9"]).To(BeNumerically(">", 100))
+	})
+
+	It("keeps series with different hosts or tags apart, whatever the order of their tags", func() {
+		aggregator.Add(sample("garden.containers", 1, 1, "a:1", "b:2"))
+		aggregator.Add(sample("garden.containers", 2, 3, "b:2", "a:1"))
+		aggregator.Add(sample("garden.containers", 2, 7, "a:2"))
+
+		rollup := aggregator.Rollup()
+		var maxes []float64
+		for _, metric := range rollup.Series {
+			if metric.Metric == "garden.containers.max" {
+				maxes = append(maxes, metric.Points[0][1])
+			}
+		}
+		Expect(maxes).To(ConsistOf(3.0, 7.0))
+	})
+
+	It("starts a new window after a rollup", func() {
+		aggregator.Add(sample("garden.memory", 1, 100))
+		aggregator.Rollup()
+
+		Expect(aggregator.Rollup().Series).To(BeEmpty())
+
+		aggregator.Add(sample("garden.memory", 2, 5))
+		Expect(values(aggregator.Rollup())["garden.memory.max"]).To(Equal(5.0))
+	})
+
+	Context("when only some metrics are rolled up", func() {
+		BeforeEach(func() {
+			cfg.Metrics = []string{"garden.numGoroutines"}
+		})
+
+		It("emits the others with their last sample", func() {
+			aggregator.Add(sample("garden.memory", 1, 100))
+			aggregator.Add(sample("garden.memory", 2, 200))
+			aggregator.Add(sample("garden.numGoroutines", 2, 10))
+
+			v := values(aggregator.Rollup())
+			Expect(v).To(HaveKeyWithValue("garden.memory", 200.0))
+			Expect(v).To(HaveKey("garden.numGoroutines.max"))
+			Expect(v).NotTo(HaveKey("garden.memory.max"))
+		})
+	})
+
+	It("emits whether targets are up with their last sample", func() {
+		aggregator.Add(sample("metrics_adapter.up", 1, 1, "target:garden-debug"))
+		aggregator.Add(sample("metrics_adapter.up", 2, 0, "target:garden-debug"))
+
+		v := values(aggregator.Rollup())
+		Expect(v).To(Equal(map[string]float64{"metrics_adapter.up": 0}))
+	})
+
+	Describe("Samples", func() {
+		BeforeEach(func() {
+			cfg.Metrics = []string{"garden.num", "host.cpu."}
+		})
+
+		It("tells whether a collector collects metrics that are rolled up", func() {
+			Expect(aggregator.Samples([]string{"garden.numGoroutines", "garden.memory"})).To(BeTrue())
+			Expect(aggregator.Samples([]string{"host."})).To(BeTrue())
+			Expect(aggregator.Samples([]string{"garden.goroutines"})).To(BeFalse())
+			Expect(aggregator.Samples(nil)).To(BeFalse())
+		})
+
+		Context("when every metric is rolled up", func() {
+			BeforeEach(func() {
+				cfg.Metrics = nil
+			})
+
+			It("samples every collector", func() {
+				Expect(aggregator.Samples([]string{"garden.goroutines"})).To(BeTrue())
+			})
+		})
+	})
+
+	It("keeps the samples of the series still rolled up when it is reconfigured", func() {
+		aggregator.Add(sample("garden.numGoroutines", 1, 10))
+		aggregator.Add(sample("garden.memory", 1, 100))
+
+		aggregator.Reconfigure(metricsadapter.AggregationConfig{
+			Percentiles: []float64{0.9},
+			Compression: 100,
+			Metrics:     []string{"garden.numGoroutines"},
+		})
+		aggregator.Add(sample("garden.numGoroutines", 2, 30))
+		aggregator.Add(sample("garden.memory", 2, 200))
+
+		v := values(aggregator.Rollup())
+		Expect(v["garden.numGoroutines.min"]).To(Equal(10.0))
+		Expect(v["garden.numGoroutines.max"]).To(Equal(30.0))
+		Expect(v).To(HaveKey("garden.numGoroutines.p90"))
+		Expect(v).NotTo(HaveKey("garden.numGoroutines.p50"))
+		Expect(v).To(HaveKeyWithValue("garden.memory", 200.0))
+	})
+})
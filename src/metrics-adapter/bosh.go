@@ -0,0 +1,137 @@
+package metricsadapter
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// BOSHInstance is what the BOSH agent knows about the instance the adapter
+// runs on, read from the spec it was last applied and from its settings.
+type BOSHInstance struct {
+	Deployment    string
+	InstanceGroup string
+	Index         string
+	AZ            string
+	ID            string
+	IP            string
+}
+
+type boshNetwork struct {
+	IP      string   `json:"ip"`
+	Default []string `json:"default"`
+}
+
+type boshSpec struct {
+	Deployment string                 `json:"deployment"`
+	Name       string                 `json:"name"`
+	Index      *int                   `json:"index"`
+	AZ         string                 `json:"az"`
+	ID         string                 `json:"id"`
+	Networks   map[string]boshNetwork `json:"networks"`
+}
+
+type boshSettings struct {
+	Networks map[string]boshNetwork `json:"networks"`
+}
+
+// ReadBOSHInstance reads bosh/spec.json and bosh/settings.json under root,
+// /var/vcap on a BOSH VM. The IP is the one on the network with the default
+// gateway, taken from the settings when the spec has none, as it does for
+// dynamic networks.
+func ReadBOSHInstance(root string) (BOSHInstance, error) {
+	var spec boshSpec
+	if err := readJSON(filepath.Join(root, "bosh", "spec.json"), &spec); err != nil {
+		return BOSHInstance{}, err
+	}
+	if spec.Deployment == "" || spec.Name == "" {
+		return BOSHInstance{}, errors.New("bosh spec names no deployment or instance group, is the instance deployed?")
+	}
+
+	instance := BOSHInstance{
+		Deployment:    spec.Deployment,
+		InstanceGroup: spec.Name,
+		AZ:            spec.AZ,
+		ID:            spec.ID,
+		IP:            defaultIP(spec.Networks),
+	}
+	if spec.Index != nil {
+		instance.Index = strconv.Itoa(*spec.Index)
+	}
+
+	if instance.IP == "" {
+		var settings boshSettings
+		err := readJSON(filepath.Join(root, "bosh", "settings.json"), &settings)
+		if err != nil && !os.IsNotExist(err) {
+			return BOSHInstance{}, err
+		}
+		instance.IP = defaultIP(settings.Networks)
+	}
+
+	return instance, nil
+}
+
+// Host names the instance <deployment>.<instance group>.<index>, or by its id
+// when it has no index.
+func (i BOSHInstance) Host() string {
+	index := i.Index
+	if index == "" {
+		index = i.ID
+	}
+	return i.Deployment + "." + i.InstanceGroup + "." + index
+}
+
+// Tags returns the deployment, instance_group, index, az, instance_id and ip
+// tags of the instance, leaving out those it does not know.
+func (i BOSHInstance) Tags() map[string]string {
+	tags := map[string]string{}
+	for key, value := range map[string]string{
+		"deployment":     i.Deployment,
+		"instance_group": i.InstanceGroup,
+		"index":          i.Index,
+		"az":             i.AZ,
+		"instance_id":    i.ID,
+		"ip":             i.IP,
+	} {
+		if value != "" {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// defaultIP returns the IP on the network with the default gateway, or on
+// the first network by name when none has it.
+func defaultIP(networks map[string]boshNetwork) string {
+	var names []string
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, d := range networks[name].Default {
+			if d == "gateway" {
+				return networks[name].IP
+			}
+		}
+	}
+	for _, name := range names {
+		if ip := networks[name].IP; ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+func readJSON(path string, v interface{}) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(contents, v)
+}
@@ -0,0 +1,87 @@
+package metricsadapter_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ReadBOSHInstance", func() {
+	var root string
+
+	writeBOSHFile := func(name, contents string) {
+		Expect(ioutil.WriteFile(filepath.Join(root, "bosh", name), []byte(contents), 0600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "vcap")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(root, "bosh"), 0755)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	It("reads the instance from the spec, with the ip on the network with the default gateway", func() {
+		writeBOSHFile("spec.json", `{
+			"deployment": "cf",
+			"name": "diego-cell",
+			"index": 3,
+			"az": "z2",
+			"id": "0b1c2d3e",
+			"networks": {
+				"a-services": {"ip": "10.0.16.9", "default": []},
+				"default": {"ip": "10.0.1.7", "default": ["dns", "gateway"]}
+			}
+		}`)
+
+		instance, err := metricsadapter.ReadBOSHInstance(root)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(instance).To(Equal(metricsadapter.BOSHInstance{
+			Deployment:    "cf",
+			InstanceGroup: "diego-cell",
+			Index:         "3",
+			AZ:            "z2",
+			ID:            "0b1c2d3e",
+			IP:            "10.0.1.7",
+		}))
+		Expect(instance.Host()).To(Equal("cf.diego-cell.3"))
+		Expect(instance.Tags()).To(Equal(map[string]string{
+			"deployment":     "cf",
+			"instance_group": "diego-cell",
+			"index":          "3",
+			"az":             "z2",
+			"instance_id":    "0b1c2d3e",
+			"ip":             "10.0.1.7",
+		}))
+	})
+
+	It("takes the ip from the settings when the spec has none", func() {
+		writeBOSHFile("spec.json", `{"deployment": "cf", "name": "diego-cell", "id": "0b1c2d3e", "networks": {"default": {"default": ["gateway"]}}}`)
+		writeBOSHFile("settings.json", `{"agent_id": "a1", "networks": {"default": {"ip": "10.0.1.8", "default": ["gateway"]}}}`)
+
+		instance, err := metricsadapter.ReadBOSHInstance(root)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(instance.IP).To(Equal("10.0.1.8"))
+		Expect(instance.Host()).To(Equal("cf.diego-cell.0b1c2d3e"))
+		Expect(instance.Tags()).NotTo(HaveKey("az"))
+	})
+
+	It("fails when the instance is not deployed", func() {
+		writeBOSHFile("spec.json", `{}`)
+
+		_, err := metricsadapter.ReadBOSHInstance(root)
+		Expect(err).To(MatchError(ContainSubstring("is the instance deployed?")))
+	})
+
+	It("fails when there is no spec", func() {
+		_, err := metricsadapter.ReadBOSHInstance(root)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,216 @@
+package metricsadapter
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const (
+	canaryHandlePrefix = "metrics-adapter-canary-"
+	canaryOutput       = "garden-canary"
+	canaryGraceTime    = 5 * time.Minute
+)
+
+type CanaryError struct {
+	Phase string
+	Err   error
+}
+
+func (e CanaryError) Error() string {
+	return fmt.Sprintf("canary %s failed: %s", e.Phase, e.Err)
+}
+
+// Canary exercises the garden API end to end: it creates a container, runs a
+// process in it, streams the process output and destroys the container again.
+type Canary struct {
+	client  garden.Client
+	host    string
+	rootFS  string
+	timeout time.Duration
+}
+
+func NewCanary(client garden.Client, host string, cfg CanaryConfig) *Canary {
+	return &Canary{
+		client:  client,
+		host:    host,
+		rootFS:  cfg.RootFS,
+		timeout: cfg.Timeout,
+	}
+}
+
+// Probe runs a single canary cycle. The returned series holds the latency and
+// success of every phase that was attempted, and is populated even when the
+// probe fails. A failed probe returns a CanaryError naming the first phase that
+// failed.
+func (c *Canary) Probe() (Series, error) {
+	now := time.Now().Unix()
+	probe := canaryProbe{timestamp: now, host: c.host}
+
+	handle := fmt.Sprintf("%s%d", canaryHandlePrefix, time.Now().UnixNano())
+
+	var container garden.Container
+	err := probe.phase("create", func() error {
+		var err error
+		container, err = c.client.Create(garden.ContainerSpec{
+			Handle:    handle,
+			GraceTime: canaryGraceTime,
+			Image:     garden.ImageRef{URI: c.rootFS},
+		})
+		return err
+	})
+	if err != nil {
+		return probe.series(err), err
+	}
+
+	probeErr := c.runProcess(&probe, container)
+
+	err = probe.phase("destroy", func() error {
+		return c.client.Destroy(handle)
+	})
+	if probeErr == nil {
+		probeErr = err
+	}
+
+	return probe.series(probeErr), probeErr
+}
+
+func (c *Canary) runProcess(probe *canaryProbe, container garden.Container) error {
+	stdout := new(syncBuffer)
+	stderr := new(syncBuffer)
+
+	var process garden.Process
+	err := probe.phase("run", func() error {
+		var err error
+		process, err = container.Run(garden.ProcessSpec{
+			Path: "echo",
+			Args: []string{canaryOutput},
+		}, garden.ProcessIO{
+			Stdout: stdout,
+			Stderr: stderr,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return probe.phase("stream", func() error {
+		exitCode, err := c.wait(process)
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("process exited with status %d: %s", exitCode, strings.TrimSpace(stderr.String()))
+		}
+		if output := strings.TrimSpace(stdout.String()); output != canaryOutput {
+			return fmt.Errorf("unexpected process output %q", output)
+		}
+		return nil
+	})
+}
+
+func (c *Canary) wait(process garden.Process) (int, error) {
+	type result struct {
+		exitCode int
+		err      error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		exitCode, err := process.Wait()
+		done <- result{exitCode: exitCode, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.exitCode, r.err
+	case <-time.After(c.timeout):
+		return 0, fmt.Errorf("timed out after %s waiting for process to exit", c.timeout)
+	}
+}
+
+// EmitCanaryFailure sends a Wavefront event describing a failed canary probe.
+func EmitCanaryFailure(probeErr error, host string, wfSender wavefront.Sender) error {
+	phase := "unknown"
+	if canaryErr, ok := probeErr.(CanaryError); ok {
+		phase = canaryErr.Phase
+	}
+
+	now := nowMillis()
+	return wfSender.SendEvent(
+		"garden canary failed",
+		now, now+1,
+		host,
+		map[string]string{"phase": phase},
+		event.Severity("warn"),
+		event.Type("garden-canary"),
+		event.Details(probeErr.Error()),
+	)
+}
+
+type canaryProbe struct {
+	timestamp int64
+	host      string
+	metrics   Metrics
+	duration  time.Duration
+}
+
+func (p *canaryProbe) phase(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start)
+	p.duration += elapsed
+
+	p.metrics = append(p.metrics,
+		p.metric("garden.canary."+name+".duration", elapsed.Seconds()),
+		p.metric("garden.canary."+name+".success", boolToFloat(err == nil)),
+	)
+
+	if err != nil {
+		return CanaryError{Phase: name, Err: err}
+	}
+	return nil
+}
+
+func (p *canaryProbe) series(probeErr error) Series {
+	metrics := append(p.metrics,
+		p.metric("garden.canary.duration", p.duration.Seconds()),
+		p.metric("garden.canary.success", boolToFloat(probeErr == nil)),
+	)
+	return Series{Series: metrics}
+}
+
+func (p *canaryProbe) metric(name string, value float64) Metric {
+	return newMetric(name, p.timestamp, value, p.host)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,248 @@
+package metricsadapter_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/garden/client"
+	"code.cloudfoundry.org/garden/client/connection"
+	"code.cloudfoundry.org/garden/gardenfakes"
+	"code.cloudfoundry.org/garden/server"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/masters-of-cats/metricsadapter"
+	fakes "github.com/masters-of-cats/metricsadapter/metrics-adapterfakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Canary", func() {
+	var (
+		tmpDir        string
+		gardenServer  *server.GardenServer
+		backend       *gardenfakes.FakeBackend
+		fakeContainer *gardenfakes.FakeContainer
+		fakeProcess   *gardenfakes.FakeProcess
+
+		canary   *metricsadapter.Canary
+		series   metricsadapter.Series
+		probeErr error
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "canary")
+		Expect(err).NotTo(HaveOccurred())
+		socketPath := filepath.Join(tmpDir, "garden.sock")
+
+		fakeProcess = new(gardenfakes.FakeProcess)
+		fakeProcess.IDReturns("canary-process")
+		fakeProcess.WaitReturns(0, nil)
+
+		fakeContainer = new(gardenfakes.FakeContainer)
+		fakeContainer.HandleReturns("canary-handle")
+		fakeContainer.RunStub = func(spec garden.ProcessSpec, processIO garden.ProcessIO) (garden.Process, error) {
+			_, err := processIO.Stdout.Write([]byte("garden-canary\n"))
+			Expect(err).NotTo(HaveOccurred())
+			return fakeProcess, nil
+		}
+
+		backend = new(gardenfakes.FakeBackend)
+		backend.CreateReturns(fakeContainer, nil)
+		backend.LookupReturns(fakeContainer, nil)
+
+		gardenServer = server.New("unix", socketPath, 0, backend, lagertest.NewTestLogger("garden"))
+		Expect(gardenServer.Start()).To(Succeed())
+
+		gardenClient := client.New(connection.New("unix", socketPath))
+		canary = metricsadapter.NewCanary(gardenClient, "cactus", metricsadapter.CanaryConfig{
+			RootFS:  "docker:///busybox",
+			Timeout: time.Second,
+		})
+	})
+
+	AfterEach(func() {
+		gardenServer.Stop()
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	JustBeforeEach(func() {
+		series, probeErr = canary.Probe()
+	})
+
+	metricValue := func(name string) float64 {
+		for _, m := range series.Series {
+			if m.Metric == name {
+				Expect(m.Host).To(Equal("cactus"))
+				return m.Points[0][1]
+			}
+		}
+		Fail("metric " + name + " was not emitted")
+		return 0
+	}
+
+	metricNames := func() []string {
+		var names []string
+		for _, m := range series.Series {
+			names = append(names, m.Metric)
+		}
+		return names
+	}
+
+	It("does not return an error", func() {
+		Expect(probeErr).NotTo(HaveOccurred())
+	})
+
+	It("creates a container with the configured rootfs", func() {
+		Expect(backend.CreateCallCount()).To(Equal(1))
+		spec := backend.CreateArgsForCall(0)
+		Expect(spec.Handle).To(HavePrefix("metrics-adapter-canary-"))
+		Expect(spec.Image.URI).To(Equal("docker:///busybox"))
+		Expect(spec.GraceTime).NotTo(BeZero())
+	})
+
+	It("runs a process in the container", func() {
+		Expect(fakeContainer.RunCallCount()).To(Equal(1))
+		spec, _ := fakeContainer.RunArgsForCall(0)
+		Expect(spec.Path).To(Equal("echo"))
+		Expect(spec.Args).To(ConsistOf("garden-canary"))
+	})
+
+	It("destroys the container", func() {
+		Expect(backend.DestroyCallCount()).To(Equal(1))
+		Expect(backend.DestroyArgsForCall(0)).To(Equal(backend.CreateArgsForCall(0).Handle))
+	})
+
+	It("reports the latency and success of every phase", func() {
+		Expect(metricNames()).To(ConsistOf(
+			"garden.canary.create.duration", "garden.canary.create.success",
+			"garden.canary.run.duration", "garden.canary.run.success",
+			"garden.canary.stream.duration", "garden.canary.stream.success",
+			"garden.canary.destroy.duration", "garden.canary.destroy.success",
+			"garden.canary.duration", "garden.canary.success",
+		))
+
+		for _, phase := range []string{"create", "run", "stream", "destroy"} {
+			Expect(metricValue("garden.canary." + phase + ".success")).To(Equal(1.0))
+			Expect(metricValue("garden.canary." + phase + ".duration")).To(BeNumerically(">", 0))
+		}
+		Expect(metricValue("garden.canary.success")).To(Equal(1.0))
+	})
+
+	When("creating the container fails", func() {
+		BeforeEach(func() {
+			backend.CreateReturns(nil, errors.New("no space left"))
+		})
+
+		It("returns an error naming the phase", func() {
+			Expect(probeErr).To(MatchError(ContainSubstring("no space left")))
+			Expect(probeErr.(metricsadapter.CanaryError).Phase).To(Equal("create"))
+		})
+
+		It("does not attempt the later phases", func() {
+			Expect(metricNames()).To(ConsistOf(
+				"garden.canary.create.duration", "garden.canary.create.success",
+				"garden.canary.duration", "garden.canary.success",
+			))
+			Expect(metricValue("garden.canary.create.success")).To(Equal(0.0))
+			Expect(metricValue("garden.canary.success")).To(Equal(0.0))
+		})
+	})
+
+	When("the process writes unexpected output", func() {
+		BeforeEach(func() {
+			fakeContainer.RunStub = func(spec garden.ProcessSpec, processIO garden.ProcessIO) (garden.Process, error) {
+				_, err := processIO.Stdout.Write([]byte("something else\n"))
+				Expect(err).NotTo(HaveOccurred())
+				return fakeProcess, nil
+			}
+		})
+
+		It("fails the stream phase", func() {
+			Expect(probeErr.(metricsadapter.CanaryError).Phase).To(Equal("stream"))
+			Expect(metricValue("garden.canary.stream.success")).To(Equal(0.0))
+		})
+
+		It("still destroys the container", func() {
+			Expect(backend.DestroyCallCount()).To(Equal(1))
+			Expect(metricValue("garden.canary.destroy.success")).To(Equal(1.0))
+		})
+	})
+
+	When("the process exits non-zero", func() {
+		BeforeEach(func() {
+			fakeProcess.WaitReturns(1, nil)
+		})
+
+		It("fails the stream phase", func() {
+			Expect(probeErr.(metricsadapter.CanaryError).Phase).To(Equal("stream"))
+			Expect(probeErr).To(MatchError(ContainSubstring("status 1")))
+		})
+	})
+
+	When("the process does not exit in time", func() {
+		BeforeEach(func() {
+			fakeProcess.WaitStub = func() (int, error) {
+				time.Sleep(2 * time.Second)
+				return 0, nil
+			}
+		})
+
+		It("fails the stream phase", func() {
+			Expect(probeErr.(metricsadapter.CanaryError).Phase).To(Equal("stream"))
+			Expect(probeErr).To(MatchError(ContainSubstring("timed out")))
+		})
+	})
+
+	When("destroying the container fails", func() {
+		BeforeEach(func() {
+			backend.DestroyReturns(errors.New("device busy"))
+		})
+
+		It("fails the destroy phase", func() {
+			Expect(probeErr.(metricsadapter.CanaryError).Phase).To(Equal("destroy"))
+			Expect(metricValue("garden.canary.destroy.success")).To(Equal(0.0))
+			Expect(metricValue("garden.canary.success")).To(Equal(0.0))
+		})
+	})
+
+	Describe("EmitCanaryFailure", func() {
+		var wfSender *fakes.FakeSender
+
+		BeforeEach(func() {
+			wfSender = new(fakes.FakeSender)
+		})
+
+		It("sends an event naming the failed phase", func() {
+			err := metricsadapter.EmitCanaryFailure(metricsadapter.CanaryError{Phase: "run", Err: errors.New("boom")}, "cactus", wfSender)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(wfSender.SendEventCallCount()).To(Equal(1))
+			name, startMillis, endMillis, source, tags, setters := wfSender.SendEventArgsForCall(0)
+			Expect(name).To(Equal("garden canary failed"))
+			Expect(endMillis).To(BeNumerically(">", startMillis))
+			Expect(source).To(Equal("cactus"))
+			Expect(tags).To(Equal(map[string]string{"phase": "run"}))
+
+			annotations := map[string]interface{}{"annotations": map[string]string{}}
+			for _, setter := range setters {
+				setter(annotations)
+			}
+			Expect(annotations["annotations"]).To(HaveKeyWithValue("details", "canary run failed: boom"))
+		})
+
+		When("sending the event fails", func() {
+			BeforeEach(func() {
+				wfSender.SendEventReturns(errors.New("wf-error"))
+			})
+
+			It("returns the error", func() {
+				err := metricsadapter.EmitCanaryFailure(errors.New("boom"), "cactus", wfSender)
+				Expect(err).To(MatchError("wf-error"))
+			})
+		})
+	})
+})
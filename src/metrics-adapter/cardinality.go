@@ -0,0 +1,398 @@
+package metricsadapter
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	CardinalityFold = "fold"
+	CardinalityDrop = "drop"
+
+	limitSeries    = "series"
+	limitTagValues = "tag_values"
+)
+
+// distinct keeps the distinct values seen lately, up to a limit. The limit
+// does not apply to the value everything beyond it is folded into.
+type distinct struct {
+	limit int
+	seen  map[string]time.Time
+}
+
+func newDistinct(limit int) *distinct {
+	return &distinct{limit: limit, seen: map[string]time.Time{}}
+}
+
+// allows tells whether the value is within the limit, without counting it.
+func (d *distinct) allows(value string) bool {
+	_, ok := d.seen[value]
+	return ok || d.limit <= 0 || len(d.seen) < d.limit || value == otherGroup
+}
+
+func (d *distinct) expire(before time.Time) {
+	for value, seen := range d.seen {
+		if seen.Before(before) {
+			delete(d.seen, value)
+		}
+	}
+}
+
+// cardinality is what a CardinalityLimiter counts for all metrics, or for
+// one metric: its series, and the values of each of its tag keys.
+type cardinality struct {
+	limits    CardinalityLimits
+	series    *distinct
+	tagValues map[string]*distinct
+}
+
+func newCardinality(limits CardinalityLimits) *cardinality {
+	return &cardinality{limits: limits, series: newDistinct(limits.MaxSeries), tagValues: map[string]*distinct{}}
+}
+
+func (c *cardinality) allowsTag(key, value string) bool {
+	values, ok := c.tagValues[key]
+	return !ok || values.allows(value)
+}
+
+// count counts the series and its tag values as seen now.
+func (c *cardinality) count(metric Metric, now time.Time) {
+	c.series.seen[seriesKey(metric)] = now
+	for _, tag := range metric.Tags {
+		key, value, ok := splitTag(tag)
+		if !ok {
+			continue
+		}
+
+		values, ok := c.tagValues[key]
+		if !ok {
+			values = newDistinct(c.limits.MaxTagValues)
+			c.tagValues[key] = values
+		}
+		values.seen[value] = now
+	}
+}
+
+func (c *cardinality) expire(before time.Time) {
+	c.series.expire(before)
+	for key, values := range c.tagValues {
+		values.expire(before)
+		if len(values.seen) == 0 {
+			delete(c.tagValues, key)
+		}
+	}
+}
+
+// overflow counts how many times an offender went over its limit, and when
+// it last did.
+type overflow struct {
+	count int64
+	last  time.Time
+}
+
+// offender is a metric that went over a limit, on the values of a tag key or
+// on its series.
+type offender struct {
+	metric string
+	limit  string
+	tag    string
+}
+
+// CardinalityLimiter bounds the number of series the adapter emits, so that
+// tags made of container handles, log messages or goroutine functions do not
+// get it throttled. It limits the distinct series of all metrics and the
+// distinct values of each tag key across all metrics, and the same for the
+// metrics starting with a prefix that has limits of its own. Series and tag
+// values not seen for the expiry are forgotten and no longer count.
+//
+// Beyond a limit, a tag value is folded into "other", or the series dropped.
+// A series beyond a series limit has all of its tag values folded into
+// "other", or is dropped. Series folded into the same one in a poll are
+// added up, as the goroutine collector adds up its smallest groups. That
+// suits counters and gauges of amounts, such as memory or goroutines, whose
+// folded series is the total of the others; a gauge that is not an amount,
+// such as a ratio, is meaningless added up, and should be dropped instead.
+//
+// It is a Collector of
+//
+//   - metrics_adapter.cardinality.series: distinct series of all metrics
+//   - metrics_adapter.cardinality.overflows: series that went over a limit,
+//     tagged with the metric and limit:series or limit:tag_values, until
+//     the metric has not gone over it for the expiry
+//
+// and logs the metrics that went over limits the most every report interval.
+type CardinalityLimiter struct {
+	logger         lager.Logger
+	host           string
+	overflow       string
+	expiry         time.Duration
+	reportInterval time.Duration
+	top            int
+	prefixes       []MetricCardinalityLimits
+
+	mu         sync.Mutex
+	global     *cardinality
+	metrics    map[string]*cardinality
+	overflows  map[offender]overflow
+	offenders  map[offender]int
+	lastReport time.Time
+}
+
+func NewCardinalityLimiter(logger lager.Logger, host string, cfg CardinalityConfig) *CardinalityLimiter {
+	return &CardinalityLimiter{
+		logger:         logger,
+		host:           host,
+		overflow:       cfg.Overflow,
+		expiry:         cfg.Expiry,
+		reportInterval: cfg.ReportInterval,
+		top:            cfg.Top,
+		prefixes:       cfg.Metrics,
+		global:         newCardinality(cfg.CardinalityLimits),
+		metrics:        map[string]*cardinality{},
+		overflows:      map[offender]overflow{},
+		offenders:      map[offender]int{},
+	}
+}
+
+// Limit returns the series of a poll within the limits.
+func (l *CardinalityLimiter) Limit(series Series) Series {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.expire(now.Add(-l.expiry))
+
+	var (
+		limited Series
+		folded  = map[string]int{}
+	)
+	for _, metric := range series.Series {
+		metric, fold, ok := l.limit(metric, now)
+		if !ok {
+			continue
+		}
+
+		if fold {
+			key := seriesKey(metric)
+			if i, ok := folded[key]; ok {
+				addPoints(&limited.Series[i], metric.Points)
+				continue
+			}
+			folded[key] = len(limited.Series)
+			metric.Points = append(MetricPoints{}, metric.Points...)
+		}
+		limited.Series = append(limited.Series, metric)
+	}
+
+	if len(l.offenders) > 0 && now.Sub(l.lastReport) >= l.reportInterval {
+		l.report()
+		l.lastReport = now
+	}
+
+	return limited
+}
+
+// expire forgets the series, tag values and overflows not seen since before.
+func (l *CardinalityLimiter) expire(before time.Time) {
+	l.global.expire(before)
+	for name, c := range l.metrics {
+		c.expire(before)
+		if len(c.series.seen) == 0 {
+			delete(l.metrics, name)
+		}
+	}
+	for o, overflow := range l.overflows {
+		if overflow.last.Before(before) {
+			delete(l.overflows, o)
+		}
+	}
+}
+
+// LimitTags returns the tags of something sent on its own, rather than in
+// the series of a poll, within the limits, or false when it is dropped. The
+// tags are key:value, and the name and source count as those of a series.
+func (l *CardinalityLimiter) LimitTags(name, source string, tags []string) ([]string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	metric, _, ok := l.limit(Metric{Metric: name, Host: source, Tags: tags}, time.Now())
+	return metric.Tags, ok
+}
+
+// limit returns the series with the tag values beyond the limits folded, and
+// whether it was folded at all, or false when it is dropped. Only what is
+// emitted counts towards the limits: a value that the limits of all metrics
+// allow but those of the metric do not is not counted for all metrics.
+func (l *CardinalityLimiter) limit(metric Metric, now time.Time) (Metric, bool, bool) {
+	counted := []*cardinality{l.global}
+	if perMetric := l.cardinalityOf(metric.Metric); perMetric != nil {
+		counted = append(counted, perMetric)
+	}
+
+	// the tags are copied before folding any, they are the collector's
+	fold := false
+	tags := metric.Tags
+	for i, tag := range metric.Tags {
+		key, value, ok := splitTag(tag)
+		if !ok || allowTag(counted, key, value) {
+			continue
+		}
+
+		l.overflowed(offender{metric: metric.Metric, limit: limitTagValues, tag: key}, now)
+		if l.overflow == CardinalityDrop {
+			return Metric{}, false, false
+		}
+		if !fold {
+			tags = append([]string{}, metric.Tags...)
+			fold = true
+		}
+		tags[i] = key + ":" + otherGroup
+	}
+	metric.Tags = tags
+
+	if !allowSeries(counted, seriesKey(metric)) {
+		l.overflowed(offender{metric: metric.Metric, limit: limitSeries}, now)
+		if l.overflow == CardinalityDrop {
+			return Metric{}, false, false
+		}
+
+		// the folded series counts like any other, beyond the limit
+		metric.Tags = make([]string, len(tags))
+		for i, tag := range tags {
+			metric.Tags[i] = strings.SplitN(tag, ":", 2)[0] + ":" + otherGroup
+		}
+		fold = true
+	}
+
+	for _, c := range counted {
+		c.count(metric, now)
+	}
+	return metric, fold, true
+}
+
+func allowTag(counted []*cardinality, key, value string) bool {
+	for _, c := range counted {
+		if !c.allowsTag(key, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func allowSeries(counted []*cardinality, key string) bool {
+	for _, c := range counted {
+		if !c.series.allows(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitTag splits a key:value tag, or returns false for a tag without a
+// value.
+func splitTag(tag string) (string, string, bool) {
+	parts := strings.SplitN(tag, ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// cardinalityOf returns what is counted for a metric that starts with a
+// prefix with limits of its own, or nil.
+func (l *CardinalityLimiter) cardinalityOf(name string) *cardinality {
+	for _, limits := range l.prefixes {
+		if !strings.HasPrefix(name, limits.Prefix) {
+			continue
+		}
+
+		c, ok := l.metrics[name]
+		if !ok {
+			c = newCardinality(limits.CardinalityLimits)
+			l.metrics[name] = c
+		}
+		return c
+	}
+	return nil
+}
+
+func (l *CardinalityLimiter) overflowed(o offender, now time.Time) {
+	key := offender{metric: o.metric, limit: o.limit}
+	l.overflows[key] = overflow{count: l.overflows[key].count + 1, last: now}
+	l.offenders[o]++
+}
+
+// report logs the metrics and tag keys that went over limits the most since
+// the last report.
+func (l *CardinalityLimiter) report() {
+	offenders := make([]offender, 0, len(l.offenders))
+	for o := range l.offenders {
+		offenders = append(offenders, o)
+	}
+	sort.Slice(offenders, func(i, j int) bool {
+		if l.offenders[offenders[i]] != l.offenders[offenders[j]] {
+			return l.offenders[offenders[i]] > l.offenders[offenders[j]]
+		}
+		return offenders[i].metric+offenders[i].tag < offenders[j].metric+offenders[j].tag
+	})
+	if len(offenders) > l.top {
+		offenders = offenders[:l.top]
+	}
+
+	var worst []lager.Data
+	for _, o := range offenders {
+		data := lager.Data{"metric": o.metric, "limit": o.limit, "overflows": l.offenders[o]}
+		if o.tag != "" {
+			data["tag"] = o.tag
+		}
+		worst = append(worst, data)
+	}
+	l.logger.Info("limits-exceeded", lager.Data{"overflow": l.overflow, "offenders": worst})
+
+	l.offenders = map[offender]int{}
+}
+
+func (l *CardinalityLimiter) Collect() (Series, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.expire(now.Add(-l.expiry))
+
+	overflows := make([]offender, 0, len(l.overflows))
+	for o := range l.overflows {
+		overflows = append(overflows, o)
+	}
+	sort.Slice(overflows, func(i, j int) bool {
+		return overflows[i].metric+overflows[i].limit < overflows[j].metric+overflows[j].limit
+	})
+
+	s := &sample{timestamp: now.Unix(), host: l.host}
+	s.add("metrics_adapter.cardinality.series", float64(len(l.global.series.seen)))
+	for _, o := range overflows {
+		s.add("metrics_adapter.cardinality.overflows", float64(l.overflows[o].count), "metric:"+o.metric, "limit:"+o.limit)
+	}
+	return Series{Series: s.metrics}, nil
+}
+
+// addPoints adds the values of points to those of the metric with the same
+// timestamps, or appends them.
+func addPoints(metric *Metric, points MetricPoints) {
+	for _, point := range points {
+		added := false
+		for i := range metric.Points {
+			if metric.Points[i][0] == point[0] {
+				metric.Points[i][1] += point[1]
+				added = true
+				break
+			}
+		}
+		if !added {
+			metric.Points = append(metric.Points, point)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package metricsadapter_test
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("CardinalityLimiter", func() {
+	var (
+		cfg     metricsadapter.CardinalityConfig
+		logger  *lagertest.TestLogger
+		limiter *metricsadapter.CardinalityLimiter
+	)
+
+	metric := func(name string, value float64, tags ...string) metricsadapter.Metric {
+		return metricsadapter.Metric{
+			Metric: name,
+			Points: metricsadapter.MetricPoints{{1000, value}},
+			Host:   "cactus",
+			Tags:   tags,
+		}
+	}
+
+	limit := func(metrics ...metricsadapter.Metric) metricsadapter.Metrics {
+		return limiter.Limit(metricsadapter.Series{Series: metrics}).Series
+	}
+
+	BeforeEach(func() {
+		cfg = metricsadapter.CardinalityConfig{
+			Overflow:       metricsadapter.CardinalityFold,
+			Expiry:         time.Hour,
+			ReportInterval: time.Hour,
+			Top:            10,
+		}
+		logger = lagertest.NewTestLogger("test")
+	})
+
+	JustBeforeEach(func() {
+		limiter = metricsadapter.NewCardinalityLimiter(logger, "cactus", cfg)
+	})
+
+	Context("with a limit on the values of each tag key", func() {
+		BeforeEach(func() {
+			cfg.MaxTagValues = 2
+		})
+
+		It("folds the values beyond it into other, adding up the series folded together", func() {
+			Expect(limit(
+				metric("garden.containers.cpu", 1, "handle:a", "app:x"),
+				metric("garden.containers.cpu", 2, "handle:b", "app:x"),
+				metric("garden.containers.cpu", 3, "handle:c", "app:x"),
+				metric("garden.containers.cpu", 4, "handle:d", "app:x"),
+			)).To(Equal(metricsadapter.Metrics{
+				metric("garden.containers.cpu", 1, "handle:a", "app:x"),
+				metric("garden.containers.cpu", 2, "handle:b", "app:x"),
+				metric("garden.containers.cpu", 7, "handle:other", "app:x"),
+			}))
+		})
+
+		It("keeps letting through the values seen before the limit was reached", func() {
+			limit(metric("garden.containers.cpu", 1, "handle:a"), metric("garden.containers.cpu", 1, "handle:b"))
+
+			Expect(limit(metric("garden.containers.cpu", 5, "handle:c"), metric("garden.containers.cpu", 5, "handle:b"))).To(Equal(metricsadapter.Metrics{
+				metric("garden.containers.cpu", 5, "handle:other"),
+				metric("garden.containers.cpu", 5, "handle:b"),
+			}))
+		})
+
+		It("counts the overflows, and logs the worst offenders", func() {
+			limit(
+				metric("garden.containers.cpu", 1, "handle:a"),
+				metric("garden.containers.cpu", 1, "handle:b"),
+				metric("garden.containers.cpu", 1, "handle:c"),
+				metric("garden.containers.memory", 1, "handle:d"),
+				metric("garden.containers.memory", 1, "handle:e"),
+			)
+
+			series, err := limiter.Collect()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(series.Series).To(HaveLen(3))
+			Expect(series.Series[0].Metric).To(Equal("metrics_adapter.cardinality.series"))
+			Expect(series.Series[0].Points[0][1]).To(Equal(4.0))
+			Expect(series.Series[1].Metric).To(Equal("metrics_adapter.cardinality.overflows"))
+			Expect(series.Series[1].Tags).To(Equal([]string{"metric:garden.containers.cpu", "limit:tag_values"}))
+			Expect(series.Series[1].Points[0][1]).To(Equal(1.0))
+			Expect(series.Series[2].Tags).To(Equal([]string{"metric:garden.containers.memory", "limit:tag_values"}))
+			Expect(series.Series[2].Points[0][1]).To(Equal(2.0))
+
+			Expect(logger).To(gbytes.Say(`"message":"test.limits-exceeded".*"offenders":\[{"limit":"tag_values","metric":"garden.containers.memory","overflows":2,"tag":"handle"},{"limit":"tag_values","metric":"garden.containers.cpu","overflows":1,"tag":"handle"}\]`))
+		})
+
+		Context("when the overflow is dropped", func() {
+			BeforeEach(func() {
+				cfg.Overflow = metricsadapter.CardinalityDrop
+			})
+
+			It("drops the series with values beyond the limit", func() {
+				Expect(limit(
+					metric("garden.containers.cpu", 1, "handle:a"),
+					metric("garden.containers.cpu", 2, "handle:b"),
+					metric("garden.containers.cpu", 3, "handle:c"),
+				)).To(Equal(metricsadapter.Metrics{
+					metric("garden.containers.cpu", 1, "handle:a"),
+					metric("garden.containers.cpu", 2, "handle:b"),
+				}))
+			})
+		})
+
+		Context("when values are not seen for the expiry", func() {
+			BeforeEach(func() {
+				cfg.Expiry = time.Millisecond
+			})
+
+			It("forgets them", func() {
+				limit(metric("garden.containers.cpu", 1, "handle:a"), metric("garden.containers.cpu", 1, "handle:b"))
+				time.Sleep(5 * time.Millisecond)
+
+				Expect(limit(metric("garden.containers.cpu", 1, "handle:c"))).To(Equal(metricsadapter.Metrics{
+					metric("garden.containers.cpu", 1, "handle:c"),
+				}))
+			})
+
+			It("stops counting the overflows of the metrics that no longer go over it", func() {
+				limit(
+					metric("garden.containers.cpu", 1, "handle:a"),
+					metric("garden.containers.cpu", 1, "handle:b"),
+					metric("garden.containers.cpu", 1, "handle:c"),
+				)
+				series, err := limiter.Collect()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(series.Series).To(HaveLen(2))
+
+				time.Sleep(5 * time.Millisecond)
+				series, err = limiter.Collect()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(series.Series).To(HaveLen(1))
+				Expect(series.Series[0].Metric).To(Equal("metrics_adapter.cardinality.series"))
+			})
+		})
+	})
+
+	Context("with a limit on the series of a metric", func() {
+		BeforeEach(func() {
+			cfg.Metrics = []metricsadapter.MetricCardinalityLimits{{
+				Prefix:            "garden.goroutines",
+				CardinalityLimits: metricsadapter.CardinalityLimits{MaxSeries: 1},
+			}}
+		})
+
+		It("folds all tag values of the series beyond it, leaving the other metrics be", func() {
+			Expect(limit(
+				metric("garden.goroutines", 10, "function:a", "state:select"),
+				metric("garden.goroutines", 20, "function:b", "state:IO wait"),
+				metric("garden.goroutines", 30, "function:c", "state:select"),
+				metric("garden.containers.cpu", 1, "handle:a"),
+				metric("garden.containers.cpu", 1, "handle:b"),
+			)).To(Equal(metricsadapter.Metrics{
+				metric("garden.goroutines", 10, "function:a", "state:select"),
+				metric("garden.goroutines", 50, "function:other", "state:other"),
+				metric("garden.containers.cpu", 1, "handle:a"),
+				metric("garden.containers.cpu", 1, "handle:b"),
+			}))
+		})
+	})
+
+	Context("with limits for all metrics and for a metric", func() {
+		BeforeEach(func() {
+			cfg.MaxTagValues = 3
+			cfg.Metrics = []metricsadapter.MetricCardinalityLimits{{
+				Prefix:            "garden.goroutines",
+				CardinalityLimits: metricsadapter.CardinalityLimits{MaxTagValues: 1},
+			}}
+		})
+
+		It("does not count the values the limits of the metric fold for all metrics", func() {
+			limit(
+				metric("garden.goroutines", 1, "handle:a"),
+				metric("garden.goroutines", 1, "handle:b"),
+				metric("garden.goroutines", 1, "handle:c"),
+			)
+
+			Expect(limit(metric("garden.containers.cpu", 1, "handle:d"))).To(Equal(metricsadapter.Metrics{
+				metric("garden.containers.cpu", 1, "handle:d"),
+			}))
+		})
+	})
+
+	Context("with a limit on the series of all metrics", func() {
+		BeforeEach(func() {
+			cfg.MaxSeries = 2
+			cfg.Overflow = metricsadapter.CardinalityDrop
+		})
+
+		It("drops the series beyond it", func() {
+			Expect(limit(
+				metric("garden.memory", 1),
+				metric("garden.numGoroutines", 2),
+				metric("garden.containers.cpu", 3, "handle:a"),
+			)).To(Equal(metricsadapter.Metrics{
+				metric("garden.memory", 1),
+				metric("garden.numGoroutines", 2),
+			}))
+		})
+	})
+})
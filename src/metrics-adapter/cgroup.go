@@ -0,0 +1,367 @@
+package metricsadapter
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CgroupCollector reports the resource usage the kernel accounts to garden's
+// cgroup and to the cgroup of every container below it. It supports both the
+// cgroup v1 layout, where every controller is mounted separately under the
+// cgroup root, and the unified cgroup v2 hierarchy.
+//
+// Series for garden's own cgroup are named garden.cgroup.*, series for the
+// containers are named garden.container.* and tagged with the container handle.
+type CgroupCollector struct {
+	host         string
+	root         string
+	gardenCgroup string
+}
+
+func NewCgroupCollector(host string, cfg CgroupConfig) *CgroupCollector {
+	return &CgroupCollector{
+		host:         host,
+		root:         cfg.Root,
+		gardenCgroup: cfg.GardenCgroup,
+	}
+}
+
+func (c *CgroupCollector) Collect() (Series, error) {
+	reader := newCgroupReader(c.root)
+
+	handles, err := reader.children(c.gardenCgroup)
+	if err != nil {
+		return Series{}, fmt.Errorf("listing garden cgroups: %s", err)
+	}
+
+	timestamp := time.Now().Unix()
+	var metrics Metrics
+
+	stats, err := reader.stats(c.gardenCgroup)
+	if err != nil {
+		return Series{}, err
+	}
+	for _, stat := range stats {
+		metrics = append(metrics, newMetric("garden.cgroup."+stat.name, timestamp, stat.value, c.host))
+	}
+
+	for _, handle := range handles {
+		stats, err := reader.stats(filepath.Join(c.gardenCgroup, handle))
+		if err != nil {
+			return Series{}, err
+		}
+		for _, stat := range stats {
+			metrics = append(metrics, newMetric("garden.container."+stat.name, timestamp, stat.value, c.host, "handle:"+handle))
+		}
+	}
+
+	return Series{Series: metrics}, nil
+}
+
+// newCgroupReader returns a reader for the cgroup layout mounted at root.
+func newCgroupReader(root string) cgroupReader {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		return cgroupV2Reader{root: root}
+	}
+	return cgroupV1Reader{root: root}
+}
+
+type cgroupStat struct {
+	name  string
+	value float64
+}
+
+type cgroupField struct {
+	name   string
+	factor float64
+}
+
+type cgroupReader interface {
+	children(cgroup string) ([]string, error)
+	stats(cgroup string) ([]cgroupStat, error)
+	oomKills(cgroup string) (float64, bool, error)
+}
+
+type cgroupV1Reader struct {
+	root string
+}
+
+func (r cgroupV1Reader) children(cgroup string) ([]string, error) {
+	return subdirectories(filepath.Join(r.root, "memory", cgroup))
+}
+
+func (r cgroupV1Reader) stats(cgroup string) ([]cgroupStat, error) {
+	s := &cgroupStats{}
+
+	memory := filepath.Join(r.root, "memory", cgroup)
+	s.readValue(filepath.Join(memory, "memory.usage_in_bytes"), "memory.usage", 1)
+	s.readValue(filepath.Join(memory, "memory.limit_in_bytes"), "memory.limit", 1)
+	s.readValue(filepath.Join(memory, "memory.failcnt"), "memory.failcnt", 1)
+	s.readKeyValues(filepath.Join(memory, "memory.stat"), map[string]cgroupField{
+		"total_rss":   {"memory.rss", 1},
+		"total_cache": {"memory.cache", 1},
+		"total_swap":  {"memory.swap", 1},
+	})
+
+	s.readKeyValues(filepath.Join(r.root, "cpu", cgroup, "cpu.stat"), map[string]cgroupField{
+		"nr_periods":     {"cpu.periods", 1},
+		"nr_throttled":   {"cpu.throttled_periods", 1},
+		"throttled_time": {"cpu.throttled_time", 1e-9},
+	})
+
+	cpuacct := filepath.Join(r.root, "cpuacct", cgroup)
+	s.readValue(filepath.Join(cpuacct, "cpuacct.usage"), "cpu.usage", 1e-9)
+	s.readKeyValues(filepath.Join(cpuacct, "cpuacct.stat"), map[string]cgroupField{
+		"user":   {"cpu.user", 1.0 / userHZ},
+		"system": {"cpu.system", 1.0 / userHZ},
+	})
+
+	pids := filepath.Join(r.root, "pids", cgroup)
+	s.readValue(filepath.Join(pids, "pids.current"), "pids.current", 1)
+	s.readValue(filepath.Join(pids, "pids.max"), "pids.limit", 1)
+
+	blkio := filepath.Join(r.root, "blkio", cgroup)
+	s.readBlkio(filepath.Join(blkio, "blkio.throttle.io_service_bytes"), "io.read_bytes", "io.write_bytes")
+	s.readBlkio(filepath.Join(blkio, "blkio.throttle.io_serviced"), "io.reads", "io.writes")
+
+	return s.result()
+}
+
+func (r cgroupV1Reader) oomKills(cgroup string) (float64, bool, error) {
+	return readOOMKills(filepath.Join(r.root, "memory", cgroup, "memory.oom_control"))
+}
+
+type cgroupV2Reader struct {
+	root string
+}
+
+func (r cgroupV2Reader) children(cgroup string) ([]string, error) {
+	return subdirectories(filepath.Join(r.root, cgroup))
+}
+
+func (r cgroupV2Reader) stats(cgroup string) ([]cgroupStat, error) {
+	s := &cgroupStats{}
+	dir := filepath.Join(r.root, cgroup)
+
+	s.readValue(filepath.Join(dir, "memory.current"), "memory.usage", 1)
+	s.readValue(filepath.Join(dir, "memory.max"), "memory.limit", 1)
+	s.readValue(filepath.Join(dir, "memory.swap.current"), "memory.swap", 1)
+	s.readKeyValues(filepath.Join(dir, "memory.stat"), map[string]cgroupField{
+		"anon": {"memory.rss", 1},
+		"file": {"memory.cache", 1},
+	})
+
+	s.readKeyValues(filepath.Join(dir, "cpu.stat"), map[string]cgroupField{
+		"usage_usec":     {"cpu.usage", 1e-6},
+		"user_usec":      {"cpu.user", 1e-6},
+		"system_usec":    {"cpu.system", 1e-6},
+		"nr_periods":     {"cpu.periods", 1},
+		"nr_throttled":   {"cpu.throttled_periods", 1},
+		"throttled_usec": {"cpu.throttled_time", 1e-6},
+	})
+
+	s.readValue(filepath.Join(dir, "pids.current"), "pids.current", 1)
+	s.readValue(filepath.Join(dir, "pids.max"), "pids.limit", 1)
+
+	s.readIOStat(filepath.Join(dir, "io.stat"))
+
+	return s.result()
+}
+
+func (r cgroupV2Reader) oomKills(cgroup string) (float64, bool, error) {
+	return readOOMKills(filepath.Join(r.root, cgroup, "memory.events"))
+}
+
+// readOOMKills reads the oom_kill counter from a memory.oom_control or
+// memory.events file. Kernels before 4.13 do not count OOM kills in cgroup v1.
+func readOOMKills(path string) (float64, bool, error) {
+	s := &cgroupStats{}
+	s.readKeyValues(path, map[string]cgroupField{"oom_kill": {"oom_kills", 1}})
+
+	stats, err := s.result()
+	if err != nil || len(stats) == 0 {
+		return 0, false, err
+	}
+	return stats[0].value, true, nil
+}
+
+// cgroupStats accumulates the stats of a single cgroup. Files that do not
+// exist are skipped: not every controller is enabled everywhere, and a
+// container may be destroyed while its cgroup is being read.
+type cgroupStats struct {
+	stats []cgroupStat
+	err   error
+}
+
+func (s *cgroupStats) result() ([]cgroupStat, error) {
+	return s.stats, s.err
+}
+
+func (s *cgroupStats) add(name string, value float64) {
+	s.stats = append(s.stats, cgroupStat{name: name, value: value})
+}
+
+func (s *cgroupStats) fail(path string, err error) {
+	if s.err == nil && !os.IsNotExist(err) {
+		s.err = fmt.Errorf("%s: %s", path, err)
+	}
+}
+
+// readValue reads a file holding a single value. Limits that are not set
+// ("max" or the v1 equivalent of a huge number) are not reported.
+func (s *cgroupStats) readValue(path, name string, factor float64) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		s.fail(path, err)
+		return
+	}
+
+	field := strings.TrimSpace(string(contents))
+	if field == "max" {
+		return
+	}
+
+	value, err := strconv.ParseFloat(field, 64)
+	if err != nil {
+		s.fail(path, err)
+		return
+	}
+	if value >= unlimitedCgroupV1 {
+		return
+	}
+
+	s.add(name, value*factor)
+}
+
+// unlimitedCgroupV1 is the page-aligned maximum int64 that cgroup v1 reports
+// for an unset memory limit.
+const unlimitedCgroupV1 = float64(0x7FFFFFFFFFFFF000)
+
+func (s *cgroupStats) readKeyValues(path string, keys map[string]cgroupField) {
+	s.scan(path, func(fields []string) error {
+		field, ok := keys[fields[0]]
+		if !ok || len(fields) != 2 {
+			return nil
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return err
+		}
+		s.add(field.name, value*field.factor)
+		return nil
+	})
+}
+
+// readBlkio sums the per device "<major>:<minor> Read|Write <value>" lines
+// of a v1 blkio file.
+func (s *cgroupStats) readBlkio(path, readName, writeName string) {
+	var read, write float64
+	found := false
+	s.scan(path, func(fields []string) error {
+		if len(fields) != 3 {
+			return nil
+		}
+
+		value, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return err
+		}
+
+		switch fields[1] {
+		case "Read":
+			read += value
+		case "Write":
+			write += value
+		default:
+			return nil
+		}
+		found = true
+		return nil
+	})
+
+	if found {
+		s.add(readName, read)
+		s.add(writeName, write)
+	}
+}
+
+// readIOStat sums the per device "<major>:<minor> rbytes=.. wbytes=.." lines
+// of a v2 io.stat file.
+func (s *cgroupStats) readIOStat(path string) {
+	keys := map[string]string{
+		"rbytes": "io.read_bytes",
+		"wbytes": "io.write_bytes",
+		"rios":   "io.reads",
+		"wios":   "io.writes",
+	}
+	sums := map[string]float64{}
+
+	s.scan(path, func(fields []string) error {
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || keys[kv[0]] == "" {
+				continue
+			}
+
+			value, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				return err
+			}
+			sums[kv[0]] += value
+		}
+		return nil
+	})
+
+	for _, key := range []string{"rbytes", "wbytes", "rios", "wios"} {
+		if value, ok := sums[key]; ok {
+			s.add(keys[key], value)
+		}
+	}
+}
+
+func (s *cgroupStats) scan(path string, fn func(fields []string) error) {
+	file, err := os.Open(path)
+	if err != nil {
+		s.fail(path, err)
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := fn(fields); err != nil {
+			s.fail(path, err)
+			return
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		s.fail(path, err)
+	}
+}
+
+func subdirectories(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,168 @@
+package metricsadapter_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CgroupCollector", func() {
+	var (
+		root       string
+		series     metricsadapter.Series
+		collectErr error
+	)
+
+	JustBeforeEach(func() {
+		collector := metricsadapter.NewCgroupCollector("cactus", metricsadapter.CgroupConfig{
+			Root:         root,
+			GardenCgroup: "garden",
+		})
+		series, collectErr = collector.Collect()
+	})
+
+	find := func(name string, tags ...string) (float64, bool) {
+		if tags == nil {
+			tags = []string{}
+		}
+		for _, m := range series.Series {
+			if m.Metric == name && reflect.DeepEqual(m.Tags, tags) {
+				Expect(m.Host).To(Equal("cactus"))
+				return m.Points[0][1], true
+			}
+		}
+		return 0, false
+	}
+
+	value := func(name string, tags ...string) float64 {
+		v, ok := find(name, tags...)
+		Expect(ok).To(BeTrue(), "metric %s %v was not collected", name, tags)
+		return v
+	}
+
+	Context("with a cgroup v1 hierarchy", func() {
+		BeforeEach(func() {
+			root = "testdata/cgroup/v1"
+		})
+
+		It("does not return an error", func() {
+			Expect(collectErr).NotTo(HaveOccurred())
+		})
+
+		It("reports garden's cgroup", func() {
+			Expect(value("garden.cgroup.memory.usage")).To(Equal(3000000.0))
+			Expect(value("garden.cgroup.memory.rss")).To(Equal(2000000.0))
+			Expect(value("garden.cgroup.cpu.usage")).To(Equal(5.0))
+			Expect(value("garden.cgroup.cpu.user")).To(Equal(3.0))
+			Expect(value("garden.cgroup.pids.current")).To(Equal(12.0))
+		})
+
+		It("sums io over all devices", func() {
+			Expect(value("garden.cgroup.io.read_bytes")).To(Equal(5120.0))
+			Expect(value("garden.cgroup.io.write_bytes")).To(Equal(8192.0))
+			Expect(value("garden.cgroup.io.reads")).To(Equal(4.0))
+			Expect(value("garden.cgroup.io.writes")).To(Equal(8.0))
+		})
+
+		It("does not report unset limits", func() {
+			_, found := find("garden.cgroup.memory.limit")
+			Expect(found).To(BeFalse())
+			_, found = find("garden.cgroup.pids.limit")
+			Expect(found).To(BeFalse())
+		})
+
+		It("reports every container tagged with its handle", func() {
+			Expect(value("garden.container.memory.usage", "handle:handle-1")).To(Equal(1048576.0))
+			Expect(value("garden.container.memory.limit", "handle:handle-1")).To(Equal(2097152.0))
+			Expect(value("garden.container.memory.cache", "handle:handle-1")).To(Equal(524288.0))
+			Expect(value("garden.container.memory.swap", "handle:handle-1")).To(Equal(4096.0))
+			Expect(value("garden.container.memory.failcnt", "handle:handle-1")).To(Equal(3.0))
+			Expect(value("garden.container.pids.limit", "handle:handle-1")).To(Equal(1024.0))
+		})
+
+		It("reports cpu throttling", func() {
+			Expect(value("garden.container.cpu.periods", "handle:handle-1")).To(Equal(100.0))
+			Expect(value("garden.container.cpu.throttled_periods", "handle:handle-1")).To(Equal(25.0))
+			Expect(value("garden.container.cpu.throttled_time", "handle:handle-1")).To(Equal(1.5))
+		})
+	})
+
+	Context("with a unified cgroup v2 hierarchy", func() {
+		BeforeEach(func() {
+			root = "testdata/cgroup/v2"
+		})
+
+		It("does not return an error", func() {
+			Expect(collectErr).NotTo(HaveOccurred())
+		})
+
+		It("reports garden's cgroup", func() {
+			Expect(value("garden.cgroup.memory.usage")).To(Equal(3000000.0))
+			Expect(value("garden.cgroup.memory.rss")).To(Equal(2000000.0))
+			Expect(value("garden.cgroup.memory.cache")).To(Equal(1000000.0))
+			Expect(value("garden.cgroup.cpu.usage")).To(Equal(5.0))
+			Expect(value("garden.cgroup.io.read_bytes")).To(Equal(5120.0))
+			Expect(value("garden.cgroup.io.writes")).To(Equal(8.0))
+		})
+
+		It("does not report unset limits", func() {
+			_, found := find("garden.cgroup.memory.limit")
+			Expect(found).To(BeFalse())
+		})
+
+		It("reports every container tagged with its handle", func() {
+			Expect(value("garden.container.memory.usage", "handle:handle-1")).To(Equal(1048576.0))
+			Expect(value("garden.container.memory.limit", "handle:handle-1")).To(Equal(2097152.0))
+			Expect(value("garden.container.memory.swap", "handle:handle-1")).To(Equal(4096.0))
+			Expect(value("garden.container.cpu.throttled_periods", "handle:handle-1")).To(Equal(25.0))
+			Expect(value("garden.container.cpu.throttled_time", "handle:handle-1")).To(Equal(1.5))
+			Expect(value("garden.container.pids.current", "handle:handle-1")).To(Equal(4.0))
+		})
+
+		It("reports what is available for containers with fewer controllers", func() {
+			Expect(value("garden.container.memory.usage", "handle:handle-2")).To(Equal(2048.0))
+			_, found := find("garden.container.cpu.usage", "handle:handle-2")
+			Expect(found).To(BeFalse())
+		})
+	})
+
+	Context("when garden's cgroup does not exist", func() {
+		BeforeEach(func() {
+			var err error
+			root, err = ioutil.TempDir("", "cgroup")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(root)).To(Succeed())
+		})
+
+		It("returns an error", func() {
+			Expect(collectErr).To(MatchError(ContainSubstring("listing garden cgroups")))
+		})
+	})
+
+	Context("when a cgroup file is malformed", func() {
+		BeforeEach(func() {
+			var err error
+			root, err = ioutil.TempDir("", "cgroup")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("memory\n"), 0644)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(root, "garden"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(root, "garden", "memory.current"), []byte("lots\n"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(root)).To(Succeed())
+		})
+
+		It("returns an error naming the file", func() {
+			Expect(collectErr).To(MatchError(ContainSubstring("memory.current")))
+		})
+	})
+})
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"flag"
-	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagerflags"
 	"github.com/masters-of-cats/metricsadapter"
 	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
 )
@@ -14,45 +21,311 @@ type flags struct {
 	gardenDebugEndpoint string
 	host                string
 	wavefrontProxyPort  int
+	pollingInterval     time.Duration
+	configPath          string
+	configCheckInterval time.Duration
+	recordPath          string
+	replayPath          string
+	replaySpeed         float64
+	lager               lagerflags.LagerConfig
 }
 
 func initFlags() (flags, error) {
 	var f flags
-	flag.StringVar(&f.gardenDebugEndpoint, "garden-debug-endpoint", "", "Address of garden's debug endpoint")
-	flag.StringVar(&f.host, "host", "", "Name of the host VM")
+	flag.StringVar(&f.gardenDebugEndpoint, "garden-debug-endpoint", "", "Address of garden's debug endpoint; when unset, the config must enable garden_discovery")
+	flag.StringVar(&f.host, "host", "", "Name of the host VM; when unset and the config enables bosh, named after the BOSH instance")
 	flag.IntVar(&f.wavefrontProxyPort, "wavefront-proxy-port", 0, "Wavefront Proxy port")
+	flag.DurationVar(&f.pollingInterval, "polling-interval", 0, "Interval at which to poll and emit; when unset, poll once and exit")
+	flag.StringVar(&f.configPath, "config", "", "Path to the YAML configuration file for optional features")
+	flag.DurationVar(&f.configCheckInterval, "config-check-interval", 10*time.Second, "Interval at which to check the config file for changes and reload it; 0 only reloads on SIGHUP")
+	flag.StringVar(&f.recordPath, "record", "", "Path of an archive to record the responses of all collectors to")
+	flag.StringVar(&f.replayPath, "replay", "", "Path of a recorded archive to emit instead of polling garden")
+	flag.Float64Var(&f.replaySpeed, "replay-speed", 1, "Speed-up of the replay relative to the recording; 0 replays as fast as possible")
+	lagerflags.AddFlags(flag.CommandLine)
 	flag.Parse()
 
-	if f.wavefrontProxyPort == 0 || f.gardenDebugEndpoint == "" || f.host == "" {
-		return flags{}, errors.New("please provide all flags, see help for usage")
+	// the logger is made of the flags even when they are invalid, to log why
+	f.lager = lagerflags.ConfigFromFlags()
+	if _, err := lager.LogLevelFromString(f.lager.LogLevel); err != nil {
+		f.lager.LogLevel = lagerflags.INFO
+		return f, err
 	}
 
+	if f.pollingInterval < 0 {
+		return f, errors.New("polling-interval must not be negative")
+	}
+
+	// the proxy port is checked once we know whether the config has sinks,
+	// the host and debug endpoint once we know whether they are discovered
 	return f, nil
 }
 
 func main() {
 	f, err := initFlags()
-	exitOn(err)
+	logger := newLogger(f.lager)
+	exitOn(logger, "parsing-flags-failed", err)
+
+	cfg, err := metricsadapter.LoadConfig(f.configPath)
+	exitOn(logger, "loading-config-failed", err)
+
+	instanceTags, err := identify(&f, cfg)
+	exitOn(logger, "reading-bosh-metadata-failed", err)
+	if f.host == "" || f.replayPath == "" && f.gardenDebugEndpoint == "" && cfg.GardenDiscovery == nil {
+		exitOn(logger, "parsing-flags-failed", errors.New("please provide all flags, see help for usage"))
+	}
+
+	a := &adapter{
+		flags:   f,
+		logger:  logger,
+		sender:  metricsadapter.NewFanOutSender(f.host),
+		tags:    instanceTags,
+		reloads: metricsadapter.NewReloadStatus(f.host),
+
+		gardenChanges: make(chan struct{}, 1),
+	}
+	a.out = metricsadapter.NewTaggingSender(a.sender, mergeTags(instanceTags, cfg.Tags))
+	a.limited = metricsadapter.NewLimitingSender(a.out, nil)
+	defer a.sender.Close()
+
+	if f.recordPath != "" && f.replayPath == "" {
+		a.recorder, err = metricsadapter.NewRecorder(f.recordPath)
+		exitOn(logger, "creating-recorder-failed", err)
+		defer a.recorder.Close()
+	}
+
+	p, err := a.build(cfg, nil)
+	exitOn(logger, "building-failed", err)
+	a.swap(p)
+
+	if f.replayPath != "" {
+		exitOn(logger, "replay-failed", a.replay(logger.Session("replay"), p))
+		return
+	}
+
+	if f.pollingInterval == 0 {
+		pollLogger := logger.Session("poll")
+		series, collectErr := a.collect(pollLogger, p.targets())
+		exitOn(pollLogger, "emit-failed", emit(p.filter(series), nil, a.out, a.limited))
+		var canaryErr error
+		if canary := p.canary(); canary != nil {
+			canaryErr = probeCanary(canary, f.host, a.limited)
+		}
+
+		// exiting skips the deferred close, which sends what was emitted,
+		// including that the targets that failed are down
+		if collectErr != nil || canaryErr != nil {
+			a.sender.Close()
+		}
+		exitOn(pollLogger, "collect-failed", collectErr)
+		exitOn(logger, "canary-failed", canaryErr)
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	configChanges := make(chan struct{}, 1)
+	if f.configPath != "" && f.configCheckInterval > 0 {
+		go watchConfig(f.configPath, f.configCheckInterval, configChanges)
+	}
+
+	exitOn(logger, "starting-failed", p.start(nil))
+	defer func() {
+		a.pipeline().stop(nil)
+	}()
+
+	logger.Info("started", lager.Data{"polling-interval": f.pollingInterval.String(), "config": f.configPath})
+	defer logger.Info("exited")
+
+	a.poll()
+	ticker := time.NewTicker(f.pollingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.poll()
+		case <-hangups:
+			a.reload("sighup")
+		case <-configChanges:
+			a.reload("config-file-changed")
+		case <-a.gardenChanges:
+			a.reload("garden-config-changed")
+		case <-signals:
+			return
+		}
+	}
+}
+
+// newLogger logs as lagerflags does, but to stderr: stdout is the stdout
+// sink's, which its lines would otherwise be interleaved with.
+func newLogger(cfg lagerflags.LagerConfig) lager.Logger {
+	var sink lager.Sink = lager.NewWriterSink(os.Stderr, lager.DEBUG)
+	if cfg.TimeFormat == lagerflags.FormatRFC3339 {
+		sink = lager.NewPrettySink(os.Stderr, lager.DEBUG)
+	}
+
+	if cfg.RedactSecrets {
+		redacting, err := lager.NewRedactingSink(sink, nil, nil)
+		if err != nil {
+			panic(err)
+		}
+		sink = redacting
+	}
+
+	// the level was checked along with the flags
+	level, _ := lager.LogLevelFromString(cfg.LogLevel)
+	logger := lager.NewLogger("metrics-adapter")
+	logger.RegisterSink(lager.NewReconfigurableSink(sink, level))
+	return logger
+}
+
+// identify names the host after the BOSH instance when the config enables
+// bosh and no host is given, and returns the tags of the instance.
+func identify(f *flags, cfg metricsadapter.Config) (map[string]string, error) {
+	if cfg.BOSH == nil {
+		return nil, nil
+	}
+
+	instance, err := metricsadapter.ReadBOSHInstance(cfg.BOSH.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.host == "" {
+		f.host = instance.Host()
+	}
+	return instance.Tags(), nil
+}
+
+// mergeTags returns the tags of the instance with the tags of the config
+// over them.
+func mergeTags(instanceTags, configTags map[string]string) map[string]string {
+	tags := map[string]string{}
+	for key, value := range instanceTags {
+		tags[key] = value
+	}
+	for key, value := range configTags {
+		tags[key] = value
+	}
+	return tags
+}
 
-	series, err := metricsadapter.CollectMetrics(f.gardenDebugEndpoint, f.host)
-	exitOn(err)
+// watchConfig tells when the contents of the config file change, checking
+// every interval.
+func watchConfig(path string, interval time.Duration, changes chan<- struct{}) {
+	last, _ := ioutil.ReadFile(path)
+	every(interval, nil, func() {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil || bytes.Equal(contents, last) {
+			return
+		}
+		last = contents
 
-	proxyCfg := &wavefront.ProxyConfiguration{
-		Host:        "localhost",
-		MetricsPort: f.wavefrontProxyPort,
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// emit emits the series, which were filtered already, then lets every
+// flusher send what it aggregated since the last call to the limited sender.
+func emit(series metricsadapter.Series, flushers []func(wavefront.Sender) error, sender, limited wavefront.Sender) error {
+	if err := metricsadapter.EmitMetrics(series, sender); err != nil {
+		return err
 	}
 
-	sender, err := wavefront.NewProxySender(proxyCfg)
-	exitOn(err)
-	defer sender.Close()
+	for _, flush := range flushers {
+		if err := flush(limited); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func probeCanary(canary *metricsadapter.Canary, host string, sender wavefront.Sender) error {
+	series, probeErr := canary.Probe()
+	if err := metricsadapter.EmitMetrics(series, sender); err != nil {
+		return err
+	}
+
+	if probeErr != nil {
+		if err := metricsadapter.EmitCanaryFailure(probeErr, host, sender); err != nil {
+			return err
+		}
+	}
 
-	err = metricsadapter.EmitMetrics(series, sender)
-	exitOn(err)
+	return probeErr
 }
 
-func exitOn(err error) {
+func watchOOMKills(logger lager.Logger, cfg metricsadapter.OOMConfig, host string, sender wavefront.Sender, stop <-chan struct{}) error {
+	watcher := metricsadapter.NewOOMWatcher(host, cfg, sender)
+
+	if cfg.KmsgPath != "" {
+		kmsg, err := os.Open(cfg.KmsgPath)
+		if err != nil {
+			return err
+		}
+
+		// only report kills that happen from now on
+		if _, err := kmsg.Seek(0, io.SeekEnd); err != nil {
+			kmsg.Close()
+			return err
+		}
+
+		go func() {
+			<-stop
+			kmsg.Close()
+		}()
+
+		go func() {
+			err := watcher.WatchKmsg(kmsg)
+			select {
+			case <-stop:
+				// closed by the stop
+			default:
+				logOn(logger, "watching-kmsg-failed", err)
+			}
+		}()
+	}
+
+	go every(cfg.Interval, stop, func() {
+		logOn(logger, "poll-failed", watcher.Poll())
+	})
+
+	return nil
+}
+
+// every calls fn right away, then every interval until stop is closed.
+func every(interval time.Duration, stop <-chan struct{}, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	fn()
+	for {
+		select {
+		case <-ticker.C:
+			fn()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func exitOn(logger lager.Logger, action string, err error) {
 	if err != nil {
-		fmt.Println(err.Error())
+		logger.Error(action, err)
 		os.Exit(1)
 	}
 }
+
+func logOn(logger lager.Logger, action string, err error) {
+	if err != nil {
+		logger.Error(action, err)
+	}
+}
@@ -0,0 +1,755 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/garden/client"
+	"code.cloudfoundry.org/garden/client/connection"
+	"code.cloudfoundry.org/lager"
+	"github.com/masters-of-cats/metricsadapter"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+// unit is the part of the adapter made of one section of the config. A
+// reload keeps the units whose section did not change, with their state and
+// what they run in the background, and replaces the others.
+type unit struct {
+	cfg   interface{}
+	value interface{}
+
+	collector metricsadapter.Collector
+	flushers  []func(wavefront.Sender) error
+	sink      *metricsadapter.FanOutSink
+
+	// metrics are the prefixes of the metrics of the collector, which tell
+	// whether it is sampled when the pipeline aggregates
+	metrics []string
+
+	// start and stop what the unit runs in the background; discard cleans up
+	// after a unit that was built for a reload that failed
+	start   func() error
+	stop    func()
+	discard func()
+}
+
+// pipeline is what the adapter makes of a config, as units in the order
+// they were added.
+type pipeline struct {
+	order []string
+	units map[string]*unit
+}
+
+// target is a collector the adapter scrapes, named after its unit.
+type target struct {
+	name      string
+	collector metricsadapter.Collector
+}
+
+func (p *pipeline) targets() []target {
+	var targets []target
+	for _, name := range p.order {
+		if u := p.units[name]; u.collector != nil {
+			targets = append(targets, target{name: name, collector: u.collector})
+		}
+	}
+	return targets
+}
+
+// sampledTargets returns the targets whose metrics the aggregator rolls up
+// when sampled is true, or the others.
+func (p *pipeline) sampledTargets(aggregator *metricsadapter.Aggregator, sampled bool) []target {
+	var targets []target
+	for _, t := range p.targets() {
+		if aggregator.Samples(p.units[t.name].metrics) == sampled {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+func (p *pipeline) flushers() []func(wavefront.Sender) error {
+	var flushers []func(wavefront.Sender) error
+	for _, name := range p.order {
+		flushers = append(flushers, p.units[name].flushers...)
+	}
+	return flushers
+}
+
+func (p *pipeline) sinks() []metricsadapter.FanOutSink {
+	var sinks []metricsadapter.FanOutSink
+	for _, name := range p.order {
+		if u := p.units[name]; u.sink != nil {
+			sinks = append(sinks, *u.sink)
+		}
+	}
+	return sinks
+}
+
+func (p *pipeline) canary() *metricsadapter.Canary {
+	if u, ok := p.units["canary"]; ok {
+		return u.value.(*metricsadapter.Canary)
+	}
+	return nil
+}
+
+func (p *pipeline) profiler() *metricsadapter.Profiler {
+	if u, ok := p.units["profile"]; ok {
+		return u.value.(*metricsadapter.Profiler)
+	}
+	return nil
+}
+
+func (p *pipeline) limiter() *metricsadapter.CardinalityLimiter {
+	if u, ok := p.units["cardinality"]; ok {
+		return u.value.(*metricsadapter.CardinalityLimiter)
+	}
+	return nil
+}
+
+// filter returns the series within the cardinality limits, of those that
+// changed enough when the pipeline deduplicates.
+func (p *pipeline) filter(series metricsadapter.Series) metricsadapter.Series {
+	if limiter := p.limiter(); limiter != nil {
+		series = limiter.Limit(series)
+	}
+	if deduplicator := p.deduplicator(); deduplicator != nil {
+		series = deduplicator.Filter(series)
+	}
+	return series
+}
+
+func (p *pipeline) deduplicator() *metricsadapter.Deduplicator {
+	if u, ok := p.units["dedup"]; ok {
+		return u.value.(*metricsadapter.Deduplicator)
+	}
+	return nil
+}
+
+func (p *pipeline) aggregator() *metricsadapter.Aggregator {
+	if u, ok := p.units["aggregation"]; ok {
+		return u.value.(*metricsadapter.Aggregator)
+	}
+	return nil
+}
+
+// debugSection is the section of a unit that reads garden's debug endpoint,
+// which is rebuilt when the endpoint changes as well as its section.
+type debugSection struct {
+	section  interface{}
+	endpoint string
+}
+
+// gardenSection is the section of the unit that watches garden's config,
+// which is rebuilt along with what it found there.
+type gardenSection struct {
+	discovery metricsadapter.GardenDiscoveryConfig
+	garden    metricsadapter.GardenConfig
+}
+
+// logUnit holds the parts of the log unit that outlive a change of the log
+// config: the histograms of the log collector, and the events of the
+// forwarder as long as its own config is the same.
+type logUnit struct {
+	collector *metricsadapter.LogCollector
+	events    *metricsadapter.LogEventsConfig
+	forwarder *metricsadapter.LogEventForwarder
+	tracer    *metricsadapter.LogTracer
+}
+
+// adapter polls the collectors of the current pipeline and emits to a
+// sender whose sinks are swapped along with the pipeline, tagged with the
+// tags of the instance and of the config.
+type adapter struct {
+	flags  flags
+	logger lager.Logger
+	sender *metricsadapter.FanOutSender
+	out    *metricsadapter.TaggingSender
+	tags   map[string]string
+
+	// limited keeps what is sent to out without being filtered, as the
+	// series of a poll are, within the cardinality limits
+	limited *metricsadapter.LimitingSender
+
+	recorder *metricsadapter.Recorder
+	reloads  *metricsadapter.ReloadStatus
+
+	// gardenChanges tells when garden's config no longer matches the
+	// pipeline that was built of it
+	gardenChanges chan struct{}
+
+	mu      sync.Mutex
+	current *pipeline
+}
+
+func (a *adapter) pipeline() *pipeline {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.current
+}
+
+// build makes a pipeline of the config, reusing the units of prev whose
+// section is unchanged.
+func (a *adapter) build(cfg metricsadapter.Config, prev *pipeline) (*pipeline, error) {
+	p := &pipeline{units: map[string]*unit{}}
+	if prev == nil {
+		prev = &pipeline{units: map[string]*unit{}}
+	}
+
+	add := func(name string, section interface{}, build func() (*unit, error)) error {
+		if u, ok := prev.units[name]; ok && reflect.DeepEqual(u.cfg, section) {
+			p.units[name] = u
+			p.order = append(p.order, name)
+			return nil
+		}
+
+		u, err := build()
+		if err != nil {
+			p.discard(prev)
+			return fmt.Errorf("%s: %s", name, err)
+		}
+
+		u.cfg = section
+		if u.collector != nil && a.recorder != nil {
+			u.collector = a.recorder.Wrap(name, u.collector)
+		}
+		p.units[name] = u
+		p.order = append(p.order, name)
+		return nil
+	}
+
+	if err := a.addSinks(cfg, add); err != nil {
+		return nil, err
+	}
+
+	// a replay reads nothing from garden, not even where it is
+	replaying := a.flags.replayPath != ""
+
+	var garden metricsadapter.GardenConfig
+	if cfg.GardenDiscovery != nil && !replaying {
+		var err error
+		garden, err = metricsadapter.ReadGardenConfig(cfg.GardenDiscovery.ConfigPath)
+		if err != nil {
+			p.discard(prev)
+			return nil, fmt.Errorf("garden-discovery: %s", err)
+		}
+	}
+
+	host, endpoint := a.flags.host, a.flags.gardenDebugEndpoint
+	if endpoint == "" {
+		endpoint = garden.DebugEndpoint
+	}
+
+	collector := func(c metricsadapter.Collector, metrics ...string) func() (*unit, error) {
+		return func() (*unit, error) {
+			return &unit{collector: c, metrics: metrics}, nil
+		}
+	}
+
+	if err := add("sinks", nil, collector(a.sender, "metrics_adapter.sink.", "metrics_adapter.proxy.")); err != nil {
+		return nil, err
+	}
+	if a.flags.configPath != "" {
+		if err := add("config", nil, collector(a.reloads, "metrics_adapter.config.")); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.GardenDiscovery != nil && !replaying {
+		section := gardenSection{discovery: *cfg.GardenDiscovery, garden: garden}
+		if err := add("garden-discovery", section, func() (*unit, error) {
+			return a.newGardenDiscoveryUnit(section), nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if err := add("garden-debug", debugSection{endpoint: endpoint}, collector(metricsadapter.NewDebugCollector(host, endpoint), "garden.numGoroutines", "garden.memory")); err != nil {
+		return nil, err
+	}
+	if cfg.Host != nil {
+		if err := add("host", *cfg.Host, collector(metricsadapter.NewHostCollector(host, *cfg.Host), "host.")); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Cgroup != nil {
+		if err := add("cgroup", *cfg.Cgroup, collector(metricsadapter.NewCgroupCollector(host, *cfg.Cgroup), "garden.cgroup.", "garden.container.")); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Process != nil {
+		if err := add("process", *cfg.Process, collector(metricsadapter.NewProcessCollector(host, *cfg.Process), "garden.process.")); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Goroutines != nil {
+		if err := add("goroutines", debugSection{*cfg.Goroutines, endpoint}, func() (*unit, error) {
+			goroutineCollector, err := metricsadapter.NewGoroutineCollector(host, endpoint, *cfg.Goroutines)
+			if err != nil {
+				return nil, err
+			}
+			return &unit{collector: goroutineCollector, metrics: []string{"garden.goroutines"}}, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Log != nil {
+		if err := add("log", *cfg.Log, func() (*unit, error) {
+			return a.newLogUnit(*cfg.Log, prev.units["log"]), nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Canary != nil {
+		canaryCfg := *cfg.Canary
+		if canaryCfg.GardenAddress == "" {
+			canaryCfg.GardenNetwork, canaryCfg.GardenAddress = garden.Network, garden.Address
+		}
+
+		if err := add("canary", canaryCfg, func() (*unit, error) {
+			gardenClient := client.New(connection.New(canaryCfg.GardenNetwork, canaryCfg.GardenAddress))
+			canary := metricsadapter.NewCanary(gardenClient, host, canaryCfg)
+			interval := canaryCfg.Interval
+
+			logger := a.logger.Session("canary")
+
+			u := &unit{value: canary}
+			u.start, u.stop = loop(func(stop <-chan struct{}) error {
+				go every(interval, stop, func() {
+					logOn(logger, "probe-failed", probeCanary(canary, host, a.limited))
+				})
+				return nil
+			})
+			return u, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.OOM != nil {
+		if err := add("oom", *cfg.OOM, func() (*unit, error) {
+			oomCfg := *cfg.OOM
+			u := &unit{}
+			u.start, u.stop = loop(func(stop <-chan struct{}) error {
+				return watchOOMKills(a.logger.Session("oom"), oomCfg, host, a.limited, stop)
+			})
+			return u, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Profile != nil {
+		if err := add("profile", debugSection{*cfg.Profile, endpoint}, func() (*unit, error) {
+			profiler, err := metricsadapter.NewProfiler(host, endpoint, *cfg.Profile, a.limited)
+			if err != nil {
+				return nil, err
+			}
+			return &unit{value: profiler}, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Aggregation != nil {
+		if err := add("aggregation", *cfg.Aggregation, func() (*unit, error) {
+			aggregationCfg := *cfg.Aggregation
+
+			// the samples of the series that are still rolled up are kept
+			aggregator := metricsadapter.NewAggregator(aggregationCfg)
+			if u, ok := prev.units["aggregation"]; ok {
+				aggregator = u.value.(*metricsadapter.Aggregator)
+			}
+
+			u := &unit{value: aggregator}
+			u.start, u.stop = loop(func(stop <-chan struct{}) error {
+				aggregator.Reconfigure(aggregationCfg)
+				go every(aggregationCfg.SampleInterval, stop, func() {
+					series, _ := a.collect(a.logger.Session("sample"), a.pipeline().sampledTargets(aggregator, true))
+					aggregator.Add(series)
+					a.checkProfile(series)
+				})
+				return nil
+			})
+			return u, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Cardinality != nil {
+		if err := add("cardinality", *cfg.Cardinality, func() (*unit, error) {
+			limiter := metricsadapter.NewCardinalityLimiter(a.logger.Session("cardinality"), host, *cfg.Cardinality)
+			return &unit{value: limiter, collector: limiter, metrics: []string{"metrics_adapter.cardinality."}}, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Dedup != nil {
+		if err := add("dedup", *cfg.Dedup, func() (*unit, error) {
+			// what was last emitted is forgotten with the previous
+			// thresholds, which at worst emits every series once more
+			deduplicator := metricsadapter.NewDeduplicator(host, *cfg.Dedup)
+			return &unit{value: deduplicator, collector: deduplicator, metrics: []string{"metrics_adapter.dedup."}}, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// addSinks adds a unit for every sink, or for the proxy on the port given on
+// the command line when there are none.
+func (a *adapter) addSinks(cfg metricsadapter.Config, add func(string, interface{}, func() (*unit, error)) error) error {
+	sinks := cfg.Sinks
+	if len(sinks) == 0 {
+		sinks = []metricsadapter.SinkConfig{{Type: metricsadapter.SinkWavefront}}
+	}
+
+	for _, sink := range sinks {
+		if sink.Type == metricsadapter.SinkWavefront && sink.Port == 0 && len(sink.Endpoints) == 0 {
+			sink.Port = a.flags.wavefrontProxyPort
+		}
+
+		sink := sink
+		if err := add("sink "+sink.SinkName(), sink, func() (*unit, error) {
+			sender, err := metricsadapter.NewSink(a.logger.Session("sink", lager.Data{"sink": sink.SinkName()}), sink)
+			if err != nil {
+				return nil, err
+			}
+
+			return &unit{
+				sink: &metricsadapter.FanOutSink{
+					Name:         sink.SinkName(),
+					Type:         sink.Type,
+					Sender:       sender,
+					QueueSize:    sink.QueueSize,
+					Overflow:     sink.Overflow,
+					BlockTimeout: sink.BlockTimeout,
+				},
+				discard: sender.Close,
+			}, nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newGardenDiscoveryUnit re-reads garden's config every interval, and tells
+// when it no longer matches what the pipeline was built of.
+func (a *adapter) newGardenDiscoveryUnit(section gardenSection) *unit {
+	logger := a.logger.Session("garden-discovery", lager.Data{"path": section.discovery.ConfigPath})
+
+	u := &unit{}
+	u.start, u.stop = loop(func(stop <-chan struct{}) error {
+		go every(section.discovery.Interval, stop, func() {
+			garden, err := metricsadapter.ReadGardenConfig(section.discovery.ConfigPath)
+			if err != nil {
+				logger.Error("reading-failed", err)
+				return
+			}
+			if garden == section.garden {
+				return
+			}
+
+			logger.Info("changed", lager.Data{"debug-endpoint": garden.DebugEndpoint, "network": garden.Network, "address": garden.Address})
+			select {
+			case a.gardenChanges <- struct{}{}:
+			default:
+			}
+		})
+		return nil
+	})
+	return u
+}
+
+func (a *adapter) newLogUnit(cfg metricsadapter.LogConfig, prev *unit) *unit {
+	var parts logUnit
+	if prev != nil {
+		parts = prev.value.(logUnit)
+	}
+
+	if parts.collector == nil {
+		parts.collector = metricsadapter.NewLogCollector(a.flags.host)
+	}
+	if !reflect.DeepEqual(parts.events, cfg.Events) {
+		parts.forwarder = nil
+		if cfg.Events != nil {
+			parts.forwarder = metricsadapter.NewLogEventForwarder(a.flags.host, *cfg.Events)
+		}
+		parts.events = cfg.Events
+	}
+	if !cfg.Traces {
+		parts.tracer = nil
+	} else if parts.tracer == nil {
+		parts.tracer = metricsadapter.NewLogTracer(a.flags.host)
+	}
+
+	u := &unit{
+		value:     parts,
+		collector: parts.collector,
+		metrics:   []string{"garden.log."},
+		flushers:  []func(wavefront.Sender) error{parts.collector.EmitDistributions},
+	}
+	handlers := []metricsadapter.LogHandler{parts.collector}
+	if parts.forwarder != nil {
+		u.flushers = append(u.flushers, parts.forwarder.EmitEvents)
+		handlers = append(handlers, parts.forwarder)
+	}
+	if parts.tracer != nil {
+		u.flushers = append(u.flushers, parts.tracer.EmitSpans)
+		handlers = append(handlers, parts.tracer)
+	}
+
+	logger := a.logger.Session("log", lager.Data{"path": cfg.Path})
+	tailer := metricsadapter.NewLogTailer(cfg, handlers...)
+	u.start, u.stop = loop(func(stop <-chan struct{}) error {
+		if err := tailer.Start(); err != nil {
+			return err
+		}
+		go func() {
+			<-stop
+			logOn(logger, "tailing-failed", tailer.Stop())
+		}()
+		return nil
+	})
+	return u
+}
+
+// swap makes next the current pipeline, the sinks of next those of the
+// sender and its limiter that of what is sent without being filtered.
+func (a *adapter) swap(next *pipeline) {
+	a.mu.Lock()
+	a.current = next
+	a.mu.Unlock()
+
+	a.sender.Swap(next.sinks()...)
+	a.limited.SetLimiter(next.limiter())
+}
+
+// start starts the units of p that were not part of prev. When a unit fails
+// to start, the units it started are stopped again and the error returned.
+func (p *pipeline) start(prev *pipeline) error {
+	if prev == nil {
+		prev = &pipeline{}
+	}
+
+	var started []*unit
+	for _, name := range p.order {
+		u := p.units[name]
+		if prev.units[name] == u || u.start == nil {
+			continue
+		}
+		if err := u.start(); err != nil {
+			for _, u := range started {
+				u.stop()
+			}
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		started = append(started, u)
+	}
+	return nil
+}
+
+// stop stops the units of p that are not part of next.
+func (p *pipeline) stop(next *pipeline) {
+	if next == nil {
+		next = &pipeline{}
+	}
+
+	for _, name := range p.order {
+		if u := p.units[name]; next.units[name] != u && u.stop != nil {
+			u.stop()
+		}
+	}
+}
+
+// discard cleans up after the units of p that are not part of prev.
+func (p *pipeline) discard(prev *pipeline) {
+	for _, name := range p.order {
+		if u := p.units[name]; prev.units[name] != u && u.discard != nil {
+			u.discard()
+		}
+	}
+}
+
+// reload re-reads the config and swaps the pipeline for one made of it. When
+// the config is invalid or a unit cannot be built or started, the current
+// pipeline keeps running and the error is logged and counted. The units of
+// the next pipeline are started before it is swapped in, so the units they
+// replace are only stopped once they run.
+func (a *adapter) reload(reason string) {
+	logger := a.logger.Session("reload", lager.Data{"reason": reason, "config": a.flags.configPath})
+	logger.Info("starting")
+
+	cfg, err := metricsadapter.LoadConfig(a.flags.configPath)
+	if err != nil {
+		a.reloads.Failed(err)
+		logger.Error("failed-keeping-previous-config", err)
+		return
+	}
+
+	prev := a.pipeline()
+	next, err := a.build(cfg, prev)
+	if err != nil {
+		a.reloads.Failed(err)
+		logger.Error("failed-keeping-previous-config", err)
+		return
+	}
+
+	if err := next.start(prev); err != nil {
+		next.discard(prev)
+		a.reloads.Failed(err)
+		logger.Error("failed-keeping-previous-config", err)
+		return
+	}
+	a.swap(next)
+	prev.stop(next)
+
+	a.out.SetTags(mergeTags(a.tags, cfg.Tags))
+	a.reloads.Succeeded()
+	logger.Info("finished")
+}
+
+// poll emits the series of the collectors of the pipeline. When it
+// aggregates, the collectors of the metrics that are rolled up are sampled
+// instead, and their rollups since the last poll are emitted.
+func (a *adapter) poll() {
+	logger := a.logger.Session("poll")
+	logger.Debug("starting")
+	defer logger.Debug("finished")
+
+	p := a.pipeline()
+	aggregator := p.aggregator()
+	if aggregator == nil {
+		series, _ := a.collect(logger, p.targets())
+		a.emit(logger, series, p)
+		a.checkProfile(series)
+		return
+	}
+
+	series, _ := a.collect(logger, p.sampledTargets(aggregator, false))
+	a.checkProfile(series)
+	series.Series = append(series.Series, aggregator.Rollup().Series...)
+	a.emit(logger, series, p)
+}
+
+// collect collects the series of every target along with its health, each
+// in a session of its own that tells which target failed.
+func (a *adapter) collect(logger lager.Logger, targets []target) (metricsadapter.Series, error) {
+	var collectors []metricsadapter.Collector
+	for _, t := range targets {
+		t := t
+		collectors = append(collectors, metricsadapter.CollectorFunc(func() (metricsadapter.Series, error) {
+			// the health of the target is collected even when collecting fails
+			collectLogger := logger.Session("collect", lager.Data{"target": t.name})
+			started := time.Now()
+			s, err := metricsadapter.Scrape(a.flags.host, t.name, t.collector)
+			if err != nil {
+				collectLogger.Error("failed", err)
+				return s, fmt.Errorf("%s: %s", t.name, err)
+			}
+			collectLogger.Debug("collected", lager.Data{"series": len(s.Series), "duration": time.Since(started).String()})
+			return s, nil
+		}))
+	}
+	return metricsadapter.CollectAll(collectors...)
+}
+
+// replay emits the polls recorded in an archive through the pipeline, as if
+// its collectors had read the recorded responses: they are parsed, filtered,
+// aggregated and flushed to the sinks like live ones. The recorded failures
+// of collectors are logged and the replay goes on.
+func (a *adapter) replay(logger lager.Logger, p *pipeline) error {
+	archive, err := os.Open(a.flags.replayPath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	aggregator := p.aggregator()
+	var lastRollup time.Time
+
+	err = metricsadapter.Replay(archive, a.flags.replaySpeed, func(recordings []metricsadapter.Recording) error {
+		var targets []target
+		for _, recording := range recordings {
+			var collector metricsadapter.Collector
+			if u, ok := p.units[recording.Collector]; ok {
+				collector = u.collector
+			}
+			targets = append(targets, target{name: recording.Collector, collector: metricsadapter.ReplayCollector(recording, collector)})
+		}
+		series, _ := a.collect(logger, targets)
+
+		// the samples are rolled up every polling interval of the recording
+		if aggregator == nil {
+			a.emit(logger, series, p)
+			return nil
+		}
+		aggregator.Add(series)
+		if polled := recordings[0].Time; polled.Sub(lastRollup) >= a.flags.pollingInterval {
+			a.emit(logger, aggregator.Rollup(), p)
+			lastRollup = polled
+		}
+		return nil
+	})
+
+	if aggregator != nil {
+		a.emit(logger, aggregator.Rollup(), p)
+	}
+	return err
+}
+
+func (a *adapter) emit(logger lager.Logger, series metricsadapter.Series, p *pipeline) {
+	series = p.filter(series)
+	if err := emit(series, p.flushers(), a.out, a.limited); err != nil {
+		logger.Error("emit-failed", err)
+		return
+	}
+	logger.Debug("emitted", lager.Data{"series": len(series.Series)})
+}
+
+func (a *adapter) checkProfile(series metricsadapter.Series) {
+	profiler := a.pipeline().profiler()
+	if profiler == nil {
+		return
+	}
+
+	// capturing a cpu profile takes a while, don't hold up the next poll
+	go func() {
+		logger := a.logger.Session("profile")
+		path, err := profiler.Check(series)
+		if err != nil {
+			logger.Error("capture-failed", err)
+			return
+		}
+		if path != "" {
+			logger.Info("captured", lager.Data{"path": path})
+		}
+	}()
+}
+
+// loop returns start and stop functions for background work that runs until
+// the channel it is given is closed. Stop does nothing unless start succeeded.
+func loop(start func(stop <-chan struct{}) error) (func() error, func()) {
+	var stop chan struct{}
+	return func() error {
+			stop = make(chan struct{})
+			if err := start(stop); err != nil {
+				stop = nil
+				return err
+			}
+			return nil
+		}, func() {
+			if stop != nil {
+				close(stop)
+				stop = nil
+			}
+		}
+}
@@ -0,0 +1,636 @@
+package metricsadapter
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	Canary      *CanaryConfig      `yaml:"canary"`
+	Host        *HostConfig        `yaml:"host"`
+	Cgroup      *CgroupConfig      `yaml:"cgroup"`
+	OOM         *OOMConfig         `yaml:"oom"`
+	Process     *ProcessConfig     `yaml:"process"`
+	Log         *LogConfig         `yaml:"log"`
+	Profile     *ProfileConfig     `yaml:"profile"`
+	Goroutines  *GoroutinesConfig  `yaml:"goroutines"`
+	Aggregation *AggregationConfig `yaml:"aggregation"`
+	Dedup       *DedupConfig       `yaml:"dedup"`
+	Cardinality *CardinalityConfig `yaml:"cardinality"`
+	Sinks       []SinkConfig       `yaml:"sinks"`
+	BOSH        *BOSHConfig        `yaml:"bosh"`
+
+	// GardenDiscovery finds garden's debug endpoint and API server in
+	// garden's config instead of the command line and the canary config.
+	GardenDiscovery *GardenDiscoveryConfig `yaml:"garden_discovery"`
+
+	// Tags are added to every series, over the tags discovered from BOSH
+	// but under the tags of the series itself.
+	Tags map[string]string `yaml:"tags"`
+}
+
+// BOSHConfig makes the adapter read the metadata the BOSH agent keeps under
+// root at startup, to name the host when it is not given and to tag every
+// series with the instance it comes from.
+type BOSHConfig struct {
+	Root string `yaml:"root"`
+}
+
+// GardenDiscoveryConfig makes the adapter read garden's debug endpoint and
+// API server from the config.ini garden's job renders, and re-read it every
+// interval to follow changes to it. The debug endpoint given on the command
+// line and the garden address of the canary win over what is discovered.
+type GardenDiscoveryConfig struct {
+	ConfigPath string        `yaml:"config_path"`
+	Interval   time.Duration `yaml:"interval"`
+}
+
+type CanaryConfig struct {
+	Interval      time.Duration `yaml:"interval"`
+	Timeout       time.Duration `yaml:"timeout"`
+	GardenNetwork string        `yaml:"garden_network"`
+	GardenAddress string        `yaml:"garden_address"`
+	RootFS        string        `yaml:"rootfs"`
+}
+
+type HostConfig struct {
+	ProcRoot    string   `yaml:"proc_root"`
+	MountPoints []string `yaml:"mount_points"`
+}
+
+type CgroupConfig struct {
+	Root         string `yaml:"root"`
+	GardenCgroup string `yaml:"garden_cgroup"`
+}
+
+type OOMConfig struct {
+	CgroupConfig `yaml:",inline"`
+	Interval     time.Duration `yaml:"interval"`
+	KmsgPath     string        `yaml:"kmsg_path"`
+}
+
+type ProcessConfig struct {
+	ProcRoot string `yaml:"proc_root"`
+	Pidfile  string `yaml:"pidfile"`
+	Name     string `yaml:"name"`
+}
+
+type LogConfig struct {
+	Path   string           `yaml:"path"`
+	Poll   bool             `yaml:"poll"`
+	Events *LogEventsConfig `yaml:"events"`
+	Traces bool             `yaml:"traces"`
+}
+
+type LogEventsConfig struct {
+	DedupWindow  time.Duration `yaml:"dedup_window"`
+	RateLimit    int           `yaml:"rate_limit"`
+	RateInterval time.Duration `yaml:"rate_interval"`
+}
+
+type ProfileConfig struct {
+	Directory    string             `yaml:"directory"`
+	CPUDuration  time.Duration      `yaml:"cpu_duration"`
+	Cooldown     time.Duration      `yaml:"cooldown"`
+	MaxSnapshots int                `yaml:"max_snapshots"`
+	MaxAge       time.Duration      `yaml:"max_age"`
+	Conditions   []ProfileCondition `yaml:"conditions"`
+}
+
+// SinkConfig configures where the adapter emits to. Without sinks it emits to
+// the Wavefront proxy given on the command line.
+type SinkConfig struct {
+	Type string `yaml:"type"`
+
+	// every sink has its own queue; the name, which defaults to the type,
+	// tells sinks apart in the metrics about them
+	Name         string        `yaml:"name"`
+	QueueSize    int           `yaml:"queue_size"`
+	Overflow     string        `yaml:"overflow"`
+	BlockTimeout time.Duration `yaml:"block_timeout"`
+
+	// wavefront, which sends to the proxy on port on this host, or fails
+	// over between the proxies at endpoints, in order of preference
+	Port             int           `yaml:"port"`
+	Endpoints        []string      `yaml:"endpoints"`
+	HealthInterval   time.Duration `yaml:"health_interval"`
+	FailureThreshold int           `yaml:"failure_threshold"`
+	OpenDuration     time.Duration `yaml:"open_duration"`
+
+	// stdout and file
+	Format   string `yaml:"format"`
+	Path     string `yaml:"path"`
+	MaxSize  int64  `yaml:"max_size"`
+	MaxFiles int    `yaml:"max_files"`
+
+	// graphite
+	Network  string `yaml:"network"`
+	Address  string `yaml:"address"`
+	Prefix   string `yaml:"prefix"`
+	TagStyle string `yaml:"tag_style"`
+
+	// influxdb and otlp
+	URL      string `yaml:"url"`
+	Database string `yaml:"database"`
+
+	// graphite, influxdb and loggregator
+	BatchSize int `yaml:"batch_size"`
+
+	// otlp, which also takes the url
+	Headers  map[string]string `yaml:"headers"`
+	Resource map[string]string `yaml:"resource"`
+
+	// loggregator, which also takes the address and batch size
+	SourceID   string `yaml:"source_id"`
+	InstanceID string `yaml:"instance_id"`
+	CACert     string `yaml:"ca_cert"`
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+}
+
+// AggregationConfig makes the adapter sample every sample interval and emit
+// rollups of the samples every polling interval. Only metrics starting with
+// one of the prefixes, which must be set, are rolled up, and only their
+// collectors are sampled; the others are polled every polling interval.
+type AggregationConfig struct {
+	SampleInterval time.Duration `yaml:"sample_interval"`
+	Percentiles    []float64     `yaml:"percentiles"`
+	Compression    uint32        `yaml:"compression"`
+	Metrics        []string      `yaml:"metrics"`
+}
+
+// DedupConfig makes the adapter only emit a series when its value changed by
+// more than the absolute or the relative threshold since it was last emitted,
+// or when it was not emitted for heartbeat polling intervals. Only metrics
+// starting with one of the prefixes are deduplicated, or all of them when
+// there are none.
+type DedupConfig struct {
+	Absolute  float64  `yaml:"absolute"`
+	Relative  float64  `yaml:"relative"`
+	Heartbeat int      `yaml:"heartbeat"`
+	Metrics   []string `yaml:"metrics"`
+}
+
+// CardinalityConfig bounds the distinct series of all metrics and the
+// distinct values of each tag key across them, and the same for the metrics
+// starting with a prefix, each on its own. A limit of 0 does not apply.
+// Beyond a limit, tag values are folded into "other" or the series dropped,
+// as overflow says; the same goes for the delta counters, distributions,
+// events and spans sent outside of the series of a poll. Series and tag values
+// not seen for the expiry no longer count, and the worst offenders are logged
+// every report interval.
+type CardinalityConfig struct {
+	CardinalityLimits `yaml:",inline"`
+	Overflow          string                    `yaml:"overflow"`
+	Expiry            time.Duration             `yaml:"expiry"`
+	ReportInterval    time.Duration             `yaml:"report_interval"`
+	Top               int                       `yaml:"top"`
+	Metrics           []MetricCardinalityLimits `yaml:"metrics"`
+}
+
+type CardinalityLimits struct {
+	MaxSeries    int `yaml:"max_series"`
+	MaxTagValues int `yaml:"max_tag_values"`
+}
+
+// MetricCardinalityLimits are the limits of every metric starting with the
+// prefix, the first one that matches.
+type MetricCardinalityLimits struct {
+	Prefix            string `yaml:"prefix"`
+	CardinalityLimits `yaml:",inline"`
+}
+
+type GoroutinesConfig struct {
+	Depth int `yaml:"depth"`
+	Top   int `yaml:"top"`
+}
+
+// ProfileCondition holds when the latest value of a series with the metric
+// name and all of the tags is above or below the given thresholds.
+type ProfileCondition struct {
+	Metric string   `yaml:"metric"`
+	Tags   []string `yaml:"tags"`
+	Above  *float64 `yaml:"above"`
+	Below  *float64 `yaml:"below"`
+}
+
+const (
+	defaultProcRoot     = "/proc"
+	defaultCgroupRoot   = "/sys/fs/cgroup"
+	defaultGardenCgroup = "garden"
+	defaultOOMInterval  = 10 * time.Second
+
+	defaultLogEventsDedupWindow  = 5 * time.Minute
+	defaultLogEventsRateLimit    = 5
+	defaultLogEventsRateInterval = time.Minute
+
+	defaultProfileCPUDuration  = 10 * time.Second
+	defaultProfileCooldown     = 30 * time.Minute
+	defaultProfileMaxSnapshots = 10
+	defaultProfileMaxAge       = 7 * 24 * time.Hour
+
+	defaultGoroutinesDepth = 1
+	defaultGoroutinesTop   = 20
+
+	defaultAggregationSampleInterval = time.Second
+	defaultAggregationCompression    = 100
+
+	defaultDedupHeartbeat = 10
+
+	defaultCardinalityExpiry         = time.Hour
+	defaultCardinalityReportInterval = time.Minute
+	defaultCardinalityTop            = 10
+
+	defaultCanaryInterval      = time.Minute
+	defaultCanaryTimeout       = 30 * time.Second
+	defaultCanaryGardenNetwork = "unix"
+
+	defaultBOSHRoot = "/var/vcap"
+
+	defaultGardenConfigPath        = "/var/vcap/jobs/garden/config/config.ini"
+	defaultGardenDiscoveryInterval = 30 * time.Second
+)
+
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	if path == "" {
+		return cfg, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if err := yaml.UnmarshalStrict(contents, &cfg); err != nil {
+		return Config{}, err
+	}
+
+	cfg.setDefaults()
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) setDefaults() {
+	if c.BOSH != nil && c.BOSH.Root == "" {
+		c.BOSH.Root = defaultBOSHRoot
+	}
+
+	if c.GardenDiscovery != nil {
+		if c.GardenDiscovery.ConfigPath == "" {
+			c.GardenDiscovery.ConfigPath = defaultGardenConfigPath
+		}
+		if c.GardenDiscovery.Interval == 0 {
+			c.GardenDiscovery.Interval = defaultGardenDiscoveryInterval
+		}
+	}
+
+	if c.Canary != nil {
+		if c.Canary.Interval == 0 {
+			c.Canary.Interval = defaultCanaryInterval
+		}
+		if c.Canary.Timeout == 0 {
+			c.Canary.Timeout = defaultCanaryTimeout
+		}
+		// the network of a discovered address is discovered along with it
+		if c.Canary.GardenNetwork == "" && c.Canary.GardenAddress != "" {
+			c.Canary.GardenNetwork = defaultCanaryGardenNetwork
+		}
+	}
+
+	if c.Host != nil && c.Host.ProcRoot == "" {
+		c.Host.ProcRoot = defaultProcRoot
+	}
+
+	if c.Cgroup != nil {
+		c.Cgroup.setDefaults()
+	}
+
+	if c.Process != nil && c.Process.ProcRoot == "" {
+		c.Process.ProcRoot = defaultProcRoot
+	}
+
+	if c.OOM != nil {
+		c.OOM.CgroupConfig.setDefaults()
+		if c.OOM.Interval == 0 {
+			c.OOM.Interval = defaultOOMInterval
+		}
+	}
+
+	if c.Log != nil && c.Log.Events != nil {
+		c.Log.Events.setDefaults()
+	}
+
+	if c.Profile != nil {
+		c.Profile.setDefaults()
+	}
+
+	for i := range c.Sinks {
+		if c.Sinks[i].Format == "" {
+			c.Sinks[i].Format = FormatWavefront
+		}
+		if c.Sinks[i].Type == SinkGraphite {
+			if c.Sinks[i].Network == "" {
+				c.Sinks[i].Network = "tcp"
+			}
+			if c.Sinks[i].TagStyle == "" {
+				c.Sinks[i].TagStyle = GraphiteTagsPath
+			}
+		}
+		if c.Sinks[i].BatchSize == 0 && (c.Sinks[i].Type == SinkGraphite || c.Sinks[i].Type == SinkInfluxDB || c.Sinks[i].Type == SinkLoggregator) {
+			c.Sinks[i].BatchSize = defaultBatchSize
+		}
+	}
+
+	if c.Goroutines != nil {
+		if c.Goroutines.Depth == 0 {
+			c.Goroutines.Depth = defaultGoroutinesDepth
+		}
+		if c.Goroutines.Top == 0 {
+			c.Goroutines.Top = defaultGoroutinesTop
+		}
+	}
+
+	if c.Cardinality != nil {
+		if c.Cardinality.Overflow == "" {
+			c.Cardinality.Overflow = CardinalityFold
+		}
+		if c.Cardinality.Expiry == 0 {
+			c.Cardinality.Expiry = defaultCardinalityExpiry
+		}
+		if c.Cardinality.ReportInterval == 0 {
+			c.Cardinality.ReportInterval = defaultCardinalityReportInterval
+		}
+		if c.Cardinality.Top == 0 {
+			c.Cardinality.Top = defaultCardinalityTop
+		}
+	}
+
+	if c.Dedup != nil && c.Dedup.Heartbeat == 0 {
+		c.Dedup.Heartbeat = defaultDedupHeartbeat
+	}
+
+	if c.Aggregation != nil {
+		if c.Aggregation.SampleInterval == 0 {
+			c.Aggregation.SampleInterval = defaultAggregationSampleInterval
+		}
+		if c.Aggregation.Percentiles == nil {
+			c.Aggregation.Percentiles = []float64{0.5, 0.9, 0.99}
+		}
+		if c.Aggregation.Compression == 0 {
+			c.Aggregation.Compression = defaultAggregationCompression
+		}
+	}
+}
+
+func (c *LogEventsConfig) setDefaults() {
+	if c.DedupWindow == 0 {
+		c.DedupWindow = defaultLogEventsDedupWindow
+	}
+	if c.RateLimit == 0 {
+		c.RateLimit = defaultLogEventsRateLimit
+	}
+	if c.RateInterval == 0 {
+		c.RateInterval = defaultLogEventsRateInterval
+	}
+}
+
+func (c *ProfileConfig) setDefaults() {
+	if c.CPUDuration == 0 {
+		c.CPUDuration = defaultProfileCPUDuration
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = defaultProfileCooldown
+	}
+	if c.MaxSnapshots == 0 {
+		c.MaxSnapshots = defaultProfileMaxSnapshots
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultProfileMaxAge
+	}
+}
+
+func (c *CgroupConfig) setDefaults() {
+	if c.Root == "" {
+		c.Root = defaultCgroupRoot
+	}
+	if c.GardenCgroup == "" {
+		c.GardenCgroup = defaultGardenCgroup
+	}
+}
+
+func (c Config) Validate() error {
+	if c.GardenDiscovery != nil && c.GardenDiscovery.Interval < 0 {
+		return errors.New("garden_discovery: interval must be positive")
+	}
+
+	if c.Canary != nil {
+		if c.Canary.GardenAddress == "" && c.GardenDiscovery == nil {
+			return errors.New("canary: garden_address must be set unless garden_discovery is enabled")
+		}
+		if c.Canary.Interval < 0 || c.Canary.Timeout < 0 {
+			return errors.New("canary: interval and timeout must be positive")
+		}
+	}
+
+	if c.OOM != nil && c.OOM.Interval < 0 {
+		return errors.New("oom: interval must be positive")
+	}
+
+	if c.Process != nil && c.Process.Pidfile == "" && c.Process.Name == "" {
+		return errors.New("process: pidfile or name must be set")
+	}
+
+	if c.Log != nil {
+		if c.Log.Path == "" {
+			return errors.New("log: path must be set")
+		}
+		if c.Log.Events != nil && (c.Log.Events.DedupWindow < 0 || c.Log.Events.RateLimit < 0 || c.Log.Events.RateInterval < 0) {
+			return errors.New("log: events dedup_window, rate_limit and rate_interval must be positive")
+		}
+	}
+
+	sinkNames := map[string]bool{}
+	for _, sink := range c.Sinks {
+		if err := sink.validate(); err != nil {
+			return fmt.Errorf("sinks: %s", err)
+		}
+		if sinkNames[sink.SinkName()] {
+			return fmt.Errorf("sinks: there is more than one sink named %q, give them distinct names", sink.SinkName())
+		}
+		sinkNames[sink.SinkName()] = true
+	}
+
+	if c.Goroutines != nil && (c.Goroutines.Depth < 0 || c.Goroutines.Top < 0) {
+		return errors.New("goroutines: depth and top must be positive")
+	}
+
+	if c.Aggregation != nil {
+		if c.Aggregation.SampleInterval < 0 {
+			return errors.New("aggregation: sample_interval must be positive")
+		}
+		// every collector would be sampled, goroutine dumps included
+		if len(c.Aggregation.Metrics) == 0 {
+			return errors.New("aggregation: metrics must be set")
+		}
+		for _, p := range c.Aggregation.Percentiles {
+			if p <= 0 || p >= 1 {
+				return fmt.Errorf("aggregation: percentile %v must be between 0 and 1", p)
+			}
+		}
+	}
+
+	if c.Dedup != nil && (c.Dedup.Absolute < 0 || c.Dedup.Relative < 0 || c.Dedup.Heartbeat < 0) {
+		return errors.New("dedup: absolute, relative and heartbeat must not be negative")
+	}
+
+	if c.Cardinality != nil {
+		if err := c.Cardinality.validate(); err != nil {
+			return fmt.Errorf("cardinality: %s", err)
+		}
+	}
+
+	if c.Profile != nil {
+		if err := c.Profile.validate(); err != nil {
+			return fmt.Errorf("profile: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// SinkName returns the name of the sink, or its type when it has none.
+func (c SinkConfig) SinkName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Type
+}
+
+func (c SinkConfig) validate() error {
+	switch c.Type {
+	case SinkWavefront:
+		for _, endpoint := range c.Endpoints {
+			if _, port, err := net.SplitHostPort(endpoint); err != nil || port == "" {
+				return fmt.Errorf("wavefront proxy endpoint %q must be host:port", endpoint)
+			}
+		}
+		if c.HealthInterval < 0 || c.FailureThreshold < 0 || c.OpenDuration < 0 {
+			return errors.New("health_interval, failure_threshold and open_duration must not be negative")
+		}
+	case SinkStdout:
+	case SinkFile:
+		if c.Path == "" {
+			return errors.New("file sink needs a path")
+		}
+		if c.MaxSize < 0 || c.MaxFiles < 0 {
+			return errors.New("max_size and max_files must not be negative")
+		}
+	case SinkGraphite:
+		if c.Address == "" {
+			return errors.New("graphite sink needs an address")
+		}
+		if c.Network != "tcp" && c.Network != "udp" {
+			return fmt.Errorf("unknown network %q", c.Network)
+		}
+		if c.TagStyle != GraphiteTagsPath && c.TagStyle != GraphiteTagsTagged {
+			return fmt.Errorf("unknown tag style %q", c.TagStyle)
+		}
+	case SinkInfluxDB:
+		if c.URL == "" || c.Database == "" {
+			return errors.New("influxdb sink needs a url and a database")
+		}
+	case SinkOTLP:
+		if c.URL == "" {
+			return errors.New("otlp sink needs a url")
+		}
+	case SinkLoggregator:
+		if c.CACert == "" || c.Cert == "" || c.Key == "" {
+			return errors.New("loggregator sink needs a ca_cert, cert and key")
+		}
+	default:
+		return fmt.Errorf("unknown sink type %q", c.Type)
+	}
+
+	switch c.Format {
+	case FormatWavefront, FormatSeries, FormatNDJSON:
+	default:
+		return fmt.Errorf("unknown format %q", c.Format)
+	}
+
+	if c.BatchSize < 0 {
+		return errors.New("batch_size must not be negative")
+	}
+
+	switch c.Overflow {
+	case "", OverflowDropOldest, OverflowDropNewest, OverflowBlock:
+	default:
+		return fmt.Errorf("unknown overflow policy %q", c.Overflow)
+	}
+	if c.QueueSize < 0 {
+		return errors.New("queue_size must not be negative")
+	}
+	if c.BlockTimeout < 0 {
+		return errors.New("block_timeout must not be negative")
+	}
+
+	return nil
+}
+
+func (c CardinalityConfig) validate() error {
+	switch c.Overflow {
+	case CardinalityFold, CardinalityDrop:
+	default:
+		return fmt.Errorf("unknown overflow %q, must be fold or drop", c.Overflow)
+	}
+	if c.Expiry < 0 || c.ReportInterval < 0 || c.Top < 0 {
+		return errors.New("expiry, report_interval and top must not be negative")
+	}
+
+	limits := []CardinalityLimits{c.CardinalityLimits}
+	for _, metric := range c.Metrics {
+		if metric.Prefix == "" {
+			return errors.New("metrics must have a prefix")
+		}
+		limits = append(limits, metric.CardinalityLimits)
+	}
+	for _, l := range limits {
+		if l.MaxSeries < 0 || l.MaxTagValues < 0 {
+			return errors.New("max_series and max_tag_values must not be negative")
+		}
+	}
+	return nil
+}
+
+func (c ProfileConfig) validate() error {
+	if c.Directory == "" {
+		return errors.New("directory must be set")
+	}
+	if c.CPUDuration < time.Second {
+		return errors.New("cpu_duration must be at least 1s")
+	}
+	if c.Cooldown < 0 || c.MaxSnapshots < 0 || c.MaxAge < 0 {
+		return errors.New("cooldown, max_snapshots and max_age must not be negative")
+	}
+	if len(c.Conditions) == 0 {
+		return errors.New("at least one condition must be set")
+	}
+	for _, condition := range c.Conditions {
+		if condition.Metric == "" {
+			return errors.New("conditions must name a metric")
+		}
+		if condition.Above == nil && condition.Below == nil {
+			return fmt.Errorf("condition on %s must set above or below", condition.Metric)
+		}
+	}
+	return nil
+}
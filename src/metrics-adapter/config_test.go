@@ -0,0 +1,403 @@
+package metricsadapter_test
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LoadConfig", func() {
+	var (
+		configPath string
+		contents   string
+		cfg        metricsadapter.Config
+		loadErr    error
+	)
+
+	BeforeEach(func() {
+		contents = ""
+	})
+
+	JustBeforeEach(func() {
+		configFile, err := ioutil.TempFile("", "config")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = configFile.WriteString(contents)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configFile.Close()).To(Succeed())
+		configPath = configFile.Name()
+
+		cfg, loadErr = metricsadapter.LoadConfig(configPath)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(configPath)).To(Succeed())
+	})
+
+	It("loads an empty config", func() {
+		Expect(loadErr).NotTo(HaveOccurred())
+		Expect(cfg.Canary).To(BeNil())
+	})
+
+	It("returns an empty config when no path is given", func() {
+		cfg, err := metricsadapter.LoadConfig("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg).To(Equal(metricsadapter.Config{}))
+	})
+
+	Context("when the canary is configured", func() {
+		BeforeEach(func() {
+			contents = `
+canary:
+  interval: 2m
+  garden_address: /var/vcap/data/garden/garden.sock
+`
+		})
+
+		It("applies defaults to the unset fields", func() {
+			Expect(loadErr).NotTo(HaveOccurred())
+			Expect(*cfg.Canary).To(Equal(metricsadapter.CanaryConfig{
+				Interval:      2 * time.Minute,
+				Timeout:       30 * time.Second,
+				GardenNetwork: "unix",
+				GardenAddress: "/var/vcap/data/garden/garden.sock",
+			}))
+		})
+	})
+
+	Context("when the canary has no garden address", func() {
+		BeforeEach(func() {
+			contents = "canary: {interval: 1m}"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError(ContainSubstring("garden_address")))
+		})
+	})
+
+	Context("when the log has no path", func() {
+		BeforeEach(func() {
+			contents = "log: {poll: true}"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError(ContainSubstring("path")))
+		})
+	})
+
+	Context("when a profile condition has no threshold", func() {
+		BeforeEach(func() {
+			contents = `
+profile:
+  directory: /tmp/profiles
+  conditions:
+  - metric: garden.numGoroutines
+`
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError("profile: condition on garden.numGoroutines must set above or below"))
+		})
+	})
+
+	Context("when the profile cooldown is negative", func() {
+		BeforeEach(func() {
+			contents = `
+profile:
+  directory: /tmp/profiles
+  cooldown: -1s
+  conditions:
+  - metric: garden.numGoroutines
+    above: 10000
+`
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError("profile: cooldown, max_snapshots and max_age must not be negative"))
+		})
+	})
+
+	Context("when the profile max_snapshots is negative", func() {
+		BeforeEach(func() {
+			contents = `
+profile:
+  directory: /tmp/profiles
+  max_snapshots: -1
+  conditions:
+  - metric: garden.numGoroutines
+    above: 10000
+`
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError("profile: cooldown, max_snapshots and max_age must not be negative"))
+		})
+	})
+
+	Context("when the profile max_age is negative", func() {
+		BeforeEach(func() {
+			contents = `
+profile:
+  directory: /tmp/profiles
+  max_age: -1s
+  conditions:
+  - metric: garden.numGoroutines
+    above: 10000
+`
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError("profile: cooldown, max_snapshots and max_age must not be negative"))
+		})
+	})
+
+	Context("when a sink is configured", func() {
+		BeforeEach(func() {
+			contents = "sinks: [{type: file, path: /tmp/metrics.log}]"
+		})
+
+		It("defaults to the wavefront format", func() {
+			Expect(loadErr).NotTo(HaveOccurred())
+			Expect(cfg.Sinks).To(Equal([]metricsadapter.SinkConfig{{Type: "file", Path: "/tmp/metrics.log", Format: "wavefront"}}))
+		})
+	})
+
+	Context("when a graphite sink is configured", func() {
+		BeforeEach(func() {
+			contents = "sinks: [{type: graphite, address: 'localhost:2003'}]"
+		})
+
+		It("defaults to tcp, tags in the path and batches of 500", func() {
+			Expect(loadErr).NotTo(HaveOccurred())
+			Expect(cfg.Sinks[0].Network).To(Equal("tcp"))
+			Expect(cfg.Sinks[0].TagStyle).To(Equal(metricsadapter.GraphiteTagsPath))
+			Expect(cfg.Sinks[0].BatchSize).To(Equal(500))
+		})
+	})
+
+	Context("when an influxdb sink has no database", func() {
+		BeforeEach(func() {
+			contents = "sinks: [{type: influxdb, url: 'http://localhost:8086'}]"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError("sinks: influxdb sink needs a url and a database"))
+		})
+	})
+
+	Context("when a wavefront proxy endpoint has no port", func() {
+		BeforeEach(func() {
+			contents = "sinks: [{type: wavefront, endpoints: [proxy-1.example.com]}]"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError(`sinks: wavefront proxy endpoint "proxy-1.example.com" must be host:port`))
+		})
+	})
+
+	Context("when two sinks have the same name", func() {
+		BeforeEach(func() {
+			contents = "sinks: [{type: stdout}, {type: stdout, format: ndjson}]"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError(`sinks: there is more than one sink named "stdout", give them distinct names`))
+		})
+	})
+
+	Context("when a sink has an unknown overflow policy", func() {
+		BeforeEach(func() {
+			contents = "sinks: [{type: stdout, overflow: drop_all}]"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError(`sinks: unknown overflow policy "drop_all"`))
+		})
+	})
+
+	Context("when a sink has a negative block timeout", func() {
+		BeforeEach(func() {
+			contents = "sinks: [{type: stdout, overflow: block, block_timeout: -1s}]"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError("sinks: block_timeout must not be negative"))
+		})
+	})
+
+	Context("when a file sink has a negative max size", func() {
+		BeforeEach(func() {
+			contents = "sinks: [{type: file, path: /tmp/metrics.log, max_size: -1}]"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError("sinks: max_size and max_files must not be negative"))
+		})
+	})
+
+	Context("when a file sink has a negative number of max files", func() {
+		BeforeEach(func() {
+			contents = "sinks: [{type: file, path: /tmp/metrics.log, max_files: -1}]"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError("sinks: max_size and max_files must not be negative"))
+		})
+	})
+
+	Context("when a sink has an unknown format", func() {
+		BeforeEach(func() {
+			contents = "sinks: [{type: stdout, format: xml}]"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError(`sinks: unknown format "xml"`))
+		})
+	})
+
+	Context("when aggregation is configured", func() {
+		BeforeEach(func() {
+			contents = "aggregation: {metrics: [garden.numGoroutines]}"
+		})
+
+		It("samples every second with the median, p90 and p99", func() {
+			Expect(loadErr).NotTo(HaveOccurred())
+			Expect(*cfg.Aggregation).To(Equal(metricsadapter.AggregationConfig{
+				SampleInterval: time.Second,
+				Percentiles:    []float64{0.5, 0.9, 0.99},
+				Compression:    100,
+				Metrics:        []string{"garden.numGoroutines"},
+			}))
+		})
+	})
+
+	Context("when aggregation does not name the metrics to roll up", func() {
+		BeforeEach(func() {
+			contents = "aggregation: {}"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError("aggregation: metrics must be set"))
+		})
+	})
+
+	Context("when an aggregation percentile is out of range", func() {
+		BeforeEach(func() {
+			contents = "aggregation: {percentiles: [50], metrics: [garden.numGoroutines]}"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError("aggregation: percentile 50 must be between 0 and 1"))
+		})
+	})
+
+	Context("when bosh is enabled", func() {
+		BeforeEach(func() {
+			contents = "bosh: {}\ntags: {team: garden}"
+		})
+
+		It("reads the metadata under /var/vcap", func() {
+			Expect(loadErr).NotTo(HaveOccurred())
+			Expect(*cfg.BOSH).To(Equal(metricsadapter.BOSHConfig{Root: "/var/vcap"}))
+			Expect(cfg.Tags).To(Equal(map[string]string{"team": "garden"}))
+		})
+	})
+
+	Context("when garden discovery is enabled", func() {
+		BeforeEach(func() {
+			contents = "garden_discovery: {}\ncanary: {}"
+		})
+
+		It("reads garden's job config every 30s and lets the canary use the API server it finds there", func() {
+			Expect(loadErr).NotTo(HaveOccurred())
+			Expect(*cfg.GardenDiscovery).To(Equal(metricsadapter.GardenDiscoveryConfig{
+				ConfigPath: "/var/vcap/jobs/garden/config/config.ini",
+				Interval:   30 * time.Second,
+			}))
+			Expect(cfg.Canary.GardenNetwork).To(BeEmpty())
+			Expect(cfg.Canary.GardenAddress).To(BeEmpty())
+		})
+	})
+
+	Context("when dedup is enabled", func() {
+		BeforeEach(func() {
+			contents = "dedup: {relative: 0.05}"
+		})
+
+		It("sends a heartbeat every 10 intervals", func() {
+			Expect(loadErr).NotTo(HaveOccurred())
+			Expect(*cfg.Dedup).To(Equal(metricsadapter.DedupConfig{Relative: 0.05, Heartbeat: 10}))
+		})
+	})
+
+	Context("when a dedup threshold is negative", func() {
+		BeforeEach(func() {
+			contents = "dedup: {absolute: -1}"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError(ContainSubstring("dedup:")))
+		})
+	})
+
+	Context("when cardinality is limited", func() {
+		BeforeEach(func() {
+			contents = "cardinality: {max_series: 1000, metrics: [{prefix: garden.goroutines, max_tag_values: 20}]}"
+		})
+
+		It("folds the overflow into other, and logs the 10 worst offenders every minute", func() {
+			Expect(loadErr).NotTo(HaveOccurred())
+			Expect(*cfg.Cardinality).To(Equal(metricsadapter.CardinalityConfig{
+				CardinalityLimits: metricsadapter.CardinalityLimits{MaxSeries: 1000},
+				Overflow:          "fold",
+				Expiry:            time.Hour,
+				ReportInterval:    time.Minute,
+				Top:               10,
+				Metrics: []metricsadapter.MetricCardinalityLimits{{
+					Prefix:            "garden.goroutines",
+					CardinalityLimits: metricsadapter.CardinalityLimits{MaxTagValues: 20},
+				}},
+			}))
+		})
+	})
+
+	Context("when the cardinality overflow is unknown", func() {
+		BeforeEach(func() {
+			contents = "cardinality: {overflow: sample}"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError(`cardinality: unknown overflow "sample", must be fold or drop`))
+		})
+	})
+
+	Context("when the oom interval is negative", func() {
+		BeforeEach(func() {
+			contents = "oom: {interval: -10s}"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(MatchError("oom: interval must be positive"))
+		})
+	})
+
+	Context("when the config has unknown keys", func() {
+		BeforeEach(func() {
+			contents = "canray: {}"
+		})
+
+		It("returns an error", func() {
+			Expect(loadErr).To(HaveOccurred())
+		})
+	})
+
+	Context("when the file does not exist", func() {
+		It("returns an error", func() {
+			_, err := metricsadapter.LoadConfig("/does/not/exist")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
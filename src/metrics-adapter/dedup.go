@@ -0,0 +1,118 @@
+package metricsadapter
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lastSent is what a Deduplicator knows about a series: the value it last
+// let through, and for how many intervals since it held the series back.
+type lastSent struct {
+	value   float64
+	skipped int
+}
+
+// Deduplicator holds back the series whose value did not change by more than
+// a threshold since it last let them through, so that series which hardly
+// ever change, like limits, are not paid for on every poll. Every heartbeat
+// intervals a series is let through anyway, so that it does not look stale.
+//
+// A value changes enough when it differs from the last one let through by
+// more than the absolute threshold, or by more than the relative threshold
+// times the last value. Without thresholds, any change is enough.
+//
+// It is a Collector of metrics_adapter.dedup.sent and .suppressed, the series
+// it let through and held back so far.
+type Deduplicator struct {
+	host      string
+	absolute  float64
+	relative  float64
+	heartbeat int
+	prefixes  []string
+
+	mu         sync.Mutex
+	last       map[string]*lastSent
+	sent       int64
+	suppressed int64
+}
+
+func NewDeduplicator(host string, cfg DedupConfig) *Deduplicator {
+	return &Deduplicator{
+		host:      host,
+		absolute:  cfg.Absolute,
+		relative:  cfg.Relative,
+		heartbeat: cfg.Heartbeat,
+		prefixes:  cfg.Metrics,
+		last:      map[string]*lastSent{},
+	}
+}
+
+// Filter returns the series of one interval that changed enough or are due
+// a heartbeat, along with those that are not deduplicated. A series that is
+// missing from an interval is forgotten, and let through when it comes back.
+func (d *Deduplicator) Filter(series Series) Series {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var (
+		filtered Series
+		last     = make(map[string]*lastSent, len(d.last))
+	)
+	for _, metric := range series.Series {
+		if len(metric.Points) == 0 || !hasPrefix(metric.Metric, d.prefixes) {
+			filtered.Series = append(filtered.Series, metric)
+			continue
+		}
+
+		key := seriesKey(metric)
+		value := metric.Points[len(metric.Points)-1][1]
+		s, ok := d.last[key]
+		if ok && !d.changed(s.value, value) && s.skipped+1 < d.heartbeat {
+			s.skipped++
+			last[key] = s
+			d.suppressed++
+			continue
+		}
+
+		last[key] = &lastSent{value: value}
+		d.sent++
+		filtered.Series = append(filtered.Series, metric)
+	}
+	d.last = last
+
+	return filtered
+}
+
+func (d *Deduplicator) changed(last, value float64) bool {
+	delta := math.Abs(value - last)
+	if d.absolute == 0 && d.relative == 0 {
+		return delta != 0
+	}
+	return (d.absolute > 0 && delta > d.absolute) || (d.relative > 0 && delta > d.relative*math.Abs(last))
+}
+
+func (d *Deduplicator) Collect() (Series, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := &sample{timestamp: time.Now().Unix(), host: d.host}
+	s.add("metrics_adapter.dedup.sent", float64(d.sent))
+	s.add("metrics_adapter.dedup.suppressed", float64(d.suppressed))
+	return Series{Series: s.metrics}, nil
+}
+
+// hasPrefix tells whether the name starts with one of the prefixes, or
+// whether there are none.
+func hasPrefix(name string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package metricsadapter_test
+
+import (
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Deduplicator", func() {
+	var (
+		cfg          metricsadapter.DedupConfig
+		deduplicator *metricsadapter.Deduplicator
+	)
+
+	// poll filters one interval of series with the given values, and returns
+	// the names of those let through
+	poll := func(values map[string]float64) []string {
+		var series metricsadapter.Series
+		for name, value := range values {
+			series.Series = append(series.Series, metricsadapter.Metric{
+				Metric: name,
+				Points: metricsadapter.MetricPoints{{1000, value}},
+				Host:   "cactus",
+				Tags:   []string{"a:b"},
+			})
+		}
+
+		var names []string
+		for _, metric := range deduplicator.Filter(series).Series {
+			names = append(names, metric.Metric)
+		}
+		return names
+	}
+
+	BeforeEach(func() {
+		cfg = metricsadapter.DedupConfig{Heartbeat: 3}
+	})
+
+	JustBeforeEach(func() {
+		deduplicator = metricsadapter.NewDeduplicator("cactus", cfg)
+	})
+
+	It("lets a series through when it is new or its value changed", func() {
+		Expect(poll(map[string]float64{"garden.memory": 1})).To(ConsistOf("garden.memory"))
+		Expect(poll(map[string]float64{"garden.memory": 1})).To(BeEmpty())
+		Expect(poll(map[string]float64{"garden.memory": 2})).To(ConsistOf("garden.memory"))
+	})
+
+	It("lets a series through every heartbeat intervals when it does not change", func() {
+		Expect(poll(map[string]float64{"garden.memory": 1})).To(ConsistOf("garden.memory"))
+		Expect(poll(map[string]float64{"garden.memory": 1})).To(BeEmpty())
+		Expect(poll(map[string]float64{"garden.memory": 1})).To(BeEmpty())
+		Expect(poll(map[string]float64{"garden.memory": 1})).To(ConsistOf("garden.memory"))
+		Expect(poll(map[string]float64{"garden.memory": 1})).To(BeEmpty())
+	})
+
+	It("forgets a series missing from an interval", func() {
+		Expect(poll(map[string]float64{"garden.memory": 1, "garden.numGoroutines": 5})).To(ConsistOf("garden.memory", "garden.numGoroutines"))
+		Expect(poll(map[string]float64{"garden.numGoroutines": 5})).To(BeEmpty())
+		Expect(poll(map[string]float64{"garden.memory": 1, "garden.numGoroutines": 5})).To(ConsistOf("garden.memory"))
+	})
+
+	It("counts the series it let through and held back", func() {
+		poll(map[string]float64{"garden.memory": 1})
+		poll(map[string]float64{"garden.memory": 1})
+		poll(map[string]float64{"garden.memory": 1})
+
+		series, err := deduplicator.Collect()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(series.Series).To(HaveLen(2))
+		Expect(series.Series[0].Metric).To(Equal("metrics_adapter.dedup.sent"))
+		Expect(series.Series[0].Points[0][1]).To(Equal(1.0))
+		Expect(series.Series[1].Metric).To(Equal("metrics_adapter.dedup.suppressed"))
+		Expect(series.Series[1].Points[0][1]).To(Equal(2.0))
+	})
+
+	Context("with an absolute threshold", func() {
+		BeforeEach(func() {
+			cfg.Absolute = 10
+		})
+
+		It("lets a series through once it moved by more than the threshold from the value last let through", func() {
+			Expect(poll(map[string]float64{"garden.memory": 100})).To(ConsistOf("garden.memory"))
+			Expect(poll(map[string]float64{"garden.memory": 106})).To(BeEmpty())
+			Expect(poll(map[string]float64{"garden.memory": 111})).To(ConsistOf("garden.memory"))
+		})
+	})
+
+	Context("with a relative threshold", func() {
+		BeforeEach(func() {
+			cfg.Relative = 0.1
+		})
+
+		It("lets a series through once it moved by more than the fraction of the value last let through", func() {
+			Expect(poll(map[string]float64{"garden.memory": 1000})).To(ConsistOf("garden.memory"))
+			Expect(poll(map[string]float64{"garden.memory": 950})).To(BeEmpty())
+			Expect(poll(map[string]float64{"garden.memory": 899})).To(ConsistOf("garden.memory"))
+		})
+	})
+
+	Context("when only some metrics are deduplicated", func() {
+		BeforeEach(func() {
+			cfg.Metrics = []string{"garden.memory"}
+		})
+
+		It("always lets the others through", func() {
+			Expect(poll(map[string]float64{"garden.memory": 1, "garden.numGoroutines": 5})).To(ConsistOf("garden.memory", "garden.numGoroutines"))
+			Expect(poll(map[string]float64{"garden.memory": 1, "garden.numGoroutines": 5})).To(ConsistOf("garden.numGoroutines"))
+		})
+	})
+})
@@ -0,0 +1,404 @@
+package metricsadapter
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+
+	defaultHealthInterval   = 10 * time.Second
+	defaultFailureThreshold = 3
+	defaultOpenDuration     = 30 * time.Second
+
+	healthCheckTimeout = 2 * time.Second
+)
+
+// breaker is the circuit breaker of an endpoint. It opens after a number of
+// consecutive failures and stops traffic to the endpoint. After a while it
+// lets traffic through again to try the endpoint, half-open, and closes on
+// the first success or opens again on the first failure.
+type breaker struct {
+	threshold    int
+	openDuration time.Duration
+
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+func (b *breaker) allow(now time.Time) bool {
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.openDuration {
+		b.state = BreakerHalfOpen
+	}
+	return b.state != BreakerOpen
+}
+
+func (b *breaker) failure(now time.Time) {
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		b.state, b.openedAt = BreakerOpen, now
+	}
+}
+
+func (b *breaker) success() {
+	b.state, b.failures = BreakerClosed, 0
+}
+
+type proxyEndpoint struct {
+	address string
+	sender  wavefront.Sender
+	breaker breaker
+
+	// the sends since the last flush, which the sender buffers and loses
+	// when flushing fails
+	unflushed []func(wavefront.Sender) error
+}
+
+type transitionKey struct {
+	endpoint string
+	state    string
+}
+
+// FailoverSender is a wavefront.Sender for an ordered list of Wavefront
+// proxies. It sends to the first proxy whose circuit breaker is not open,
+// fails over to the next one when sending fails, and fails back when an
+// earlier one recovers. A proxy sender buffers what it is sent until it is
+// flushed: when flushing fails, what was sent to the proxy since its last
+// flush is sent again to the next one. Proxies are health checked every
+// health interval by connecting to them, which is what closes the breaker of
+// a proxy that has come back, and opens the breaker of an idle one that has
+// gone.
+//
+// Every transition of a breaker and every change of the proxy sent to is
+// logged and counted. FailoverSender is a Collector of
+//
+//   - metrics_adapter.proxy.up: 1 when the breaker of a proxy is closed
+//   - metrics_adapter.proxy.active: 1 for the proxy sent to
+//   - metrics_adapter.proxy.transitions: breaker transitions, tagged with
+//     the state the breaker went to
+//   - metrics_adapter.proxy.failovers: changes of the proxy sent to
+//
+// tagged with the endpoint of the proxy, and without a host.
+type FailoverSender struct {
+	logger lager.Logger
+
+	mu        sync.Mutex
+	endpoints []*proxyEndpoint
+	active    int
+
+	transitions map[transitionKey]int64
+	failovers   int64
+	failures    int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewFailoverSender(logger lager.Logger, cfg SinkConfig) (*FailoverSender, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.New("wavefront proxy endpoints must be set")
+	}
+
+	healthInterval := cfg.HealthInterval
+	if healthInterval == 0 {
+		healthInterval = defaultHealthInterval
+	}
+	threshold := cfg.FailureThreshold
+	if threshold == 0 {
+		threshold = defaultFailureThreshold
+	}
+	openDuration := cfg.OpenDuration
+	if openDuration == 0 {
+		openDuration = defaultOpenDuration
+	}
+
+	f := &FailoverSender{
+		logger:      logger.Session("failover"),
+		transitions: map[transitionKey]int64{},
+		done:        make(chan struct{}),
+	}
+	for _, address := range cfg.Endpoints {
+		sender, err := newProxySender(address)
+		if err != nil {
+			f.closeSenders()
+			return nil, err
+		}
+
+		f.endpoints = append(f.endpoints, &proxyEndpoint{
+			address: address,
+			sender:  sender,
+			breaker: breaker{threshold: threshold, openDuration: openDuration, state: BreakerClosed},
+		})
+	}
+
+	f.wg.Add(1)
+	go f.checkHealth(healthInterval)
+
+	return f, nil
+}
+
+func (f *FailoverSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	return f.send(func(s wavefront.Sender) error {
+		return s.SendMetric(name, value, ts, source, tags)
+	})
+}
+
+func (f *FailoverSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	return f.send(func(s wavefront.Sender) error {
+		return s.SendDeltaCounter(name, value, source, tags)
+	})
+}
+
+func (f *FailoverSender) SendDistribution(name string, centroids []histogram.Centroid, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string) error {
+	return f.send(func(s wavefront.Sender) error {
+		return s.SendDistribution(name, centroids, hgs, ts, source, tags)
+	})
+}
+
+func (f *FailoverSender) SendSpan(name string, startMillis, durationMillis int64, source, traceID, spanID string, parents, followsFrom []string, tags []wavefront.SpanTag, spanLogs []wavefront.SpanLog) error {
+	return f.send(func(s wavefront.Sender) error {
+		return s.SendSpan(name, startMillis, durationMillis, source, traceID, spanID, parents, followsFrom, tags, spanLogs)
+	})
+}
+
+func (f *FailoverSender) SendEvent(name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) error {
+	return f.send(func(s wavefront.Sender) error {
+		return s.SendEvent(name, startMillis, endMillis, source, tags, setters...)
+	})
+}
+
+// send tries the proxies in order, skipping those whose breaker is open.
+func (f *FailoverSender) send(op func(wavefront.Sender) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.sendExcept(op, nil)
+}
+
+// sendExcept sends to the first proxy that takes it, skipping those whose
+// breaker is open and those that failed to flush.
+func (f *FailoverSender) sendExcept(op func(wavefront.Sender) error, failedToFlush map[*proxyEndpoint]bool) error {
+	var errs []string
+	for i, endpoint := range f.endpoints {
+		if failedToFlush[endpoint] || !f.allow(endpoint) {
+			continue
+		}
+
+		err := op(endpoint.sender)
+		if err == nil {
+			f.succeeded(endpoint)
+			f.activate(i)
+			endpoint.unflushed = append(endpoint.unflushed, op)
+			return nil
+		}
+
+		f.failed(endpoint)
+		errs = append(errs, endpoint.address+": "+err.Error())
+	}
+
+	f.failures++
+	if len(errs) == 0 {
+		return errors.New("all wavefront proxies are unavailable")
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// Flush flushes the proxies sent to since the last flush. What a proxy that
+// fails to flush was sent is sent to the next proxy, which is flushed in
+// turn. It only returns an error when some of it could not be sent.
+func (f *FailoverSender) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var (
+		failedToFlush = map[*proxyEndpoint]bool{}
+		errs          []string
+		lost          int
+	)
+	for {
+		endpoint := f.nextUnflushed()
+		if endpoint == nil {
+			break
+		}
+		unflushed := endpoint.unflushed
+		endpoint.unflushed = nil
+
+		err := endpoint.sender.Flush()
+		if err == nil {
+			continue
+		}
+
+		f.failed(endpoint)
+		failedToFlush[endpoint] = true
+		errs = append(errs, endpoint.address+": "+err.Error())
+		f.logger.Info("resending-unflushed", lager.Data{"endpoint": endpoint.address, "sends": len(unflushed), "error": err.Error()})
+
+		for i, op := range unflushed {
+			if err := f.sendExcept(op, failedToFlush); err != nil {
+				// no proxy takes the rest either, they are lost along with
+				// the send that failed, which was counted already
+				f.failures += int64(len(unflushed) - i - 1)
+				lost += len(unflushed) - i
+				f.logger.Error("losing-unflushed", err, lager.Data{"endpoint": endpoint.address, "sends": len(unflushed) - i})
+				break
+			}
+		}
+	}
+
+	if lost > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (f *FailoverSender) nextUnflushed() *proxyEndpoint {
+	for _, endpoint := range f.endpoints {
+		if len(endpoint.unflushed) > 0 {
+			return endpoint
+		}
+	}
+	return nil
+}
+
+func (f *FailoverSender) GetFailureCount() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failures
+}
+
+func (f *FailoverSender) Start() {}
+
+func (f *FailoverSender) Close() {
+	close(f.done)
+	f.wg.Wait()
+	f.closeSenders()
+}
+
+func (f *FailoverSender) closeSenders() {
+	for _, endpoint := range f.endpoints {
+		endpoint.sender.Close()
+	}
+}
+
+func (f *FailoverSender) Collect() (Series, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := &sample{timestamp: time.Now().Unix()}
+	for i, endpoint := range f.endpoints {
+		tag := "endpoint:" + endpoint.address
+
+		up, active := 0.0, 0.0
+		if endpoint.breaker.state == BreakerClosed {
+			up = 1
+		}
+		if i == f.active {
+			active = 1
+		}
+		s.add("metrics_adapter.proxy.up", up, tag)
+		s.add("metrics_adapter.proxy.active", active, tag)
+
+		for _, state := range []string{BreakerOpen, BreakerHalfOpen, BreakerClosed} {
+			s.add("metrics_adapter.proxy.transitions", float64(f.transitions[transitionKey{endpoint.address, state}]), tag, "state:"+state)
+		}
+	}
+	s.add("metrics_adapter.proxy.failovers", float64(f.failovers))
+
+	return Series{Series: s.metrics}, nil
+}
+
+func (f *FailoverSender) checkHealth(interval time.Duration) {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-f.done:
+			return
+		}
+
+		for _, endpoint := range f.endpoints {
+			conn, err := net.DialTimeout("tcp", endpoint.address, healthCheckTimeout)
+			if err == nil {
+				conn.Close()
+			}
+
+			f.mu.Lock()
+			if err == nil {
+				f.succeeded(endpoint)
+			} else {
+				f.failed(endpoint)
+			}
+			f.mu.Unlock()
+		}
+
+		f.mu.Lock()
+		for i, endpoint := range f.endpoints {
+			if endpoint.breaker.state == BreakerClosed {
+				f.activate(i)
+				break
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *FailoverSender) allow(endpoint *proxyEndpoint) bool {
+	before := endpoint.breaker.state
+	allowed := endpoint.breaker.allow(time.Now())
+	f.transitioned(endpoint, before)
+	return allowed
+}
+
+func (f *FailoverSender) succeeded(endpoint *proxyEndpoint) {
+	before := endpoint.breaker.state
+	endpoint.breaker.success()
+	f.transitioned(endpoint, before)
+}
+
+func (f *FailoverSender) failed(endpoint *proxyEndpoint) {
+	before := endpoint.breaker.state
+	endpoint.breaker.failure(time.Now())
+	f.transitioned(endpoint, before)
+}
+
+func (f *FailoverSender) transitioned(endpoint *proxyEndpoint, before string) {
+	after := endpoint.breaker.state
+	if after == before {
+		return
+	}
+
+	f.transitions[transitionKey{endpoint.address, after}]++
+	f.logger.Info("circuit-breaker-transitioned", lager.Data{"endpoint": endpoint.address, "from": before, "to": after})
+}
+
+func (f *FailoverSender) activate(i int) {
+	if i == f.active {
+		return
+	}
+
+	from, to := f.endpoints[f.active].address, f.endpoints[i].address
+	action := "failed-over"
+	if i < f.active {
+		action = "failed-back"
+	}
+
+	f.active = i
+	f.failovers++
+	f.logger.Info(action, lager.Data{"from": from, "to": to})
+}
@@ -0,0 +1,200 @@
+package metricsadapter_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FailoverSender", func() {
+	var (
+		primaryAddress string
+		primary        *graphiteServer
+		secondary      *graphiteServer
+		sender         *metricsadapter.FailoverSender
+		logger         *lagertest.TestLogger
+	)
+
+	proxyMetric := func(name string, tags ...string) float64 {
+		series, err := sender.Collect()
+		Expect(err).NotTo(HaveOccurred())
+		for _, metric := range series.Series {
+			if metric.Metric == name && strings.Join(metric.Tags, ",") == strings.Join(tags, ",") {
+				return metric.Points[0][1]
+			}
+		}
+		Fail("no " + name)
+		return 0
+	}
+
+	BeforeEach(func() {
+		// an address nothing listens on, until the primary starts
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		primaryAddress = listener.Addr().String()
+		Expect(listener.Close()).To(Succeed())
+
+		secondary = startGraphiteServer("127.0.0.1:0")
+		logger = lagertest.NewTestLogger("test")
+
+		sender, err = metricsadapter.NewFailoverSender(logger, metricsadapter.SinkConfig{
+			Type:             metricsadapter.SinkWavefront,
+			Endpoints:        []string{primaryAddress, secondary.listener.Addr().String()},
+			HealthInterval:   50 * time.Millisecond,
+			FailureThreshold: 1,
+			OpenDuration:     time.Hour,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		sender.Close()
+		secondary.Stop()
+		if primary != nil {
+			primary.Stop()
+			primary = nil
+		}
+	})
+
+	It("fails over when the primary is down and fails back when it recovers", func() {
+		Expect(sender.SendMetric("garden.memory", 1, 1000, "cactus", nil)).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+		Eventually(secondary.Lines).Should(ConsistOf(Equal(`"garden.memory" 1 1000 source="cactus"`)))
+
+		primaryTag := "endpoint:" + primaryAddress
+		Expect(proxyMetric("metrics_adapter.proxy.up", primaryTag)).To(Equal(0.0))
+		Expect(proxyMetric("metrics_adapter.proxy.active", primaryTag)).To(Equal(0.0))
+		Expect(proxyMetric("metrics_adapter.proxy.transitions", primaryTag, "state:open")).To(Equal(1.0))
+		Expect(proxyMetric("metrics_adapter.proxy.failovers")).To(Equal(1.0))
+		Expect(logger.LogMessages()).To(Equal([]string{
+			"test.failover.circuit-breaker-transitioned",
+			"test.failover.failed-over",
+		}))
+
+		primary = startGraphiteServer(primaryAddress)
+		Eventually(func() float64 {
+			return proxyMetric("metrics_adapter.proxy.active", primaryTag)
+		}).Should(Equal(1.0))
+		Expect(proxyMetric("metrics_adapter.proxy.transitions", primaryTag, "state:closed")).To(Equal(1.0))
+		Expect(proxyMetric("metrics_adapter.proxy.failovers")).To(Equal(2.0))
+		Expect(logger.LogMessages()).To(ContainElement("test.failover.failed-back"))
+
+		Expect(sender.SendMetric("garden.memory", 2, 1001, "cactus", nil)).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+		Eventually(primary.Lines).Should(ConsistOf(Equal(`"garden.memory" 2 1001 source="cactus"`)))
+		Expect(secondary.Lines()).To(HaveLen(1))
+	})
+
+	Context("when the active proxy fails to flush", func() {
+		var (
+			listener net.Listener
+			accepted chan net.Conn
+		)
+
+		BeforeEach(func() {
+			sender.Close()
+
+			// the primary takes connections, for the test to reset them
+			var err error
+			listener, err = net.Listen("tcp", primaryAddress)
+			Expect(err).NotTo(HaveOccurred())
+			accepted = make(chan net.Conn, 10)
+			go func(listener net.Listener, accepted chan<- net.Conn) {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					accepted <- conn
+				}
+			}(listener, accepted)
+
+			sender, err = metricsadapter.NewFailoverSender(logger, metricsadapter.SinkConfig{
+				Type:             metricsadapter.SinkWavefront,
+				Endpoints:        []string{primaryAddress, secondary.listener.Addr().String()},
+				HealthInterval:   time.Hour,
+				FailureThreshold: 1,
+				OpenDuration:     time.Hour,
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(listener.Close()).To(Succeed())
+		})
+
+		It("sends what it was sent since the last flush to the next proxy", func() {
+			Expect(sender.SendMetric("garden.memory", 1, 1000, "cactus", nil)).To(Succeed())
+			Expect(sender.SendMetric("garden.memory", 2, 1001, "cactus", nil)).To(Succeed())
+
+			// resetting the connection fails the next write of what the
+			// sender buffered
+			var conn net.Conn
+			Eventually(accepted).Should(Receive(&conn))
+			Expect(conn.(*net.TCPConn).SetLinger(0)).To(Succeed())
+			Expect(conn.Close()).To(Succeed())
+			Expect(proxyMetric("metrics_adapter.proxy.active", "endpoint:"+primaryAddress)).To(Equal(1.0))
+
+			Expect(sender.Flush()).To(Succeed())
+			Eventually(secondary.Lines).Should(Equal([]string{
+				`"garden.memory" 1 1000 source="cactus"`,
+				`"garden.memory" 2 1001 source="cactus"`,
+			}))
+
+			Expect(proxyMetric("metrics_adapter.proxy.up", "endpoint:"+primaryAddress)).To(Equal(0.0))
+			Expect(proxyMetric("metrics_adapter.proxy.failovers")).To(Equal(1.0))
+			Expect(logger.LogMessages()).To(ContainElement("test.failover.resending-unflushed"))
+			Expect(sender.GetFailureCount()).To(BeZero())
+		})
+
+		It("does not write to the proxy before it is flushed", func() {
+			Expect(sender.SendMetric("garden.memory", 1, 1000, "cactus", nil)).To(Succeed())
+
+			var conn net.Conn
+			Eventually(accepted).Should(Receive(&conn))
+			defer conn.Close()
+			Expect(conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))).To(Succeed())
+			_, err := conn.Read(make([]byte, 1))
+			Expect(err).To(MatchError(ContainSubstring("timeout")))
+
+			Expect(sender.Flush()).To(Succeed())
+			Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			Expect(err).NotTo(HaveOccurred())
+			Expect(line).To(Equal("\"garden.memory\" 1 1000 source=\"cactus\"\n"))
+		})
+
+		Context("when the next proxy is down too", func() {
+			BeforeEach(func() {
+				secondary.Stop()
+			})
+
+			It("counts every send it could not send again as lost", func() {
+				Expect(sender.SendMetric("garden.memory", 1, 1000, "cactus", nil)).To(Succeed())
+				Expect(sender.SendMetric("garden.memory", 2, 1001, "cactus", nil)).To(Succeed())
+
+				var conn net.Conn
+				Eventually(accepted).Should(Receive(&conn))
+				Expect(conn.(*net.TCPConn).SetLinger(0)).To(Succeed())
+				Expect(conn.Close()).To(Succeed())
+
+				Expect(sender.Flush()).To(HaveOccurred())
+				Expect(sender.GetFailureCount()).To(BeEquivalentTo(2))
+				Expect(logger.LogMessages()).To(ContainElement("test.failover.losing-unflushed"))
+			})
+		})
+	})
+
+	It("returns an error when every proxy is down", func() {
+		secondary.Stop()
+
+		Expect(sender.SendMetric("garden.memory", 1, 1000, "cactus", nil)).To(HaveOccurred())
+		Expect(sender.GetFailureCount()).To(BeEquivalentTo(1))
+	})
+})
@@ -0,0 +1,389 @@
+package metricsadapter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const (
+	OverflowDropOldest = "drop_oldest"
+	OverflowDropNewest = "drop_newest"
+	OverflowBlock      = "block"
+
+	defaultQueueSize    = 10000
+	defaultBlockTimeout = 5 * time.Second
+)
+
+// FanOutSender is a wavefront.Sender that sends everything it is sent to
+// several sinks. Every sink has its own bounded queue and a worker that
+// sends from it, so a slow or dead sink holds up neither collection nor the
+// other sinks. When a queue is full, its overflow policy decides whether
+// the oldest or the newest send is dropped, or whether sending blocks until
+// there is room. Sending blocks for the block timeout at most: a sink whose
+// queue had no room for that long is stalled, and the sends to it are
+// dropped without waiting until its queue has room again. The sinks that
+// block are sent to after the others, which a stalled one does not hold up.
+//
+// Once it is closed, what a FanOutSender is sent is dropped.
+//
+// Sends to the sinks happen in the background, so the errors of the sinks
+// are not returned but counted. FanOutSender is also a Collector of these
+// counts, per sink:
+//
+//   - metrics_adapter.sink.queued: sends waiting in the queue
+//   - metrics_adapter.sink.sent: sends that succeeded
+//   - metrics_adapter.sink.errors: sends that failed
+//   - metrics_adapter.sink.dropped: sends dropped because the queue was full
+//
+// and of the metrics of the sinks that are Collectors themselves, reported
+// for the host of the FanOutSender.
+type FanOutSender struct {
+	host string
+
+	mu     sync.RWMutex
+	queues []*sinkQueue
+	closed bool
+
+	// queues being drained after a swap
+	retiring sync.WaitGroup
+}
+
+// sinkQueue holds the sends for one sink, as functions of its sender.
+type sinkQueue struct {
+	name         string
+	sinkType     string
+	sender       wavefront.Sender
+	overflow     string
+	blockTimeout time.Duration
+
+	// serializes enqueuing, so that dropping the oldest send always makes
+	// room for the newest; closing wakes up a send that blocks, so that the
+	// queue can be closed
+	enqueueMu sync.Mutex
+	ops       chan func(wavefront.Sender) error
+	stalled   bool
+	closed    bool
+	closing   chan struct{}
+	done      chan struct{}
+
+	mu      sync.Mutex
+	sent    int64
+	errors  int64
+	dropped int64
+}
+
+// FanOutSink is a sink of a FanOutSender. The queue size defaults to 10000
+// sends, the overflow policy to dropping the oldest send and the block
+// timeout to 5 seconds.
+type FanOutSink struct {
+	Name         string
+	Type         string
+	Sender       wavefront.Sender
+	QueueSize    int
+	Overflow     string
+	BlockTimeout time.Duration
+}
+
+// NewFanOutSender starts a worker for every sink.
+func NewFanOutSender(host string, sinks ...FanOutSink) *FanOutSender {
+	f := &FanOutSender{host: host}
+	for _, sink := range sinks {
+		f.queues = append(f.queues, newSinkQueue(sink))
+	}
+	return f
+}
+
+func newSinkQueue(sink FanOutSink) *sinkQueue {
+	size := sink.QueueSize
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+
+	overflow := sink.Overflow
+	if overflow == "" {
+		overflow = OverflowDropOldest
+	}
+
+	blockTimeout := sink.BlockTimeout
+	if blockTimeout <= 0 {
+		blockTimeout = defaultBlockTimeout
+	}
+
+	q := &sinkQueue{
+		name:         sink.Name,
+		sinkType:     sink.Type,
+		sender:       sink.Sender,
+		overflow:     overflow,
+		blockTimeout: blockTimeout,
+		ops:          make(chan func(wavefront.Sender) error, size),
+		closing:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go q.work()
+	return q
+}
+
+// Swap replaces the sinks in one go. A sink with a sender that is already
+// sent to keeps its queue, and with it what is queued and counted for it.
+// The queues of the sinks that are gone are drained and their senders
+// closed in the background.
+func (f *FanOutSender) Swap(sinks ...FanOutSink) {
+	f.mu.Lock()
+	kept := map[wavefront.Sender]*sinkQueue{}
+	for _, q := range f.queues {
+		kept[q.sender] = q
+	}
+
+	var queues []*sinkQueue
+	for _, sink := range sinks {
+		if q, ok := kept[sink.Sender]; ok {
+			delete(kept, sink.Sender)
+			q.name, q.sinkType = sink.Name, sink.Type
+			queues = append(queues, q)
+			continue
+		}
+		queues = append(queues, newSinkQueue(sink))
+	}
+	f.queues = queues
+	f.mu.Unlock()
+
+	for _, q := range kept {
+		f.retiring.Add(1)
+		go func(q *sinkQueue) {
+			defer f.retiring.Done()
+			q.close()
+		}(q)
+	}
+}
+
+func (f *FanOutSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	f.enqueue(func(s wavefront.Sender) error {
+		return s.SendMetric(name, value, ts, source, tags)
+	})
+	return nil
+}
+
+func (f *FanOutSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	f.enqueue(func(s wavefront.Sender) error {
+		return s.SendDeltaCounter(name, value, source, tags)
+	})
+	return nil
+}
+
+func (f *FanOutSender) SendDistribution(name string, centroids []histogram.Centroid, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string) error {
+	f.enqueue(func(s wavefront.Sender) error {
+		return s.SendDistribution(name, centroids, hgs, ts, source, tags)
+	})
+	return nil
+}
+
+func (f *FanOutSender) SendSpan(name string, startMillis, durationMillis int64, source, traceID, spanID string, parents, followsFrom []string, tags []wavefront.SpanTag, spanLogs []wavefront.SpanLog) error {
+	f.enqueue(func(s wavefront.Sender) error {
+		return s.SendSpan(name, startMillis, durationMillis, source, traceID, spanID, parents, followsFrom, tags, spanLogs)
+	})
+	return nil
+}
+
+func (f *FanOutSender) SendEvent(name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) error {
+	f.enqueue(func(s wavefront.Sender) error {
+		return s.SendEvent(name, startMillis, endMillis, source, tags, setters...)
+	})
+	return nil
+}
+
+// Flush queues a flush of every sink behind what was sent before.
+func (f *FanOutSender) Flush() error {
+	f.enqueue(func(s wavefront.Sender) error {
+		return s.Flush()
+	})
+	return nil
+}
+
+// GetFailureCount returns the failed and dropped sends of all sinks.
+func (f *FanOutSender) GetFailureCount() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var failures int64
+	for _, q := range f.queues {
+		q.mu.Lock()
+		failures += q.errors + q.dropped
+		q.mu.Unlock()
+	}
+	return failures
+}
+
+func (f *FanOutSender) Start() {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, q := range f.queues {
+		q.sender.Start()
+	}
+}
+
+// Close sends what is left in the queues, then closes the sinks. Closing
+// again does nothing.
+func (f *FanOutSender) Close() {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	queues := f.queues
+	f.mu.Unlock()
+
+	for _, q := range queues {
+		q.closeOps()
+	}
+	for _, q := range queues {
+		<-q.done
+		q.sender.Close()
+	}
+	f.retiring.Wait()
+}
+
+func (f *FanOutSender) Collect() (Series, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	s := &sample{timestamp: time.Now().Unix(), host: f.host}
+	for _, q := range f.queues {
+		q.mu.Lock()
+		sent, errors, dropped := q.sent, q.errors, q.dropped
+		q.mu.Unlock()
+
+		tags := []string{"sink:" + q.name, "type:" + q.sinkType}
+		s.add("metrics_adapter.sink.queued", float64(len(q.ops)), tags...)
+		s.add("metrics_adapter.sink.sent", float64(sent), tags...)
+		s.add("metrics_adapter.sink.errors", float64(errors), tags...)
+		s.add("metrics_adapter.sink.dropped", float64(dropped), tags...)
+
+		if collector, ok := q.sender.(Collector); ok {
+			series, err := collector.Collect()
+			if err != nil {
+				return Series{}, err
+			}
+			for _, metric := range series.Series {
+				metric.Host = f.host
+				s.metrics = append(s.metrics, metric)
+			}
+		}
+	}
+	return Series{Series: s.metrics}, nil
+}
+
+// enqueue queues a send to every sink, to those that block last. It does
+// not hold the lock of the sinks while it blocks, which would hold up a swap
+// or close until then.
+func (f *FanOutSender) enqueue(op func(wavefront.Sender) error) {
+	f.mu.RLock()
+	if f.closed {
+		f.mu.RUnlock()
+		return
+	}
+	var queues, blocking []*sinkQueue
+	for _, q := range f.queues {
+		if q.overflow == OverflowBlock {
+			blocking = append(blocking, q)
+			continue
+		}
+		queues = append(queues, q)
+	}
+	f.mu.RUnlock()
+
+	for _, q := range append(queues, blocking...) {
+		q.enqueue(op)
+	}
+}
+
+func (q *sinkQueue) enqueue(op func(wavefront.Sender) error) {
+	q.enqueueMu.Lock()
+	defer q.enqueueMu.Unlock()
+
+	// the queue was swapped out or closed since it was looked up
+	if q.closed {
+		return
+	}
+
+	select {
+	case q.ops <- op:
+		q.stalled = false
+		return
+	default:
+	}
+
+	switch q.overflow {
+	case OverflowBlock:
+		if !q.stalled && q.block(op) {
+			return
+		}
+	case OverflowDropOldest:
+		select {
+		case <-q.ops:
+		default:
+			// the worker took one meanwhile
+		}
+		q.ops <- op
+	}
+
+	q.mu.Lock()
+	q.dropped++
+	q.mu.Unlock()
+}
+
+// block waits for room in the queue for the block timeout at most, and
+// stalls the queue when there was none.
+func (q *sinkQueue) block(op func(wavefront.Sender) error) bool {
+	timer := time.NewTimer(q.blockTimeout)
+	defer timer.Stop()
+
+	select {
+	case q.ops <- op:
+		return true
+	case <-timer.C:
+		q.stalled = true
+		return false
+	case <-q.closing:
+		return false
+	}
+}
+
+// closeOps closes the queue to sends, once what blocks sending gave up.
+func (q *sinkQueue) closeOps() {
+	close(q.closing)
+
+	q.enqueueMu.Lock()
+	q.closed = true
+	close(q.ops)
+	q.enqueueMu.Unlock()
+}
+
+// close sends what is left in the queue, then closes the sender.
+func (q *sinkQueue) close() {
+	q.closeOps()
+
+	<-q.done
+	q.sender.Close()
+}
+
+func (q *sinkQueue) work() {
+	defer close(q.done)
+
+	for op := range q.ops {
+		err := op(q.sender)
+
+		q.mu.Lock()
+		if err != nil {
+			q.errors++
+		} else {
+			q.sent++
+		}
+		q.mu.Unlock()
+	}
+}
@@ -0,0 +1,297 @@
+package metricsadapter_test
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/masters-of-cats/metricsadapter"
+	fakes "github.com/masters-of-cats/metricsadapter/metrics-adapterfakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FanOutSender", func() {
+	var (
+		fast, slow *fakes.FakeSender
+		release    chan struct{}
+		releaseAll func()
+	)
+
+	BeforeEach(func() {
+		fast = new(fakes.FakeSender)
+		slow = new(fakes.FakeSender)
+
+		// the slow sink hangs on every send until released
+		release = make(chan struct{})
+		var once sync.Once
+		releaseAll = func() { once.Do(func() { close(release) }) }
+
+		// workers of sinks given up on may outlive the test
+		released := release
+		slow.SendMetricStub = func(string, float64, int64, string, map[string]string) error {
+			<-released
+			return nil
+		}
+	})
+
+	AfterEach(func() {
+		releaseAll()
+	})
+
+	sentValues := func(sender *fakes.FakeSender) []float64 {
+		var values []float64
+		for i := 0; i < sender.SendMetricCallCount(); i++ {
+			_, value, _, _, _ := sender.SendMetricArgsForCall(i)
+			values = append(values, value)
+		}
+		return values
+	}
+
+	queueMetric := func(series metricsadapter.Series, name, sink string) float64 {
+		for _, metric := range series.Series {
+			if metric.Metric == name && metric.Host == "cactus" && metric.Tags[0] == "sink:"+sink {
+				return metric.Points[0][1]
+			}
+		}
+		Fail("no " + name + " for " + sink)
+		return 0
+	}
+
+	It("delivers to every sink while one of them is stuck", func() {
+		fanOut := metricsadapter.NewFanOutSender("cactus",
+			metricsadapter.FanOutSink{Name: "slow", Type: "graphite", Sender: slow, QueueSize: 2},
+			metricsadapter.FanOutSink{Name: "fast", Type: "wavefront", Sender: fast, QueueSize: 100},
+		)
+
+		for i := 0; i < 10; i++ {
+			Expect(fanOut.SendMetric("garden.memory", float64(i), 0, "cactus", nil)).To(Succeed())
+		}
+		Expect(fanOut.Flush()).To(Succeed())
+
+		Eventually(fast.FlushCallCount).Should(Equal(1))
+		Expect(sentValues(fast)).To(Equal([]float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}))
+
+		releaseAll()
+		fanOut.Close()
+		Expect(slow.CloseCallCount()).To(Equal(1))
+		Expect(fast.CloseCallCount()).To(Equal(1))
+	})
+
+	It("drops the oldest sends by default when a queue is full", func() {
+		fanOut := metricsadapter.NewFanOutSender("cactus",
+			metricsadapter.FanOutSink{Name: "slow", Type: "graphite", Sender: slow, QueueSize: 2},
+		)
+
+		Expect(fanOut.SendMetric("garden.memory", 0, 0, "cactus", nil)).To(Succeed())
+		// the worker is stuck sending the first one
+		Eventually(slow.SendMetricCallCount).Should(Equal(1))
+		for i := 1; i < 6; i++ {
+			Expect(fanOut.SendMetric("garden.memory", float64(i), 0, "cactus", nil)).To(Succeed())
+		}
+
+		series, err := fanOut.Collect()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(queueMetric(series, "metrics_adapter.sink.queued", "slow")).To(Equal(2.0))
+		Expect(queueMetric(series, "metrics_adapter.sink.dropped", "slow")).To(Equal(3.0))
+		Expect(fanOut.GetFailureCount()).To(BeEquivalentTo(3))
+
+		releaseAll()
+		fanOut.Close()
+		Expect(sentValues(slow)).To(Equal([]float64{0, 4, 5}))
+	})
+
+	It("drops the newest sends with drop_newest", func() {
+		fanOut := metricsadapter.NewFanOutSender("cactus",
+			metricsadapter.FanOutSink{Name: "slow", Type: "graphite", Sender: slow, QueueSize: 2, Overflow: metricsadapter.OverflowDropNewest},
+		)
+
+		Expect(fanOut.SendMetric("garden.memory", 0, 0, "cactus", nil)).To(Succeed())
+		Eventually(slow.SendMetricCallCount).Should(Equal(1))
+		for i := 1; i < 6; i++ {
+			Expect(fanOut.SendMetric("garden.memory", float64(i), 0, "cactus", nil)).To(Succeed())
+		}
+
+		releaseAll()
+		fanOut.Close()
+		Expect(sentValues(slow)).To(Equal([]float64{0, 1, 2}))
+	})
+
+	It("waits for room with block", func() {
+		fanOut := metricsadapter.NewFanOutSender("cactus",
+			metricsadapter.FanOutSink{Name: "slow", Type: "graphite", Sender: slow, QueueSize: 1, Overflow: metricsadapter.OverflowBlock},
+		)
+
+		Expect(fanOut.SendMetric("garden.memory", 0, 0, "cactus", nil)).To(Succeed())
+		Eventually(slow.SendMetricCallCount).Should(Equal(1))
+		Expect(fanOut.SendMetric("garden.memory", 1, 0, "cactus", nil)).To(Succeed())
+
+		sent := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			Expect(fanOut.SendMetric("garden.memory", 2, 0, "cactus", nil)).To(Succeed())
+			close(sent)
+		}()
+		Consistently(sent, "100ms").ShouldNot(BeClosed())
+
+		releaseAll()
+		Eventually(sent).Should(BeClosed())
+		fanOut.Close()
+		Expect(sentValues(slow)).To(Equal([]float64{0, 1, 2}))
+	})
+
+	It("stops waiting for room after the block timeout, and drops without waiting until there is room again", func() {
+		fanOut := metricsadapter.NewFanOutSender("cactus",
+			metricsadapter.FanOutSink{Name: "slow", Type: "graphite", Sender: slow, QueueSize: 1, Overflow: metricsadapter.OverflowBlock, BlockTimeout: 50 * time.Millisecond},
+		)
+
+		Expect(fanOut.SendMetric("garden.memory", 0, 0, "cactus", nil)).To(Succeed())
+		Eventually(slow.SendMetricCallCount).Should(Equal(1))
+		Expect(fanOut.SendMetric("garden.memory", 1, 0, "cactus", nil)).To(Succeed())
+
+		started := time.Now()
+		Expect(fanOut.SendMetric("garden.memory", 2, 0, "cactus", nil)).To(Succeed())
+		Expect(time.Since(started)).To(BeNumerically(">=", 50*time.Millisecond))
+
+		started = time.Now()
+		Expect(fanOut.SendMetric("garden.memory", 3, 0, "cactus", nil)).To(Succeed())
+		Expect(time.Since(started)).To(BeNumerically("<", 50*time.Millisecond))
+
+		series, err := fanOut.Collect()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(queueMetric(series, "metrics_adapter.sink.dropped", "slow")).To(Equal(2.0))
+
+		releaseAll()
+		Eventually(func() float64 {
+			series, err := fanOut.Collect()
+			Expect(err).NotTo(HaveOccurred())
+			return queueMetric(series, "metrics_adapter.sink.queued", "slow")
+		}).Should(BeZero())
+		Expect(fanOut.SendMetric("garden.memory", 4, 0, "cactus", nil)).To(Succeed())
+
+		fanOut.Close()
+		Expect(sentValues(slow)).To(Equal([]float64{0, 1, 4}))
+	})
+
+	Context("when a send blocks", func() {
+		var (
+			fanOut *metricsadapter.FanOutSender
+			sent   chan struct{}
+		)
+
+		BeforeEach(func() {
+			fanOut = metricsadapter.NewFanOutSender("cactus",
+				metricsadapter.FanOutSink{Name: "slow", Type: "graphite", Sender: slow, QueueSize: 1, Overflow: metricsadapter.OverflowBlock, BlockTimeout: time.Minute},
+				metricsadapter.FanOutSink{Name: "fast", Type: "wavefront", Sender: fast},
+			)
+
+			Expect(fanOut.SendMetric("garden.memory", 0, 0, "cactus", nil)).To(Succeed())
+			Eventually(slow.SendMetricCallCount).Should(Equal(1))
+			Expect(fanOut.SendMetric("garden.memory", 1, 0, "cactus", nil)).To(Succeed())
+
+			sent = make(chan struct{})
+			go func(fanOut *metricsadapter.FanOutSender, sent chan struct{}) {
+				defer GinkgoRecover()
+				Expect(fanOut.SendMetric("garden.memory", 2, 0, "cactus", nil)).To(Succeed())
+				close(sent)
+			}(fanOut, sent)
+			Consistently(sent, "50ms").ShouldNot(BeClosed())
+		})
+
+		AfterEach(func() {
+			releaseAll()
+			fanOut.Close()
+		})
+
+		It("has sent to the sinks that do not block already", func() {
+			Eventually(func() []float64 { return sentValues(fast) }).Should(Equal([]float64{0, 1, 2}))
+		})
+
+		It("swaps the sinks without waiting for it, and gives up on the sink that is gone", func() {
+			swapped := make(chan struct{})
+			go func() {
+				fanOut.Swap(metricsadapter.FanOutSink{Name: "fast", Type: "wavefront", Sender: fast})
+				close(swapped)
+			}()
+			Eventually(swapped).Should(BeClosed())
+			Eventually(sent).Should(BeClosed())
+
+			Expect(fanOut.SendMetric("garden.memory", 3, 0, "cactus", nil)).To(Succeed())
+			Eventually(func() []float64 { return sentValues(fast) }).Should(Equal([]float64{0, 1, 2, 3}))
+		})
+
+		It("gives up on it when it is closed", func() {
+			closed := make(chan struct{})
+			go func() {
+				fanOut.Close()
+				close(closed)
+			}()
+			Eventually(sent).Should(BeClosed())
+
+			releaseAll()
+			Eventually(closed).Should(BeClosed())
+			Expect(sentValues(slow)).To(Equal([]float64{0, 1}))
+		})
+	})
+
+	It("drops what it is sent once it is closed", func() {
+		fanOut := metricsadapter.NewFanOutSender("cactus",
+			metricsadapter.FanOutSink{Name: "fast", Type: "wavefront", Sender: fast},
+		)
+		fanOut.Close()
+		fanOut.Close()
+
+		Expect(fanOut.SendMetric("garden.memory", 0, 0, "cactus", nil)).To(Succeed())
+		Expect(fanOut.Flush()).To(Succeed())
+		Expect(fast.SendMetricCallCount()).To(BeZero())
+		Expect(fast.CloseCallCount()).To(Equal(1))
+	})
+
+	It("counts the sends that succeed and fail per sink", func() {
+		fast.SendMetricReturnsOnCall(1, errors.New("connection refused"))
+		fanOut := metricsadapter.NewFanOutSender("cactus",
+			metricsadapter.FanOutSink{Name: "fast", Type: "wavefront", Sender: fast},
+		)
+
+		for i := 0; i < 3; i++ {
+			Expect(fanOut.SendMetric("garden.memory", float64(i), 0, "cactus", nil)).To(Succeed())
+		}
+		fanOut.Close()
+
+		series, err := fanOut.Collect()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(queueMetric(series, "metrics_adapter.sink.sent", "fast")).To(Equal(2.0))
+		Expect(queueMetric(series, "metrics_adapter.sink.errors", "fast")).To(Equal(1.0))
+		Expect(series.Series[0].Tags).To(Equal([]string{"sink:fast", "type:wavefront"}))
+	})
+
+	It("keeps the queues of the sinks it keeps when the sinks are swapped", func() {
+		gone := new(fakes.FakeSender)
+		fanOut := metricsadapter.NewFanOutSender("cactus",
+			metricsadapter.FanOutSink{Name: "slow", Type: "graphite", Sender: slow},
+			metricsadapter.FanOutSink{Name: "gone", Type: "wavefront", Sender: gone},
+		)
+
+		Expect(fanOut.SendMetric("garden.memory", 0, 0, "cactus", nil)).To(Succeed())
+		Expect(fanOut.SendMetric("garden.memory", 1, 0, "cactus", nil)).To(Succeed())
+		Eventually(slow.SendMetricCallCount).Should(Equal(1))
+
+		fanOut.Swap(
+			metricsadapter.FanOutSink{Name: "slow", Type: "graphite", Sender: slow},
+			metricsadapter.FanOutSink{Name: "fast", Type: "wavefront", Sender: fast},
+		)
+		Eventually(gone.CloseCallCount).Should(Equal(1))
+		Expect(sentValues(gone)).To(Equal([]float64{0, 1}))
+
+		Expect(fanOut.SendMetric("garden.memory", 2, 0, "cactus", nil)).To(Succeed())
+		series, err := fanOut.Collect()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(queueMetric(series, "metrics_adapter.sink.queued", "slow")).To(Equal(2.0))
+
+		releaseAll()
+		fanOut.Close()
+		Expect(sentValues(slow)).To(Equal([]float64{0, 1, 2}))
+		Expect(sentValues(fast)).To(Equal([]float64{2}))
+		Expect(slow.CloseCallCount()).To(Equal(1))
+	})
+})
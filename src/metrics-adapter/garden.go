@@ -0,0 +1,90 @@
+package metricsadapter
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// GardenConfig is where garden serves its debug endpoint and its API, as
+// found in the config.ini garden's job renders.
+type GardenConfig struct {
+	DebugEndpoint string
+	Network       string
+	Address       string
+}
+
+// ReadGardenConfig reads the [server] section of garden's config.ini, e.g.
+// /var/vcap/jobs/garden/config/config.ini. The API is served on bind_ip and
+// bind_port when they are set, and on bind_socket otherwise.
+func ReadGardenConfig(path string) (GardenConfig, error) {
+	server, err := readINISection(path, "server")
+	if err != nil {
+		return GardenConfig{}, err
+	}
+
+	if server["debug_bind_ip"] == "" || server["debug_bind_port"] == "" {
+		return GardenConfig{}, fmt.Errorf("%s sets no debug_bind_ip and debug_bind_port, is garden's debug server enabled?", path)
+	}
+	garden := GardenConfig{
+		DebugEndpoint: "http://" + net.JoinHostPort(server["debug_bind_ip"], server["debug_bind_port"]) + "/debug/vars",
+	}
+
+	switch {
+	case server["bind_ip"] != "" && server["bind_port"] != "":
+		garden.Network = "tcp"
+		garden.Address = net.JoinHostPort(server["bind_ip"], server["bind_port"])
+	case server["bind_socket"] != "":
+		garden.Network = "unix"
+		garden.Address = server["bind_socket"]
+	default:
+		return GardenConfig{}, fmt.Errorf("%s sets neither bind_socket nor bind_ip and bind_port", path)
+	}
+
+	return garden, nil
+}
+
+// readINISection returns the keys of a section of an ini file. Keys that are
+// repeated, as lists are in garden's config, keep their last value.
+func readINISection(path, section string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		current string
+		keys    = map[string]string{}
+	)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if !strings.EqualFold(current, section) {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		keys[strings.TrimSpace(parts[0])] = value
+	}
+
+	return keys, scanner.Err()
+}
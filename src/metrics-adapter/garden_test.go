@@ -0,0 +1,93 @@
+package metricsadapter_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ReadGardenConfig", func() {
+	var (
+		dir        string
+		configPath string
+	)
+
+	writeConfig := func(contents string) {
+		Expect(ioutil.WriteFile(configPath, []byte(contents), 0600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "garden")
+		Expect(err).NotTo(HaveOccurred())
+		configPath = filepath.Join(dir, "config.ini")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("finds the debug endpoint and the API socket in the server section", func() {
+		writeConfig(`
+; rendered by the garden job
+[server]
+  bind_socket = /var/vcap/data/garden/garden.sock
+  debug_bind_ip = 127.0.0.1
+  debug_bind_port = 17013
+  dns_server = 8.8.8.8
+  dns_server = 8.8.4.4
+
+[other]
+  bind_ip = 10.0.0.1
+`)
+
+		garden, err := metricsadapter.ReadGardenConfig(configPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(garden).To(Equal(metricsadapter.GardenConfig{
+			DebugEndpoint: "http://127.0.0.1:17013/debug/vars",
+			Network:       "unix",
+			Address:       "/var/vcap/data/garden/garden.sock",
+		}))
+	})
+
+	It("prefers the API's tcp address to its socket", func() {
+		writeConfig(`[server]
+bind_ip = "0.0.0.0"
+bind_port = 7777
+bind_socket = /var/vcap/data/garden/garden.sock
+debug_bind_ip = ::1
+debug_bind_port = 17013
+`)
+
+		garden, err := metricsadapter.ReadGardenConfig(configPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(garden).To(Equal(metricsadapter.GardenConfig{
+			DebugEndpoint: "http://[::1]:17013/debug/vars",
+			Network:       "tcp",
+			Address:       "0.0.0.0:7777",
+		}))
+	})
+
+	It("fails when garden's debug server is not enabled", func() {
+		writeConfig("[server]\nbind_socket = /var/vcap/data/garden/garden.sock\n")
+
+		_, err := metricsadapter.ReadGardenConfig(configPath)
+		Expect(err).To(MatchError(ContainSubstring("is garden's debug server enabled?")))
+	})
+
+	It("fails when garden serves no API", func() {
+		writeConfig("[server]\ndebug_bind_ip = 127.0.0.1\ndebug_bind_port = 17013\n")
+
+		_, err := metricsadapter.ReadGardenConfig(configPath)
+		Expect(err).To(MatchError(ContainSubstring("neither bind_socket nor bind_ip")))
+	})
+
+	It("fails when there is no config", func() {
+		_, err := metricsadapter.ReadGardenConfig(configPath)
+		Expect(err).To(HaveOccurred())
+	})
+})
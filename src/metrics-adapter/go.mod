@@ -3,8 +3,19 @@ module github.com/masters-of-cats/metricsadapter
 go 1.14
 
 require (
+	code.cloudfoundry.org/garden v0.0.0-20181108172608-62470dc86365
+	code.cloudfoundry.org/go-diodes v0.0.0-20190809170250-f77fb823c7ee // indirect
+	code.cloudfoundry.org/go-loggregator v7.4.0+incompatible
+	code.cloudfoundry.org/lager v2.0.0+incompatible
+	code.cloudfoundry.org/rfc5424 v0.0.0-20201103192249-000122071b78 // indirect
+	github.com/bmizerany/pat v0.0.0-20170815010413-6226ea591a40 // indirect
+	github.com/caio/go-tdigest v2.3.0+incompatible
+	github.com/hpcloud/tail v1.0.0
 	github.com/maxbrunsfeld/counterfeiter/v6 v6.2.3
 	github.com/onsi/ginkgo v1.12.0
 	github.com/onsi/gomega v1.9.0
+	github.com/tedsuo/rata v1.0.0 // indirect
 	github.com/wavefronthq/wavefront-sdk-go v0.9.5
+	google.golang.org/grpc v1.18.0
+	gopkg.in/yaml.v2 v2.2.4
 )
@@ -0,0 +1,224 @@
+package metricsadapter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	goroutinesMetric = "garden.goroutines"
+	otherGroup       = "other"
+)
+
+type goroutineGroup struct {
+	function string
+	state    string
+}
+
+// GoroutineCollector breaks garden's goroutines down by the code they are in
+// and by what they wait for, which tells apart a leak from a busy server. It
+// reads the full goroutine dump from the debug server and groups the
+// goroutines by their top frames outside of the standard library and by
+// their wait state, e.g. "chan receive", "IO wait", "select" or "semacquire".
+// Only the largest groups are reported, the others are folded into one group
+// tagged "other" to bound the number of series.
+type GoroutineCollector struct {
+	host       string
+	dumpURL    string
+	depth      int
+	top        int
+	httpClient *http.Client
+
+	responseBytes int64
+}
+
+func NewGoroutineCollector(host, debugEndpoint string, cfg GoroutinesConfig) (*GoroutineCollector, error) {
+	pprof, err := pprofURL(debugEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GoroutineCollector{
+		host:       host,
+		dumpURL:    pprof + "goroutine?debug=2",
+		depth:      cfg.Depth,
+		top:        cfg.Top,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// LastResponseBytes is the size of the last goroutine dump read, 0 when none
+// could be read.
+func (c *GoroutineCollector) LastResponseBytes() int64 {
+	return atomic.LoadInt64(&c.responseBytes)
+}
+
+func (c *GoroutineCollector) Collect() (Series, error) {
+	dump, err := c.Fetch()
+	if err != nil {
+		return Series{}, err
+	}
+	return c.Parse(dump)
+}
+
+// Fetch reads the goroutine dump from the debug server.
+func (c *GoroutineCollector) Fetch() ([]byte, error) {
+	response, err := c.httpClient.Get(c.dumpURL)
+	if err != nil {
+		atomic.StoreInt64(&c.responseBytes, 0)
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		atomic.StoreInt64(&c.responseBytes, 0)
+		return nil, fmt.Errorf("fetching goroutine dump: %s", response.Status)
+	}
+
+	dump, err := ioutil.ReadAll(response.Body)
+	atomic.StoreInt64(&c.responseBytes, int64(len(dump)))
+	return dump, err
+}
+
+// Parse groups the goroutines of a dump.
+func (c *GoroutineCollector) Parse(dump []byte) (Series, error) {
+	counts, err := groupGoroutines(bytes.NewReader(dump), c.depth)
+	if err != nil {
+		return Series{}, fmt.Errorf("parsing goroutine dump: %s", err)
+	}
+
+	groups := make([]goroutineGroup, 0, len(counts))
+	for group := range counts {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if counts[groups[i]] != counts[groups[j]] {
+			return counts[groups[i]] > counts[groups[j]]
+		}
+		return groups[i].function+groups[i].state < groups[j].function+groups[j].state
+	})
+
+	s := &sample{timestamp: time.Now().Unix(), host: c.host}
+	var other float64
+	for i, group := range groups {
+		if i >= c.top {
+			other += counts[group]
+			continue
+		}
+		s.add(goroutinesMetric, counts[group], "function:"+group.function, "state:"+group.state)
+	}
+	if other > 0 {
+		s.add(goroutinesMetric, other, "function:"+otherGroup, "state:"+otherGroup)
+	}
+
+	return Series{Series: s.metrics}, nil
+}
+
+// groupGoroutines counts the goroutines of a dump in the format of
+// /debug/pprof/goroutine?debug=2, which lists every goroutine as a header
+//
+//	goroutine 42 [chan receive, 5 minutes]:
+//
+// followed by pairs of function and file lines, innermost frame first.
+func groupGoroutines(dump io.Reader, depth int) (map[goroutineGroup]float64, error) {
+	counts := map[goroutineGroup]float64{}
+
+	var (
+		state  string
+		frames []string
+		inside bool
+	)
+	finish := func() {
+		if inside {
+			counts[goroutineGroup{function: groupFunction(frames, depth), state: state}]++
+		}
+		inside, state, frames = false, "", nil
+	}
+
+	scanner := bufio.NewScanner(dump)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		switch {
+		case len(bytes.TrimSpace(line)) == 0:
+			finish()
+		case bytes.HasPrefix(line, []byte("goroutine ")):
+			finish()
+			inside = true
+			state = goroutineState(string(line))
+		case !inside, line[0] == '\t', bytes.HasPrefix(line, []byte("created by ")), bytes.HasPrefix(line, []byte("...")):
+		default:
+			frames = append(frames, frameFunction(string(line)))
+		}
+	}
+	finish()
+
+	return counts, scanner.Err()
+}
+
+// goroutineState returns the wait state of a goroutine header without how
+// long the goroutine has been waiting, e.g. "chan receive" for
+// "goroutine 42 [chan receive, 5 minutes]:".
+func goroutineState(header string) string {
+	start := strings.Index(header, "[")
+	end := strings.LastIndex(header, "]")
+	if start < 0 || end < start {
+		return "unknown"
+	}
+
+	return strings.SplitN(header[start+1:end], ",", 2)[0]
+}
+
+// frameFunction strips the arguments from a frame such as
+// "net/http.(*conn).serve(0xc000162000, 0x1b2f0e0, 0xc0001c8000)".
+func frameFunction(frame string) string {
+	if strings.HasSuffix(frame, ")") {
+		if open := strings.LastIndex(frame, "("); open > 0 {
+			return frame[:open]
+		}
+	}
+	return frame
+}
+
+// groupFunction names a goroutine by its top depth frames outside of the
+// standard library, or by its top frame when it is entirely in the standard
+// library.
+func groupFunction(frames []string, depth int) string {
+	var user []string
+	for _, frame := range frames {
+		if len(user) == depth {
+			break
+		}
+		if !isStandardLibrary(frame) {
+			user = append(user, frame)
+		}
+	}
+
+	switch {
+	case len(user) > 0:
+		return strings.Join(user, " < ")
+	case len(frames) > 0:
+		return frames[0]
+	default:
+		return "unknown"
+	}
+}
+
+// isStandardLibrary tells whether a function is in the standard library,
+// whose import paths are the only ones without a dot in their first element.
+func isStandardLibrary(function string) bool {
+	slash := strings.Index(function, "/")
+	if slash < 0 {
+		// a package at the top of the path, e.g. runtime.gopark or main.main
+		return !strings.HasPrefix(function, "main.")
+	}
+	return !strings.Contains(function[:slash], ".")
+}
@@ -0,0 +1,106 @@
+package metricsadapter_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GoroutineCollector", func() {
+	var (
+		server     *httptest.Server
+		cfg        metricsadapter.GoroutinesConfig
+		series     metricsadapter.Series
+		collectErr error
+	)
+
+	counts := func() map[string]float64 {
+		counts := map[string]float64{}
+		for _, m := range series.Series {
+			Expect(m.Metric).To(Equal("garden.goroutines"))
+			Expect(m.Host).To(Equal("cactus"))
+			Expect(m.Tags).To(HaveLen(2))
+			counts[m.Tags[0]+" "+m.Tags[1]] = m.Points[0][1]
+		}
+		return counts
+	}
+
+	BeforeEach(func() {
+		dump, err := ioutil.ReadFile("testdata/pprof/goroutine.txt")
+		Expect(err).NotTo(HaveOccurred())
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.RequestURI() != "/debug/pprof/goroutine?debug=2" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(dump)
+		}))
+
+		cfg = metricsadapter.GoroutinesConfig{Depth: 1, Top: 10}
+	})
+
+	JustBeforeEach(func() {
+		collector, err := metricsadapter.NewGoroutineCollector("cactus", server.URL+"/debug/vars", cfg)
+		Expect(err).NotTo(HaveOccurred())
+		series, collectErr = collector.Collect()
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("groups the goroutines by top user frame and wait state", func() {
+		Expect(collectErr).NotTo(HaveOccurred())
+		Expect(counts()).To(Equal(map[string]float64{
+			"function:main.main state:chan receive":                                                  1,
+			"function:code.cloudfoundry.org/garden/server.(*GardenServer).Start.func1 state:IO wait": 1,
+			"function:code.cloudfoundry.org/guardian/gardener.(*Gardener).Create state:semacquire":   2,
+			"function:code.cloudfoundry.org/guardian/rundmc.(*Watcher).Watch state:select":           2,
+			"function:os/signal.signal_recv state:syscall":                                           1,
+		}))
+	})
+
+	Context("with a deeper grouping", func() {
+		BeforeEach(func() {
+			cfg.Depth = 2
+		})
+
+		It("tells apart the callers of the top frame", func() {
+			Expect(counts()).To(HaveKeyWithValue(
+				"function:code.cloudfoundry.org/guardian/gardener.(*Gardener).Create < code.cloudfoundry.org/garden/server.(*GardenServer).handleCreate state:semacquire", 1.0,
+			))
+			Expect(counts()).To(HaveKeyWithValue(
+				"function:code.cloudfoundry.org/guardian/gardener.(*Gardener).Create < code.cloudfoundry.org/garden/server.(*GardenServer).handleDestroy state:semacquire", 1.0,
+			))
+		})
+	})
+
+	Context("when there are more groups than reported", func() {
+		BeforeEach(func() {
+			cfg.Top = 2
+		})
+
+		It("folds the smallest groups into other", func() {
+			Expect(counts()).To(Equal(map[string]float64{
+				"function:code.cloudfoundry.org/guardian/gardener.(*Gardener).Create state:semacquire": 2,
+				"function:code.cloudfoundry.org/guardian/rundmc.(*Watcher).Watch state:select":         2,
+				"function:other state:other": 3,
+			}))
+		})
+	})
+
+	Context("when the debug server fails", func() {
+		BeforeEach(func() {
+			server.Config.Handler = http.NotFoundHandler()
+		})
+
+		It("returns an error", func() {
+			Expect(collectErr).To(MatchError(ContainSubstring("404")))
+		})
+	})
+})
@@ -0,0 +1,172 @@
+package metricsadapter
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const (
+	GraphiteTagsPath   = "path"
+	GraphiteTagsTagged = "tagged"
+
+	graphiteTimeout = 5 * time.Second
+
+	// keeps a datagram within the MTU of most networks
+	maxGraphiteDatagram = 1400
+)
+
+var graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_\-.]`)
+
+// NewGraphiteSender returns a sender for the plaintext protocol of Graphite
+// over TCP or UDP. Graphite names are dot separated paths. Metrics are named
+//
+//	[<prefix>.]<host>.<name>[.<tag key>.<tag value>...]
+//
+// with the tags sorted by key, or, with the tag style "tagged", use the tag
+// support of Graphite 1.1:
+//
+//	[<prefix>.]<name>;host=<host>[;<tag key>=<tag value>...]
+//
+// Characters Graphite does not allow in a path are replaced with underscores,
+// as are dots in the host and tag values of paths.
+func NewGraphiteSender(cfg SinkConfig) (wavefront.Sender, error) {
+	network := cfg.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("unknown network %q", network)
+	}
+
+	conn := &graphiteConn{network: network, address: cfg.Address}
+	return &lineSender{
+		format: func(name string, value float64, ts int64, source string, tags map[string]string) string {
+			return graphiteName(cfg.Prefix, cfg.TagStyle, name, source, tags) + " " +
+				strconv.FormatFloat(value, 'f', -1, 64) + " " + strconv.FormatInt(ts, 10) + "\n"
+		},
+		send:      conn.send,
+		close:     conn.close,
+		batchSize: batchSize(cfg),
+	}, nil
+}
+
+func graphiteName(prefix, style, name, source string, tags map[string]string) string {
+	path := func(s string) string {
+		return graphiteUnsafe.ReplaceAllString(s, "_")
+	}
+	component := func(s string) string {
+		return path(strings.Replace(s, ".", "_", -1))
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	if prefix != "" {
+		parts = append(parts, path(prefix))
+	}
+
+	if style == GraphiteTagsTagged {
+		// ; separates tags and ~ is reserved, values may contain anything else
+		value := strings.NewReplacer(";", "_", "~", "_", " ", "_").Replace
+
+		parts = append(parts, path(name))
+		tagged := []string{strings.Join(parts, "."), "host=" + value(source)}
+		for _, key := range keys {
+			tagged = append(tagged, path(key)+"="+value(tags[key]))
+		}
+		return strings.Join(tagged, ";")
+	}
+
+	parts = append(parts, component(source), path(name))
+	for _, key := range keys {
+		parts = append(parts, component(key), component(tags[key]))
+	}
+	return strings.Join(parts, ".")
+}
+
+// graphiteConn is a connection to Graphite that is established when lines are
+// first sent, and again after it fails.
+type graphiteConn struct {
+	network string
+	address string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (c *graphiteConn) send(lines []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		conn, err := net.DialTimeout(c.network, c.address, graphiteTimeout)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	}
+
+	var err error
+	if c.network == "udp" {
+		err = c.writeDatagrams(lines)
+	} else {
+		err = c.write(strings.Join(lines, ""))
+	}
+
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+func (c *graphiteConn) writeDatagrams(lines []string) error {
+	var datagram strings.Builder
+	for _, line := range lines {
+		if datagram.Len() > 0 && datagram.Len()+len(line) > maxGraphiteDatagram {
+			if err := c.write(datagram.String()); err != nil {
+				return err
+			}
+			datagram.Reset()
+		}
+		datagram.WriteString(line)
+	}
+	return c.write(datagram.String())
+}
+
+func (c *graphiteConn) write(data string) error {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(graphiteTimeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write([]byte(data))
+	return err
+}
+
+func (c *graphiteConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func batchSize(cfg SinkConfig) int {
+	if cfg.BatchSize > 0 {
+		return cfg.BatchSize
+	}
+	return defaultBatchSize
+}
@@ -0,0 +1,241 @@
+package metricsadapter_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+// graphiteServer receives plaintext lines over TCP like carbon does.
+type graphiteServer struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns []net.Conn
+	lines []string
+}
+
+func startGraphiteServer(address string) *graphiteServer {
+	listener, err := net.Listen("tcp", address)
+	Expect(err).NotTo(HaveOccurred())
+
+	server := &graphiteServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			server.mu.Lock()
+			server.conns = append(server.conns, conn)
+			server.mu.Unlock()
+
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					server.mu.Lock()
+					server.lines = append(server.lines, scanner.Text())
+					server.mu.Unlock()
+				}
+			}()
+		}
+	}()
+	return server
+}
+
+func (s *graphiteServer) Lines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.lines...)
+}
+
+func (s *graphiteServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *graphiteServer) Stop() {
+	s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+var _ = Describe("Graphite sink", func() {
+	var (
+		server *graphiteServer
+		cfg    metricsadapter.SinkConfig
+		sender wavefront.Sender
+	)
+
+	BeforeEach(func() {
+		server = startGraphiteServer("127.0.0.1:0")
+		cfg = metricsadapter.SinkConfig{
+			Type:      metricsadapter.SinkGraphite,
+			Network:   "tcp",
+			Address:   server.listener.Addr().String(),
+			TagStyle:  metricsadapter.GraphiteTagsPath,
+			BatchSize: 500,
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		sender, err = metricsadapter.NewSink(lagertest.NewTestLogger("test"), cfg)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		sender.Close()
+		server.Stop()
+	})
+
+	It("puts the host and the tags sorted by key into the path", func() {
+		Expect(sender.SendMetric("garden.memory", 42.5, 1589299485, "cactus.example.com", map[string]string{"state": "in use", "handle": "h.1"})).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+
+		Eventually(server.Lines).Should(ConsistOf("cactus_example_com.garden.memory.handle.h_1.state.in_use 42.5 1589299485"))
+	})
+
+	It("sends delta counters as the increment of the interval", func() {
+		Expect(sender.SendDeltaCounter("∆garden.container.oom_kills", 2, "cactus", nil)).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+
+		Eventually(server.Lines).Should(HaveLen(1))
+		Expect(server.Lines()[0]).To(HavePrefix("cactus.garden.container.oom_kills 2 "))
+	})
+
+	Context("with a prefix and tagged names", func() {
+		BeforeEach(func() {
+			cfg.Prefix = "bosh"
+			cfg.TagStyle = metricsadapter.GraphiteTagsTagged
+		})
+
+		It("uses graphite tags", func() {
+			Expect(sender.SendMetric("garden.memory", 42, 1589299485, "cactus.example.com", map[string]string{"state": "a;b"})).To(Succeed())
+			Expect(sender.Flush()).To(Succeed())
+
+			Eventually(server.Lines).Should(ConsistOf("bosh.garden.memory;host=cactus.example.com;state=a_b 42 1589299485"))
+		})
+	})
+
+	Context("when the batch is full", func() {
+		BeforeEach(func() {
+			cfg.BatchSize = 2
+		})
+
+		It("sends it without waiting for a flush", func() {
+			Expect(sender.SendMetric("a", 1, 1, "cactus", nil)).To(Succeed())
+			Consistently(server.Lines, "100ms").Should(BeEmpty())
+
+			Expect(sender.SendMetric("b", 2, 1, "cactus", nil)).To(Succeed())
+			Eventually(server.Lines).Should(ConsistOf("cactus.a 1 1", "cactus.b 2 1"))
+		})
+	})
+
+	Context("when graphite is down", func() {
+		var address string
+
+		BeforeEach(func() {
+			address = server.listener.Addr().String()
+			server.Stop()
+		})
+
+		It("keeps the lines and sends them once it is back", func() {
+			Expect(sender.SendMetric("garden.memory", 42, 1589299485, "cactus", nil)).To(Succeed())
+			Expect(sender.Flush()).NotTo(Succeed())
+			Expect(sender.GetFailureCount()).To(BeEquivalentTo(1))
+
+			server = startGraphiteServer(address)
+			Expect(sender.Flush()).To(Succeed())
+			Eventually(server.Lines).Should(ConsistOf("cactus.garden.memory 42 1589299485"))
+		})
+	})
+
+	Context("when graphite drops the connection", func() {
+		It("reconnects", func() {
+			Expect(sender.SendMetric("before", 1, 1, "cactus", nil)).To(Succeed())
+			Expect(sender.Flush()).To(Succeed())
+			Eventually(server.Lines).Should(HaveLen(1))
+
+			server.mu.Lock()
+			server.conns[0].Close()
+			server.mu.Unlock()
+
+			// the first write after the peer closed the connection may still
+			// succeed, the one after fails and reconnects
+			Eventually(func() []string {
+				sender.SendMetric("after", 2, 2, "cactus", nil)
+				sender.Flush()
+				return server.Lines()
+			}).Should(ContainElement("cactus.after 2 2"))
+			Expect(server.Connections()).To(Equal(2))
+		})
+	})
+
+	Context("over udp", func() {
+		var (
+			conn      net.PacketConn
+			datagrams chan string
+		)
+
+		BeforeEach(func() {
+			var err error
+			conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			datagrams = make(chan string, 100)
+			go func() {
+				buf := make([]byte, 64*1024)
+				for {
+					n, _, err := conn.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					datagrams <- string(buf[:n])
+				}
+			}()
+
+			cfg.Network = "udp"
+			cfg.Address = conn.LocalAddr().String()
+		})
+
+		AfterEach(func() {
+			conn.Close()
+		})
+
+		It("packs the lines into datagrams that fit the MTU", func() {
+			for i := 0; i < 100; i++ {
+				Expect(sender.SendMetric("garden.containers.memory", float64(i), 1589299485, "cactus", map[string]string{"handle": "some-container-handle"})).To(Succeed())
+			}
+			Expect(sender.Flush()).To(Succeed())
+
+			var lines []string
+			Eventually(func() int {
+				for {
+					select {
+					case datagram := <-datagrams:
+						Expect(len(datagram)).To(BeNumerically("<=", 1400))
+						Expect(datagram).To(HaveSuffix("\n"))
+						lines = append(lines, strings.Split(strings.TrimSuffix(datagram, "\n"), "\n")...)
+					default:
+						return len(lines)
+					}
+				}
+			}).Should(Equal(100))
+			Expect(lines[0]).To(Equal("cactus.garden.containers.memory.handle.some-container-handle 0 1589299485"))
+		})
+	})
+})
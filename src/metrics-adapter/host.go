@@ -0,0 +1,278 @@
+package metricsadapter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// userHZ is the kernel's USER_HZ, the unit of the cpu times in /proc/stat. It
+// is 100 on every architecture we deploy to.
+const userHZ = 100
+
+const sectorSize = 512
+
+var cpuModes = []string{"user", "nice", "system", "idle", "iowait", "irq", "softirq", "steal"}
+
+var statFields = map[string]string{
+	"ctxt":          "host.context_switches",
+	"processes":     "host.forks",
+	"procs_running": "host.procs.running",
+	"procs_blocked": "host.procs.blocked",
+}
+
+var meminfoFields = map[string]string{
+	"MemTotal":     "host.memory.total",
+	"MemFree":      "host.memory.free",
+	"MemAvailable": "host.memory.available",
+	"Buffers":      "host.memory.buffers",
+	"Cached":       "host.memory.cached",
+	"SwapTotal":    "host.swap.total",
+	"SwapFree":     "host.swap.free",
+}
+
+// netDevFields names the columns of /proc/net/dev that we report, by position.
+var netDevFields = map[int]string{
+	0: "rx_bytes", 1: "rx_packets", 2: "rx_errors", 3: "rx_dropped",
+	8: "tx_bytes", 9: "tx_packets", 10: "tx_errors", 11: "tx_dropped",
+}
+
+// HostCollector reads VM level metrics from procfs and from the filesystems
+// mounted at the configured mount points. Counters such as cpu time or bytes
+// transferred are reported as the cumulative values the kernel exposes.
+type HostCollector struct {
+	host        string
+	procRoot    string
+	mountPoints []string
+}
+
+func NewHostCollector(host string, cfg HostConfig) *HostCollector {
+	return &HostCollector{
+		host:        host,
+		procRoot:    cfg.ProcRoot,
+		mountPoints: cfg.MountPoints,
+	}
+}
+
+func (c *HostCollector) Collect() (Series, error) {
+	s := &sample{timestamp: time.Now().Unix(), host: c.host}
+
+	readers := []func(*sample) error{c.readStat, c.readMeminfo, c.readLoadavg, c.readDiskstats, c.readNetDev}
+	for _, read := range readers {
+		if err := read(s); err != nil {
+			return Series{}, err
+		}
+	}
+
+	for _, mountPoint := range c.mountPoints {
+		if err := s.readFilesystem(mountPoint); err != nil {
+			return Series{}, err
+		}
+	}
+
+	return Series{Series: s.metrics}, nil
+}
+
+func (c *HostCollector) readStat(s *sample) error {
+	cpus := 0
+	err := c.scanProcFile("stat", func(fields []string) error {
+		switch {
+		case fields[0] == "cpu":
+			for i, mode := range cpuModes {
+				if i+1 >= len(fields) {
+					break
+				}
+				if err := s.parseAndAdd("host.cpu."+mode, fields[i+1], 1.0/userHZ); err != nil {
+					return err
+				}
+			}
+		case strings.HasPrefix(fields[0], "cpu"):
+			cpus++
+		case statFields[fields[0]] != "" && len(fields) == 2:
+			return s.parseAndAdd(statFields[fields[0]], fields[1], 1)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.add("host.cpu.count", float64(cpus))
+	return nil
+}
+
+func (c *HostCollector) readMeminfo(s *sample) error {
+	values := map[string]float64{}
+	err := c.scanProcFile("meminfo", func(fields []string) error {
+		key := strings.TrimSuffix(fields[0], ":")
+		name, ok := meminfoFields[key]
+		if !ok || len(fields) < 2 {
+			return nil
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("parsing meminfo %s: %s", key, err)
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+
+		values[key] = value
+		s.add(name, value)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if total, ok := values["MemTotal"]; ok {
+		if available, ok := values["MemAvailable"]; ok {
+			s.add("host.memory.used", total-available)
+		}
+	}
+	return nil
+}
+
+func (c *HostCollector) readLoadavg(s *sample) error {
+	return c.scanProcFile("loadavg", func(fields []string) error {
+		if len(fields) < 3 {
+			return fmt.Errorf("unexpected loadavg format: %q", strings.Join(fields, " "))
+		}
+
+		for i, name := range []string{"host.load.1m", "host.load.5m", "host.load.15m"} {
+			if err := s.parseAndAdd(name, fields[i], 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *HostCollector) readDiskstats(s *sample) error {
+	return c.scanProcFile("diskstats", func(fields []string) error {
+		if len(fields) < 14 {
+			return nil
+		}
+
+		device := fields[2]
+		if strings.HasPrefix(device, "loop") || strings.HasPrefix(device, "ram") {
+			return nil
+		}
+
+		tag := "device:" + device
+		for _, stat := range []struct {
+			name   string
+			field  int
+			factor float64
+		}{
+			{"host.disk.reads", 3, 1},
+			{"host.disk.read_bytes", 5, sectorSize},
+			{"host.disk.writes", 7, 1},
+			{"host.disk.write_bytes", 9, sectorSize},
+			{"host.disk.io_in_progress", 11, 1},
+			{"host.disk.io_time", 12, 1.0 / 1000},
+		} {
+			if err := s.parseAndAdd(stat.name, fields[stat.field], stat.factor, tag); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *HostCollector) readNetDev(s *sample) error {
+	return c.scanProcFile("net/dev", func(fields []string) error {
+		colon := strings.Index(fields[0], ":")
+		if colon < 0 {
+			// header lines
+			return nil
+		}
+
+		// the interface name and the first counter are not always separated by
+		// whitespace, e.g. "eth0:1234"
+		iface := fields[0][:colon]
+		counters := fields[1:]
+		if rest := fields[0][colon+1:]; rest != "" {
+			counters = append([]string{rest}, counters...)
+		}
+
+		tag := "interface:" + iface
+		for i, counter := range counters {
+			name, ok := netDevFields[i]
+			if !ok {
+				continue
+			}
+			if err := s.parseAndAdd("host.net."+name, counter, 1, tag); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *HostCollector) scanProcFile(name string, fn func(fields []string) error) error {
+	file, err := os.Open(filepath.Join(c.procRoot, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := fn(fields); err != nil {
+			return fmt.Errorf("%s: %s", file.Name(), err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+type sample struct {
+	timestamp int64
+	host      string
+	metrics   Metrics
+}
+
+func (s *sample) add(name string, value float64, tags ...string) {
+	s.metrics = append(s.metrics, newMetric(name, s.timestamp, value, s.host, tags...))
+}
+
+func (s *sample) parseAndAdd(name, field string, factor float64, tags ...string) error {
+	value, err := strconv.ParseFloat(field, 64)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %s", name, err)
+	}
+
+	s.add(name, value*factor, tags...)
+	return nil
+}
+
+func (s *sample) readFilesystem(mountPoint string) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mountPoint, &stat); err != nil {
+		return fmt.Errorf("statfs %s: %s", mountPoint, err)
+	}
+
+	blockSize := float64(stat.Bsize)
+	total := float64(stat.Blocks) * blockSize
+	free := float64(stat.Bfree) * blockSize
+
+	tag := "mount:" + mountPoint
+	s.add("host.fs.total", total, tag)
+	s.add("host.fs.free", free, tag)
+	s.add("host.fs.available", float64(stat.Bavail)*blockSize, tag)
+	s.add("host.fs.used", total-free, tag)
+	s.add("host.fs.inodes.total", float64(stat.Files), tag)
+	s.add("host.fs.inodes.free", float64(stat.Ffree), tag)
+	return nil
+}
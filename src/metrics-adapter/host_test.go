@@ -0,0 +1,150 @@
+package metricsadapter_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HostCollector", func() {
+	var (
+		procRoot    string
+		mountPoints []string
+		series      metricsadapter.Series
+		collectErr  error
+	)
+
+	BeforeEach(func() {
+		procRoot = "testdata/proc"
+		mountPoints = []string{os.TempDir()}
+	})
+
+	JustBeforeEach(func() {
+		collector := metricsadapter.NewHostCollector("cactus", metricsadapter.HostConfig{
+			ProcRoot:    procRoot,
+			MountPoints: mountPoints,
+		})
+		series, collectErr = collector.Collect()
+	})
+
+	value := func(name string, tags ...string) float64 {
+		if tags == nil {
+			tags = []string{}
+		}
+		for _, m := range series.Series {
+			if m.Metric == name && len(m.Tags) == len(tags) && (len(tags) == 0 || m.Tags[0] == tags[0]) {
+				Expect(m.Host).To(Equal("cactus"))
+				return m.Points[0][1]
+			}
+		}
+		Fail("metric " + name + " was not collected")
+		return 0
+	}
+
+	It("does not return an error", func() {
+		Expect(collectErr).NotTo(HaveOccurred())
+	})
+
+	It("reports cpu times in seconds", func() {
+		Expect(value("host.cpu.user")).To(Equal(10.0))
+		Expect(value("host.cpu.idle")).To(Equal(400.0))
+		Expect(value("host.cpu.steal")).To(Equal(0.08))
+		Expect(value("host.cpu.count")).To(Equal(2.0))
+	})
+
+	It("reports scheduler statistics", func() {
+		Expect(value("host.context_switches")).To(Equal(987654.0))
+		Expect(value("host.forks")).To(Equal(4321.0))
+		Expect(value("host.procs.running")).To(Equal(3.0))
+		Expect(value("host.procs.blocked")).To(Equal(1.0))
+	})
+
+	It("reports memory in bytes", func() {
+		Expect(value("host.memory.total")).To(Equal(8000000.0 * 1024))
+		Expect(value("host.memory.available")).To(Equal(6000000.0 * 1024))
+		Expect(value("host.memory.used")).To(Equal(2000000.0 * 1024))
+		Expect(value("host.swap.free")).To(Equal(900000.0 * 1024))
+	})
+
+	It("reports the load average", func() {
+		Expect(value("host.load.1m")).To(Equal(0.52))
+		Expect(value("host.load.5m")).To(Equal(0.58))
+		Expect(value("host.load.15m")).To(Equal(0.59))
+	})
+
+	It("reports disk statistics per device", func() {
+		Expect(value("host.disk.reads", "device:sda")).To(Equal(1000.0))
+		Expect(value("host.disk.read_bytes", "device:sda")).To(Equal(20000.0 * 512))
+		Expect(value("host.disk.write_bytes", "device:sda1")).To(Equal(38000.0 * 512))
+		Expect(value("host.disk.io_in_progress", "device:sda")).To(Equal(2.0))
+		Expect(value("host.disk.io_time", "device:sda")).To(Equal(1.5))
+	})
+
+	It("skips loop devices", func() {
+		for _, m := range series.Series {
+			Expect(m.Tags).NotTo(ContainElement("device:loop0"))
+		}
+	})
+
+	It("reports network statistics per interface", func() {
+		Expect(value("host.net.rx_bytes", "interface:eth0")).To(Equal(98765432.0))
+		Expect(value("host.net.rx_dropped", "interface:eth0")).To(Equal(2.0))
+		Expect(value("host.net.tx_bytes", "interface:eth0")).To(Equal(12345678.0))
+		Expect(value("host.net.tx_errors", "interface:eth0")).To(Equal(3.0))
+		Expect(value("host.net.rx_packets", "interface:lo")).To(Equal(100.0))
+	})
+
+	It("reports filesystem usage per mount point", func() {
+		tag := "mount:" + os.TempDir()
+		Expect(value("host.fs.total", tag)).To(BeNumerically(">", 0))
+		Expect(value("host.fs.used", tag)).To(Equal(value("host.fs.total", tag) - value("host.fs.free", tag)))
+		Expect(value("host.fs.inodes.total", tag)).To(BeNumerically(">=", value("host.fs.inodes.free", tag)))
+	})
+
+	Context("when a proc file is missing", func() {
+		BeforeEach(func() {
+			var err error
+			procRoot, err = ioutil.TempDir("", "proc")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(procRoot)).To(Succeed())
+		})
+
+		It("returns an error", func() {
+			Expect(collectErr).To(HaveOccurred())
+		})
+	})
+
+	Context("when a proc file is malformed", func() {
+		BeforeEach(func() {
+			var err error
+			procRoot, err = ioutil.TempDir("", "proc")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(procRoot, "stat"), []byte("cpu  abc 1 2 3\n"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(procRoot)).To(Succeed())
+		})
+
+		It("returns an error naming the file", func() {
+			Expect(collectErr).To(MatchError(ContainSubstring("stat")))
+		})
+	})
+
+	Context("when a mount point does not exist", func() {
+		BeforeEach(func() {
+			mountPoints = []string{"/does/not/exist"}
+		})
+
+		It("returns an error", func() {
+			Expect(collectErr).To(MatchError(ContainSubstring("/does/not/exist")))
+		})
+	})
+})
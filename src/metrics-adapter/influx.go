@@ -0,0 +1,96 @@
+package metricsadapter
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// NewInfluxSender returns a sender for the write API of InfluxDB. Metrics are
+// written in the line protocol as
+//
+//	<name>,host=<host>[,<tag key>=<tag value>...] value=<value> <timestamp>
+//
+// with the name as the measurement, a single field named value and timestamps
+// in seconds. Commas and spaces are escaped in the measurement, and commas,
+// equal signs and spaces in tag keys and values. Tags with an empty value are
+// left out, InfluxDB does not accept them. A batch InfluxDB rejects with a
+// client error other than 429 is dropped, any other failed write is retried
+// with the next flush.
+func NewInfluxSender(cfg SinkConfig) (wavefront.Sender, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("url %q must be http or https", cfg.URL)
+	}
+
+	write := *base
+	write.Path = strings.TrimSuffix(write.Path, "/") + "/write"
+	query := write.Query()
+	query.Set("db", cfg.Database)
+	query.Set("precision", "s")
+	write.RawQuery = query.Encode()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	return &lineSender{
+		format: influxLine,
+		send: func(lines []string) error {
+			response, err := client.Post(write.String(), "text/plain; charset=utf-8", strings.NewReader(strings.Join(lines, "")))
+			if err != nil {
+				return err
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode/100 == 2 {
+				return nil
+			}
+
+			body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+			err = fmt.Errorf("writing to influxdb: %s: %s", response.Status, strings.TrimSpace(string(body)))
+			// only server errors and throttling are worth writing the batch
+			// again for, InfluxDB rejects a bad point the same every time
+			if response.StatusCode/100 == 4 && response.StatusCode != http.StatusTooManyRequests {
+				return rejectedError{err}
+			}
+			return err
+		},
+		batchSize: batchSize(cfg),
+	}, nil
+}
+
+func influxLine(name string, value float64, ts int64, source string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key, value := range tags {
+		if key != "host" && value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(name))
+	if source != "" {
+		b.WriteString(",host=" + influxTagEscaper.Replace(source))
+	}
+	for _, key := range keys {
+		b.WriteString("," + influxTagEscaper.Replace(key) + "=" + influxTagEscaper.Replace(tags[key]))
+	}
+	b.WriteString(" value=" + strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteString(" " + strconv.FormatInt(ts, 10) + "\n")
+	return b.String()
+}
@@ -0,0 +1,149 @@
+package metricsadapter_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+var _ = Describe("InfluxDB sink", func() {
+	var (
+		server *httptest.Server
+		status int
+
+		mu       sync.Mutex
+		requests []*url.URL
+		bodies   []string
+
+		cfg    metricsadapter.SinkConfig
+		sender wavefront.Sender
+	)
+
+	BeforeEach(func() {
+		status = http.StatusNoContent
+		requests, bodies = nil, nil
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+
+			mu.Lock()
+			defer mu.Unlock()
+			requests = append(requests, r.URL)
+			bodies = append(bodies, string(body))
+
+			if status != http.StatusNoContent {
+				http.Error(w, `{"error":"database not found"}`, status)
+				return
+			}
+			w.WriteHeader(status)
+		}))
+
+		cfg = metricsadapter.SinkConfig{
+			Type:      metricsadapter.SinkInfluxDB,
+			URL:       server.URL + "/influx/",
+			Database:  "garden",
+			BatchSize: 500,
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		sender, err = metricsadapter.NewSink(lagertest.NewTestLogger("test"), cfg)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		sender.Close()
+		server.Close()
+	})
+
+	It("writes to the database in the line protocol", func() {
+		Expect(sender.SendMetric("garden.memory", 42.5, 1589299485, "cactus", map[string]string{"state": "in use", "handle": "a,b=c"})).To(Succeed())
+		Expect(sender.SendMetric("garden log lines", 3, 1589299485, "cactus", map[string]string{"empty": ""})).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Path).To(Equal("/influx/write"))
+		Expect(requests[0].Query().Get("db")).To(Equal("garden"))
+		Expect(requests[0].Query().Get("precision")).To(Equal("s"))
+		Expect(strings.Split(bodies[0], "\n")).To(Equal([]string{
+			`garden.memory,host=cactus,handle=a\,b\=c,state=in\ use value=42.5 1589299485`,
+			`garden\ log\ lines,host=cactus value=3 1589299485`,
+			"",
+		}))
+	})
+
+	Context("when the batch is full", func() {
+		BeforeEach(func() {
+			cfg.BatchSize = 2
+		})
+
+		It("writes it without waiting for a flush", func() {
+			Expect(sender.SendMetric("a", 1, 1, "cactus", nil)).To(Succeed())
+			Expect(requests).To(BeEmpty())
+
+			Expect(sender.SendMetric("b", 2, 1, "cactus", nil)).To(Succeed())
+			Expect(bodies).To(ConsistOf("a,host=cactus value=1 1\nb,host=cactus value=2 1\n"))
+		})
+	})
+
+	Context("when the write fails", func() {
+		BeforeEach(func() {
+			status = http.StatusServiceUnavailable
+		})
+
+		It("keeps the lines for the next flush", func() {
+			Expect(sender.SendMetric("garden.memory", 42, 1589299485, "cactus", nil)).To(Succeed())
+			Expect(sender.Flush()).To(MatchError(ContainSubstring("503 Service Unavailable")))
+			Expect(sender.GetFailureCount()).To(BeEquivalentTo(1))
+
+			status = http.StatusNoContent
+			Expect(sender.Flush()).To(Succeed())
+			Expect(bodies).To(HaveLen(2))
+			Expect(bodies[1]).To(Equal("garden.memory,host=cactus value=42 1589299485\n"))
+		})
+	})
+
+	Context("when the write is rejected", func() {
+		BeforeEach(func() {
+			status = http.StatusBadRequest
+			cfg.BatchSize = 2
+		})
+
+		It("drops the batch, counts its lines as failures and writes the others", func() {
+			Expect(sender.SendMetric("a", 1, 1, "cactus", nil)).To(Succeed())
+			Expect(sender.SendMetric("b", 2, 1, "cactus", nil)).To(MatchError(ContainSubstring("400 Bad Request")))
+			Expect(sender.GetFailureCount()).To(BeEquivalentTo(2))
+
+			status = http.StatusNoContent
+			Expect(sender.SendMetric("c", 3, 1, "cactus", nil)).To(Succeed())
+			Expect(sender.Flush()).To(Succeed())
+			Expect(bodies).To(HaveLen(2))
+			Expect(bodies[1]).To(Equal("c,host=cactus value=3 1\n"))
+		})
+	})
+
+	Context("when the write is throttled", func() {
+		BeforeEach(func() {
+			status = http.StatusTooManyRequests
+		})
+
+		It("keeps the lines for the next flush", func() {
+			Expect(sender.SendMetric("garden.memory", 42, 1589299485, "cactus", nil)).To(Succeed())
+			Expect(sender.Flush()).To(HaveOccurred())
+
+			status = http.StatusNoContent
+			Expect(sender.Flush()).To(Succeed())
+			Expect(bodies).To(HaveLen(2))
+		})
+	})
+})
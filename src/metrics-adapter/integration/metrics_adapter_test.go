@@ -2,12 +2,20 @@ package metrics_adapter_integration_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
 )
 
@@ -63,4 +71,371 @@ var _ = Describe("MetricsAdapterIntegration", func() {
 			Expect(session.Wait()).NotTo(gexec.Exit(0))
 		})
 	})
+
+	Context("when the polling interval is negative", func() {
+		BeforeEach(func() {
+			cmd = exec.Command(metricsBinPath, "--wavefront-proxy-port", "1234", "--garden-debug-endpoint", gardenDebugServer.URL, "--host", "bar",
+				"--polling-interval", "-1s")
+		})
+
+		It("fails", func() {
+			Expect(session.Wait()).To(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("polling-interval must not be negative"))
+		})
+	})
+
+	Context("when the config file is invalid", func() {
+		var configPath string
+
+		BeforeEach(func() {
+			configFile, err := ioutil.TempFile("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = configFile.WriteString("canary: {}")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(configFile.Close()).To(Succeed())
+			configPath = configFile.Name()
+
+			cmd = exec.Command(metricsBinPath, "--wavefront-proxy-port", "1234", "--garden-debug-endpoint", gardenDebugServer.URL, "--host", "bar", "--config", configPath)
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(configPath)).To(Succeed())
+		})
+
+		It("fails", func() {
+			Expect(session.Wait()).To(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("garden_address"))
+		})
+	})
+
+	Context("when logging at debug level", func() {
+		BeforeEach(func() {
+			cmd = exec.Command(metricsBinPath, "--wavefront-proxy-port", "1234", "--garden-debug-endpoint", gardenDebugServer.URL, "--host", "bar",
+				"--polling-interval", "100ms", "--logLevel", "debug")
+		})
+
+		AfterEach(func() {
+			session.Kill().Wait()
+		})
+
+		It("logs every collect in a session of the poll, with its target", func() {
+			Eventually(session.Err).Should(gbytes.Say(`"message":"metrics-adapter.poll.collect.collected".*"target":"garden-debug"`))
+		})
+	})
+
+	Context("when garden's debug server is down", func() {
+		var configDir string
+
+		BeforeEach(func() {
+			gardenDebugServer.Close()
+
+			var err error
+			configDir, err = ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			configPath := filepath.Join(configDir, "config.yml")
+			Expect(ioutil.WriteFile(configPath, []byte("sinks: [{type: stdout}]"), 0600)).To(Succeed())
+
+			cmd = exec.Command(metricsBinPath, "--garden-debug-endpoint", gardenDebugServer.URL, "--host", "bar", "--config", configPath)
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(configDir)).To(Succeed())
+		})
+
+		It("still emits that the target is down, then fails", func() {
+			Expect(session.Wait()).To(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`"metrics_adapter.up" 0 \d+ source="bar" "target"="garden-debug"`))
+		})
+	})
+
+	Context("when series are deduplicated", func() {
+		var configDir string
+
+		BeforeEach(func() {
+			var err error
+			configDir, err = ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			configPath := filepath.Join(configDir, "config.yml")
+			Expect(ioutil.WriteFile(configPath, []byte("dedup: {metrics: [garden.], heartbeat: 1000}\nsinks: [{type: stdout}]"), 0600)).To(Succeed())
+
+			cmd = exec.Command(metricsBinPath, "--garden-debug-endpoint", gardenDebugServer.URL, "--host", "bar",
+				"--polling-interval", "50ms", "--config", configPath)
+		})
+
+		AfterEach(func() {
+			session.Kill().Wait()
+			Expect(os.RemoveAll(configDir)).To(Succeed())
+		})
+
+		It("only emits the series that do not change once", func() {
+			Eventually(session.Out).Should(gbytes.Say(`"metrics_adapter.dedup.suppressed" [1-9]`))
+			session.Kill().Wait()
+			Expect(strings.Count(string(session.Out.Contents()), `"garden.numGoroutines"`)).To(Equal(1))
+		})
+	})
+
+	Context("when the values of a tag key are limited", func() {
+		var configDir string
+
+		BeforeEach(func() {
+			var err error
+			configDir, err = ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			configPath := filepath.Join(configDir, "config.yml")
+			Expect(ioutil.WriteFile(configPath, []byte("cardinality: {max_tag_values: 1}\nsinks: [{type: stdout}]"), 0600)).To(Succeed())
+
+			cmd = exec.Command(metricsBinPath, "--garden-debug-endpoint", gardenDebugServer.URL, "--host", "bar", "--config", configPath)
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(configDir)).To(Succeed())
+		})
+
+		It("folds the values beyond the limit into other, and logs the offenders", func() {
+			Expect(session.Wait()).To(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"message":"metrics-adapter.cardinality.limits-exceeded".*"metric":"metrics_adapter.up".*"tag":"target"`))
+			Expect(session.Out).To(gbytes.Say(`"metrics_adapter.up" \d+ \d+ source="bar" "target"="other"`))
+			Expect(session.Out.Contents()).NotTo(ContainSubstring(`"log_level"`))
+		})
+	})
+
+	Context("when a recording is replayed", func() {
+		var (
+			configDir   string
+			configPath  string
+			archivePath string
+		)
+
+		BeforeEach(func() {
+			var err error
+			configDir, err = ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			configPath = filepath.Join(configDir, "config.yml")
+			Expect(ioutil.WriteFile(configPath, []byte("sinks: [{type: stdout}]"), 0600)).To(Succeed())
+			archivePath = filepath.Join(configDir, "archive.gz")
+
+			recording := gexecStart(exec.Command(metricsBinPath, "--garden-debug-endpoint", gardenDebugServer.URL, "--host", "bar",
+				"--config", configPath, "--record", archivePath))
+			Expect(recording.Wait()).To(gexec.Exit(0))
+
+			Expect(ioutil.WriteFile(configPath, []byte("cardinality: {max_tag_values: 1}\nsinks: [{type: stdout}]"), 0600)).To(Succeed())
+			cmd = exec.Command(metricsBinPath, "--host", "replayed", "--config", configPath, "--replay", archivePath, "--replay-speed", "0")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(configDir)).To(Succeed())
+		})
+
+		It("parses the recorded responses and emits them through the pipeline of the config", func() {
+			Expect(session.Wait()).To(gexec.Exit(0))
+			Expect(session.Out.Contents()).To(MatchRegexp(`"garden.numGoroutines" 19 \d+ source="replayed"`))
+			Expect(session.Out.Contents()).To(MatchRegexp(`"metrics_adapter.up" [1-9] \d+ source="replayed" "target"="other"`))
+		})
+	})
+
+	Context("when series are aggregated", func() {
+		var (
+			configDir      string
+			debugHits      int64
+			goroutinesHits int64
+		)
+
+		BeforeEach(func() {
+			gardenDebugServer.Close()
+			atomic.StoreInt64(&debugHits, 0)
+			atomic.StoreInt64(&goroutinesHits, 0)
+			gardenDebugServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, "/debug/pprof/goroutine") {
+					atomic.AddInt64(&goroutinesHits, 1)
+					return
+				}
+				atomic.AddInt64(&debugHits, 1)
+				fmt.Fprintln(w, "{\"numGoRoutines\": 19}")
+			}))
+
+			var err error
+			configDir, err = ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			configPath := filepath.Join(configDir, "config.yml")
+			Expect(ioutil.WriteFile(configPath, []byte(`aggregation: {sample_interval: 20ms, metrics: [garden.numGoroutines]}
+goroutines: {}
+sinks: [{type: stdout}]`), 0600)).To(Succeed())
+
+			cmd = exec.Command(metricsBinPath, "--garden-debug-endpoint", gardenDebugServer.URL+"/debug/vars", "--host", "bar",
+				"--polling-interval", "500ms", "--config", configPath)
+		})
+
+		AfterEach(func() {
+			session.Kill().Wait()
+			Expect(os.RemoveAll(configDir)).To(Succeed())
+		})
+
+		It("only samples the collectors of the metrics that are rolled up, and emits whether targets are up as it is", func() {
+			Eventually(session.Out).Should(gbytes.Say(`"garden.numGoroutines.max" 19`))
+			Eventually(session.Out).Should(gbytes.Say(`"metrics_adapter.up" 1 \d+ source="bar" "target"="garden-debug"`))
+			Expect(session.Out.Contents()).NotTo(ContainSubstring(`"metrics_adapter.up.`))
+
+			// the first rollup may come after a single sample
+			Eventually(func() int64 {
+				return atomic.LoadInt64(&debugHits)
+			}).Should(BeNumerically(">", 5))
+			Expect(atomic.LoadInt64(&goroutinesHits)).To(BeNumerically("~", 2, 1))
+		})
+	})
+
+	Context("when the log level is unknown", func() {
+		BeforeEach(func() {
+			cmd = exec.Command(metricsBinPath, "--wavefront-proxy-port", "1234", "--garden-debug-endpoint", gardenDebugServer.URL, "--host", "bar",
+				"--logLevel", "chatty")
+		})
+
+		It("fails", func() {
+			Expect(session.Wait()).To(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("invalid log level: chatty"))
+		})
+	})
+
+	Context("when the host is discovered from BOSH", func() {
+		var root string
+
+		BeforeEach(func() {
+			var err error
+			root, err = ioutil.TempDir("", "vcap")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.MkdirAll(filepath.Join(root, "bosh"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(root, "bosh", "spec.json"), []byte(`{"deployment": "cf", "name": "diego-cell", "index": 3, "az": "z2"}`), 0600)).To(Succeed())
+
+			configPath := filepath.Join(root, "config.yml")
+			Expect(ioutil.WriteFile(configPath, []byte(fmt.Sprintf("bosh: {root: %s}\ntags: {az: z9}\nsinks: [{type: stdout, format: ndjson}]", root)), 0600)).To(Succeed())
+
+			cmd = exec.Command(metricsBinPath, "--garden-debug-endpoint", gardenDebugServer.URL, "--config", configPath)
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(root)).To(Succeed())
+		})
+
+		It("names the host after the instance and tags the series with it, under the tags of the config", func() {
+			Expect(session.Wait()).To(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say(`"garden.numGoroutines","source":"cf.diego-cell.3","tags":{"az":"z9","deployment":"cf","index":"3","instance_group":"diego-cell"}`))
+		})
+	})
+
+	Context("when garden's debug endpoint is discovered from garden's config", func() {
+		var (
+			dir              string
+			gardenConfigPath string
+		)
+
+		writeGardenConfig := func(debugURL string) {
+			u, err := url.Parse(debugURL)
+			Expect(err).NotTo(HaveOccurred())
+			contents := fmt.Sprintf("[server]\n  bind_socket = /tmp/garden.sock\n  debug_bind_ip = %s\n  debug_bind_port = %s\n", u.Hostname(), u.Port())
+			Expect(ioutil.WriteFile(gardenConfigPath, []byte(contents), 0600)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "garden")
+			Expect(err).NotTo(HaveOccurred())
+			gardenConfigPath = filepath.Join(dir, "config.ini")
+			writeGardenConfig(gardenDebugServer.URL)
+
+			configPath := filepath.Join(dir, "config.yml")
+			Expect(ioutil.WriteFile(configPath, []byte(fmt.Sprintf("garden_discovery: {config_path: %s, interval: 50ms}\nsinks: [{type: stdout}]", gardenConfigPath)), 0600)).To(Succeed())
+
+			cmd = exec.Command(metricsBinPath, "--host", "bar", "--polling-interval", "100ms", "--config", configPath)
+		})
+
+		AfterEach(func() {
+			session.Kill().Wait()
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("polls the endpoint it finds, and follows it when garden's config changes", func() {
+			Eventually(session.Out).Should(gbytes.Say(`"garden.numGoroutines" 19`))
+
+			movedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintln(w, "{\"numGoRoutines\": 42}")
+			}))
+			defer movedServer.Close()
+			writeGardenConfig(movedServer.URL)
+
+			Eventually(session.Err).Should(gbytes.Say(`"message":"metrics-adapter.reload.finished".*"reason":"garden-config-changed"`))
+			Eventually(session.Out).Should(gbytes.Say(`"garden.numGoroutines" 42`))
+		})
+	})
+
+	Context("when the config is reloaded", func() {
+		var (
+			configDir  string
+			configPath string
+		)
+
+		writeConfig := func(contents string) {
+			Expect(ioutil.WriteFile(configPath, []byte(contents), 0600)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			var err error
+			configDir, err = ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			configPath = filepath.Join(configDir, "config.yml")
+			writeConfig("sinks: [{type: stdout}]")
+
+			cmd = exec.Command(metricsBinPath, "--garden-debug-endpoint", gardenDebugServer.URL, "--host", "bar",
+				"--polling-interval", "100ms", "--config", configPath, "--config-check-interval", "0")
+		})
+
+		AfterEach(func() {
+			session.Kill().Wait()
+			Expect(os.RemoveAll(configDir)).To(Succeed())
+		})
+
+		It("swaps the sinks on SIGHUP, and keeps the previous config when the new one is invalid", func() {
+			Eventually(session.Out).Should(gbytes.Say(`garden`))
+
+			writeConfig("canary: {}")
+			session.Signal(syscall.SIGHUP)
+			Eventually(session.Err).Should(gbytes.Say(`"message":"metrics-adapter.reload.failed-keeping-previous-config".*"error":"canary: garden_address`))
+			Eventually(session.Out).Should(gbytes.Say(`garden`))
+
+			metricsPath := filepath.Join(configDir, "metrics.log")
+			writeConfig(fmt.Sprintf("sinks: [{type: file, path: %s}]", metricsPath))
+			session.Signal(syscall.SIGHUP)
+			Eventually(session.Err).Should(gbytes.Say(`"message":"metrics-adapter.reload.finished".*"reason":"sighup"`))
+			Eventually(func() (string, error) {
+				contents, err := ioutil.ReadFile(metricsPath)
+				return string(contents), err
+			}).Should(ContainSubstring("metrics_adapter.config.reloads"))
+		})
+
+		It("keeps the previous config when a unit of the new one fails to start", func() {
+			Eventually(session.Out).Should(gbytes.Say(`garden`))
+
+			metricsPath := filepath.Join(configDir, "metrics.log")
+			writeConfig(fmt.Sprintf("sinks: [{type: file, path: %s}]\ntags: {team: garden}\noom: {kmsg_path: %s}", metricsPath, filepath.Join(configDir, "kmsg")))
+			session.Signal(syscall.SIGHUP)
+			Eventually(session.Err).Should(gbytes.Say(`"message":"metrics-adapter.reload.failed-keeping-previous-config".*"error":"oom: open`))
+
+			Eventually(session.Out).Should(gbytes.Say(`"garden.numGoroutines" \S+ \d+ source="bar"\n`))
+			Consistently(func() (string, error) {
+				contents, err := ioutil.ReadFile(metricsPath)
+				return string(contents), err
+			}, "300ms").Should(BeEmpty())
+		})
+
+		Context("when the config file changes", func() {
+			BeforeEach(func() {
+				cmd.Args[len(cmd.Args)-1] = "50ms"
+			})
+
+			It("reloads it", func() {
+				Eventually(session.Out).Should(gbytes.Say(`garden`))
+
+				writeConfig("sinks: [{type: stdout, format: ndjson}]")
+				Eventually(session.Err).Should(gbytes.Say(`"message":"metrics-adapter.reload.finished".*"reason":"config-file-changed"`))
+			})
+		})
+	})
 })
@@ -0,0 +1,187 @@
+package metricsadapter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hpcloud/tail"
+)
+
+// lagerLevels maps the numeric log_level of lager's original JSON format to
+// the level names used by its RFC 3339 format.
+var lagerLevels = map[int]string{0: "debug", 1: "info", 2: "error", 3: "fatal"}
+
+// LogEntry is a line of a lager JSON log.
+type LogEntry struct {
+	Timestamp time.Time
+	Source    string
+	Message   string
+	Level     string
+	Session   string
+	Data      map[string]interface{}
+}
+
+// ParseLogEntry parses a line written by lager in either its original format,
+// with unix timestamps and numeric log levels, or its RFC 3339 format.
+func ParseLogEntry(line string) (LogEntry, error) {
+	var raw struct {
+		Timestamp string                 `json:"timestamp"`
+		Source    string                 `json:"source"`
+		Message   string                 `json:"message"`
+		LogLevel  *int                   `json:"log_level"`
+		Level     string                 `json:"level"`
+		Data      map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(line), &raw); err != nil {
+		return LogEntry{}, err
+	}
+	if raw.Message == "" {
+		return LogEntry{}, errors.New("not a lager log line")
+	}
+
+	timestamp, err := parseLagerTimestamp(raw.Timestamp)
+	if err != nil {
+		return LogEntry{}, err
+	}
+
+	level := raw.Level
+	if raw.LogLevel != nil {
+		level = lagerLevels[*raw.LogLevel]
+	}
+
+	entry := LogEntry{
+		Timestamp: timestamp,
+		Source:    raw.Source,
+		Message:   raw.Message,
+		Level:     level,
+		Data:      raw.Data,
+	}
+	if session, ok := raw.Data["session"].(string); ok {
+		entry.Session = session
+	}
+
+	return entry, nil
+}
+
+func parseLagerTimestamp(timestamp string) (time.Time, error) {
+	// a float64 cannot hold the nanoseconds since the epoch exactly, so the
+	// seconds and their fraction are parsed separately
+	if seconds, fraction, err := parseUnixTimestamp(timestamp); err == nil {
+		return time.Unix(seconds, fraction), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	return t, nil
+}
+
+func parseUnixTimestamp(timestamp string) (int64, int64, error) {
+	parts := strings.SplitN(timestamp, ".", 2)
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) == 1 {
+		return seconds, 0, err
+	}
+
+	digits := parts[1]
+	if len(digits) > 9 {
+		digits = digits[:9]
+	}
+	nanos, err := strconv.ParseInt(digits+strings.Repeat("0", 9-len(digits)), 10, 64)
+	return seconds, nanos, err
+}
+
+// Operation returns the message without the source prefix and the final
+// action, e.g. "garden-server.create" for "guardian.garden-server.create.starting".
+func (e LogEntry) Operation() string {
+	operation := strings.TrimPrefix(e.Message, e.Source+".")
+	if dot := strings.LastIndex(operation, "."); dot >= 0 {
+		return operation[:dot]
+	}
+	return operation
+}
+
+// Action returns the last component of the message, e.g. "starting".
+func (e LogEntry) Action() string {
+	return e.Message[strings.LastIndex(e.Message, ".")+1:]
+}
+
+type LogHandler interface {
+	HandleLogEntry(LogEntry)
+}
+
+// LogTailer follows a lager log file the way tail -F does, reopening it when
+// it is rotated and reading it from the start when it is truncated, and hands
+// every parsed line to its handlers. Lines that are not lager JSON, such as
+// panics written to the same file, are skipped.
+type LogTailer struct {
+	path     string
+	poll     bool
+	handlers []LogHandler
+	tail     *tail.Tail
+}
+
+func NewLogTailer(cfg LogConfig, handlers ...LogHandler) *LogTailer {
+	return &LogTailer{
+		path:     cfg.Path,
+		poll:     cfg.Poll,
+		handlers: handlers,
+	}
+}
+
+// Start begins tailing at the current end of the file, or at the start of the
+// file once it is created if it does not exist yet. Lines are handled in the
+// background until Stop is called.
+func (t *LogTailer) Start() error {
+	var location *tail.SeekInfo
+	info, err := os.Stat(t.path)
+	switch {
+	case err == nil:
+		location = &tail.SeekInfo{Offset: info.Size(), Whence: io.SeekStart}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	t.tail, err = tail.TailFile(t.path, tail.Config{
+		Location: location,
+		ReOpen:   true,
+		Follow:   true,
+		Poll:     t.poll,
+		Logger:   tail.DiscardingLogger,
+	})
+	if err != nil {
+		return err
+	}
+
+	go t.handleLines()
+	return nil
+}
+
+func (t *LogTailer) handleLines() {
+	for line := range t.tail.Lines {
+		if line.Err != nil {
+			continue
+		}
+
+		entry, err := ParseLogEntry(line.Text)
+		if err != nil {
+			continue
+		}
+
+		for _, handler := range t.handlers {
+			handler.HandleLogEntry(entry)
+		}
+	}
+}
+
+// Stop stops tailing and returns the error that ended tailing early, if any.
+func (t *LogTailer) Stop() error {
+	return t.tail.Stop()
+}
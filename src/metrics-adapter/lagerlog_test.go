@@ -0,0 +1,147 @@
+package metricsadapter_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type recordingHandler struct {
+	mu      sync.Mutex
+	entries []metricsadapter.LogEntry
+}
+
+func (h *recordingHandler) HandleLogEntry(entry metricsadapter.LogEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, entry)
+}
+
+func (h *recordingHandler) messages() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var messages []string
+	for _, entry := range h.entries {
+		messages = append(messages, entry.Message)
+	}
+	return messages
+}
+
+var _ = Describe("ParseLogEntry", func() {
+	It("parses lager's original format", func() {
+		entry, err := metricsadapter.ParseLogEntry(`{"timestamp":"1589299485.250000000","source":"guardian","message":"guardian.create.starting","log_level":1,"data":{"handle":"h","session":"12.3"}}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Timestamp.UnixNano()).To(Equal(int64(1589299485250000000)))
+		Expect(entry.Source).To(Equal("guardian"))
+		Expect(entry.Message).To(Equal("guardian.create.starting"))
+		Expect(entry.Level).To(Equal("info"))
+		Expect(entry.Session).To(Equal("12.3"))
+		Expect(entry.Data).To(HaveKeyWithValue("handle", "h"))
+		Expect(entry.Operation()).To(Equal("create"))
+		Expect(entry.Action()).To(Equal("starting"))
+	})
+
+	It("keeps the nanoseconds of unix timestamps, which a float64 cannot hold", func() {
+		entry, err := metricsadapter.ParseLogEntry(`{"timestamp":"1589299485.123456789","source":"guardian","message":"guardian.create.starting","log_level":1,"data":{}}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Timestamp.UnixNano()).To(Equal(int64(1589299485123456789)))
+	})
+
+	It("parses lager's RFC 3339 format", func() {
+		entry, err := metricsadapter.ParseLogEntry(`{"timestamp":"2020-05-12T16:04:45.25Z","level":"error","source":"guardian","message":"guardian.garden-server.create.failed","data":{"error":"boom"}}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Timestamp).To(BeTemporally("==", time.Date(2020, 5, 12, 16, 4, 45, 250000000, time.UTC)))
+		Expect(entry.Level).To(Equal("error"))
+		Expect(entry.Session).To(BeEmpty())
+		Expect(entry.Operation()).To(Equal("garden-server.create"))
+	})
+
+	It("rejects lines that are not lager JSON", func() {
+		_, err := metricsadapter.ParseLogEntry("panic: runtime error")
+		Expect(err).To(HaveOccurred())
+		_, err = metricsadapter.ParseLogEntry(`{"foo":"bar"}`)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("LogTailer", func() {
+	var (
+		dir     string
+		path    string
+		handler *recordingHandler
+		tailer  *metricsadapter.LogTailer
+	)
+
+	line := func(message string) string {
+		return `{"timestamp":"1589299485.0","source":"guardian","message":"` + message + `","log_level":1,"data":{}}` + "\n"
+	}
+
+	appendLines := func(lines ...string) {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+		for _, l := range lines {
+			_, err := file.WriteString(l)
+			Expect(err).NotTo(HaveOccurred())
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "lagerlog")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "garden.stdout.log")
+		handler = &recordingHandler{}
+		appendLines(line("guardian.old"))
+	})
+
+	JustBeforeEach(func() {
+		tailer = metricsadapter.NewLogTailer(metricsadapter.LogConfig{Path: path, Poll: true}, handler)
+		Expect(tailer.Start()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(tailer.Stop()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("handles the lines written after it started", func() {
+		appendLines(line("guardian.first"), "not json\n", line("guardian.second"))
+		Eventually(handler.messages).Should(Equal([]string{"guardian.first", "guardian.second"}))
+	})
+
+	It("follows the log across rotations", func() {
+		appendLines(line("guardian.first"))
+		Eventually(handler.messages).Should(HaveLen(1))
+
+		Expect(os.Rename(path, path+".1")).To(Succeed())
+		appendLines(line("guardian.rotated"))
+		Eventually(handler.messages, 5*time.Second).Should(Equal([]string{"guardian.first", "guardian.rotated"}))
+	})
+
+	It("follows the log when it is truncated", func() {
+		appendLines(line("guardian.first"))
+		Eventually(handler.messages).Should(HaveLen(1))
+
+		Expect(os.Truncate(path, 0)).To(Succeed())
+		appendLines(line("guardian.truncated"))
+		Eventually(handler.messages, 5*time.Second).Should(Equal([]string{"guardian.first", "guardian.truncated"}))
+	})
+
+	Context("when the log does not exist yet", func() {
+		BeforeEach(func() {
+			Expect(os.Remove(path)).To(Succeed())
+		})
+
+		It("reads it from the start once it is created", func() {
+			appendLines(line("guardian.first"))
+			Eventually(handler.messages, 5*time.Second).Should(Equal([]string{"guardian.first"}))
+		})
+	})
+})
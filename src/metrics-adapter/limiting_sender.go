@@ -0,0 +1,123 @@
+package metricsadapter
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+// LimitingSender keeps what is sent to it directly, rather than in the series
+// of a poll, within the limits of a CardinalityLimiter: the delta counters
+// and distributions of the log and OOM collectors, events and spans. Tag
+// values beyond the limits are folded into "other", or what is sent is
+// dropped. Sends folded together are not added up, Wavefront adds up delta
+// counters and distributions on its own.
+type LimitingSender struct {
+	wavefront.Sender
+
+	mu      sync.RWMutex
+	limiter *CardinalityLimiter
+}
+
+func NewLimitingSender(sender wavefront.Sender, limiter *CardinalityLimiter) *LimitingSender {
+	return &LimitingSender{Sender: sender, limiter: limiter}
+}
+
+// SetLimiter replaces the limiter used from now on, nil to send everything.
+func (s *LimitingSender) SetLimiter(limiter *CardinalityLimiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limiter = limiter
+}
+
+func (s *LimitingSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	tags, ok := s.limited(name, source, tags)
+	if !ok {
+		return nil
+	}
+	return s.Sender.SendMetric(name, value, ts, source, tags)
+}
+
+func (s *LimitingSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	tags, ok := s.limited(name, source, tags)
+	if !ok {
+		return nil
+	}
+	return s.Sender.SendDeltaCounter(name, value, source, tags)
+}
+
+func (s *LimitingSender) SendDistribution(name string, centroids []histogram.Centroid, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string) error {
+	tags, ok := s.limited(name, source, tags)
+	if !ok {
+		return nil
+	}
+	return s.Sender.SendDistribution(name, centroids, hgs, ts, source, tags)
+}
+
+func (s *LimitingSender) SendSpan(name string, startMillis, durationMillis int64, source, traceID, spanID string, parents, followsFrom []string, tags []wavefront.SpanTag, spanLogs []wavefront.SpanLog) error {
+	limiter := s.currentLimiter()
+	if limiter == nil {
+		return s.Sender.SendSpan(name, startMillis, durationMillis, source, traceID, spanID, parents, followsFrom, tags, spanLogs)
+	}
+
+	tagList := make([]string, len(tags))
+	for i, tag := range tags {
+		tagList[i] = tag.Key + ":" + tag.Value
+	}
+	tagList, ok := limiter.LimitTags(name, source, tagList)
+	if !ok {
+		return nil
+	}
+
+	spanTags := make([]wavefront.SpanTag, len(tagList))
+	for i, tag := range tagList {
+		key, value, _ := splitTag(tag)
+		spanTags[i] = wavefront.SpanTag{Key: key, Value: value}
+	}
+	return s.Sender.SendSpan(name, startMillis, durationMillis, source, traceID, spanID, parents, followsFrom, spanTags, spanLogs)
+}
+
+func (s *LimitingSender) SendEvent(name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) error {
+	tags, ok := s.limited(name, source, tags)
+	if !ok {
+		return nil
+	}
+	return s.Sender.SendEvent(name, startMillis, endMillis, source, tags, setters...)
+}
+
+func (s *LimitingSender) currentLimiter() *CardinalityLimiter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.limiter
+}
+
+// limited returns the tags within the limits, or false when what they are
+// the tags of is dropped.
+func (s *LimitingSender) limited(name, source string, tags map[string]string) (map[string]string, bool) {
+	limiter := s.currentLimiter()
+	if limiter == nil {
+		return tags, true
+	}
+
+	tagList := make([]string, 0, len(tags))
+	for key, value := range tags {
+		tagList = append(tagList, key+":"+value)
+	}
+	// in the same order every time, not the random one of the map
+	sort.Strings(tagList)
+
+	tagList, ok := limiter.LimitTags(name, source, tagList)
+	if !ok {
+		return nil, false
+	}
+
+	limited := make(map[string]string, len(tagList))
+	for _, tag := range tagList {
+		key, value, _ := splitTag(tag)
+		limited[key] = value
+	}
+	return limited, true
+}
@@ -0,0 +1,77 @@
+package metricsadapter_test
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/masters-of-cats/metricsadapter"
+	fakes "github.com/masters-of-cats/metricsadapter/metrics-adapterfakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+var _ = Describe("LimitingSender", func() {
+	var (
+		cfg        metricsadapter.CardinalityConfig
+		fakeSender *fakes.FakeSender
+		sender     *metricsadapter.LimitingSender
+	)
+
+	BeforeEach(func() {
+		cfg = metricsadapter.CardinalityConfig{
+			CardinalityLimits: metricsadapter.CardinalityLimits{MaxTagValues: 1},
+			Overflow:          metricsadapter.CardinalityFold,
+			Expiry:            time.Hour,
+			ReportInterval:    time.Hour,
+			Top:               10,
+		}
+		fakeSender = new(fakes.FakeSender)
+	})
+
+	JustBeforeEach(func() {
+		limiter := metricsadapter.NewCardinalityLimiter(lagertest.NewTestLogger("test"), "cactus", cfg)
+		sender = metricsadapter.NewLimitingSender(fakeSender, limiter)
+	})
+
+	It("folds the tag values of delta counters beyond the limits", func() {
+		Expect(sender.SendDeltaCounter("garden.container.oom_kills", 1, "cactus", map[string]string{"handle": "a"})).To(Succeed())
+		Expect(sender.SendDeltaCounter("garden.container.oom_kills", 1, "cactus", map[string]string{"handle": "b"})).To(Succeed())
+
+		Expect(fakeSender.SendDeltaCounterCallCount()).To(Equal(2))
+		_, _, _, tags := fakeSender.SendDeltaCounterArgsForCall(0)
+		Expect(tags).To(Equal(map[string]string{"handle": "a"}))
+		_, _, _, tags = fakeSender.SendDeltaCounterArgsForCall(1)
+		Expect(tags).To(Equal(map[string]string{"handle": "other"}))
+	})
+
+	It("folds the tag values of spans beyond the limits", func() {
+		Expect(sender.SendSpan("create", 0, 1, "cactus", "t", "s1", nil, nil, []wavefront.SpanTag{{Key: "session", Value: "1"}}, nil)).To(Succeed())
+		Expect(sender.SendSpan("create", 0, 1, "cactus", "t", "s2", nil, nil, []wavefront.SpanTag{{Key: "session", Value: "2"}}, nil)).To(Succeed())
+
+		_, _, _, _, _, _, _, _, tags, _ := fakeSender.SendSpanArgsForCall(1)
+		Expect(tags).To(Equal([]wavefront.SpanTag{{Key: "session", Value: "other"}}))
+	})
+
+	Context("when the overflow is dropped", func() {
+		BeforeEach(func() {
+			cfg.Overflow = metricsadapter.CardinalityDrop
+		})
+
+		It("drops the events beyond the limits", func() {
+			Expect(sender.SendEvent("container OOM killed", 0, 0, "cactus", map[string]string{"handle": "a"})).To(Succeed())
+			Expect(sender.SendEvent("container OOM killed", 0, 0, "cactus", map[string]string{"handle": "b"})).To(Succeed())
+
+			Expect(fakeSender.SendEventCallCount()).To(Equal(1))
+		})
+	})
+
+	It("sends everything when it is not given a limiter", func() {
+		sender.SetLimiter(nil)
+		Expect(sender.SendDistribution("garden.log.duration", nil, nil, 0, "cactus", map[string]string{"operation": "a"})).To(Succeed())
+		Expect(sender.SendDistribution("garden.log.duration", nil, nil, 0, "cactus", map[string]string{"operation": "b"})).To(Succeed())
+
+		_, _, _, _, _, tags := fakeSender.SendDistributionArgsForCall(1)
+		Expect(tags).To(Equal(map[string]string{"operation": "b"}))
+	})
+})
@@ -0,0 +1,124 @@
+package metricsadapter
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const (
+	defaultBatchSize = 500
+
+	// lines kept for a backend that is down, beyond which the oldest lines are
+	// dropped
+	maxBufferedLines = 10000
+)
+
+// rejectedError is the error of a batch that the backend rejected, which
+// sending it again would not change.
+type rejectedError struct {
+	error
+}
+
+// lineSender is the part of a wavefront.Sender that is the same for every
+// backend taking one line per point: it formats metrics and delta counters as
+// lines, buffers them, and sends them in batches when a batch is full or on
+// Flush. Lines that could not be sent are kept and sent with the next batch,
+// unless the backend rejected them, in which case they are dropped and
+// counted as failures. Distributions, spans and events have no equivalent in
+// these backends and are dropped.
+type lineSender struct {
+	format    func(name string, value float64, ts int64, source string, tags map[string]string) string
+	send      func(lines []string) error
+	close     func()
+	batchSize int
+
+	mu       sync.Mutex
+	lines    []string
+	failures int64
+}
+
+func (s *lineSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	if ts == 0 {
+		ts = time.Now().Unix()
+	}
+
+	s.mu.Lock()
+	s.lines = append(s.lines, s.format(name, value, ts, source, tags))
+	if overflow := len(s.lines) - maxBufferedLines; overflow > 0 {
+		s.lines = s.lines[overflow:]
+		s.failures += int64(overflow)
+	}
+	full := len(s.lines) >= s.batchSize
+	s.mu.Unlock()
+
+	if full {
+		return s.Flush()
+	}
+	return nil
+}
+
+// SendDeltaCounter sends the increment as the value of the interval, these
+// backends have no delta counters.
+func (s *lineSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	if value <= 0 {
+		return nil
+	}
+	return s.SendMetric(strings.TrimPrefix(name, deltaPrefix), value, 0, source, tags)
+}
+
+func (s *lineSender) SendDistribution(string, []histogram.Centroid, map[histogram.Granularity]bool, int64, string, map[string]string) error {
+	return nil
+}
+
+func (s *lineSender) SendSpan(string, int64, int64, string, string, string, []string, []string, []wavefront.SpanTag, []wavefront.SpanLog) error {
+	return nil
+}
+
+func (s *lineSender) SendEvent(string, int64, int64, string, map[string]string, ...event.Option) error {
+	return nil
+}
+
+func (s *lineSender) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rejected error
+	for len(s.lines) > 0 {
+		n := s.batchSize
+		if n > len(s.lines) {
+			n = len(s.lines)
+		}
+
+		err := s.send(s.lines[:n])
+		if _, ok := err.(rejectedError); ok {
+			s.failures += int64(n)
+			rejected = err
+		} else if err != nil {
+			s.failures++
+			return err
+		}
+		s.lines = s.lines[n:]
+	}
+
+	return rejected
+}
+
+func (s *lineSender) GetFailureCount() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures
+}
+
+func (s *lineSender) Start() {}
+
+func (s *lineSender) Close() {
+	s.Flush()
+	if s.close != nil {
+		s.close()
+	}
+}
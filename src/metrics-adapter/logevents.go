@@ -0,0 +1,174 @@
+package metricsadapter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const (
+	logEventsSuppressedMetric = "garden.log.events_suppressed"
+
+	// the most events kept between two emits, whatever their message
+	maxPendingLogEvents = 100
+)
+
+type logEvent struct {
+	entry LogEntry
+	err   string
+}
+
+type logErrorKey struct {
+	message string
+	err     string
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// LogEventForwarder turns garden's error and fatal log lines into Wavefront
+// events. An error that repeats the message and error text of one forwarded
+// within the dedup window is dropped, and at most rate_limit events are
+// forwarded per message and rate interval, so that an error storm does not
+// flood the event stream. Dropped errors are counted by message. Windows are
+// measured with the timestamps of the log lines.
+type LogEventForwarder struct {
+	host         string
+	dedupWindow  time.Duration
+	rateLimit    int
+	rateInterval time.Duration
+
+	mu         sync.Mutex
+	pending    []logEvent
+	suppressed map[string]float64
+	lastSeen   map[logErrorKey]time.Time
+	windows    map[string]*rateWindow
+}
+
+func NewLogEventForwarder(host string, cfg LogEventsConfig) *LogEventForwarder {
+	return &LogEventForwarder{
+		host:         host,
+		dedupWindow:  cfg.DedupWindow,
+		rateLimit:    cfg.RateLimit,
+		rateInterval: cfg.RateInterval,
+		suppressed:   map[string]float64{},
+		lastSeen:     map[logErrorKey]time.Time{},
+		windows:      map[string]*rateWindow{},
+	}
+}
+
+func (f *LogEventForwarder) HandleLogEntry(entry LogEntry) {
+	if entry.Level != "error" && entry.Level != "fatal" {
+		return
+	}
+
+	key := logErrorKey{message: entry.Message}
+	if err, ok := entry.Data["error"]; ok {
+		key.err = fmt.Sprint(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if last, ok := f.lastSeen[key]; ok && entry.Timestamp.Sub(last) < f.dedupWindow {
+		f.suppressed[entry.Message]++
+		return
+	}
+
+	window, ok := f.windows[entry.Message]
+	if !ok || entry.Timestamp.Sub(window.start) >= f.rateInterval {
+		window = &rateWindow{start: entry.Timestamp}
+		f.windows[entry.Message] = window
+	}
+	if window.count >= f.rateLimit || len(f.pending) >= maxPendingLogEvents {
+		f.suppressed[entry.Message]++
+		return
+	}
+	window.count++
+
+	f.lastSeen[key] = entry.Timestamp
+	f.pending = append(f.pending, logEvent{entry: entry, err: key.err})
+}
+
+// EmitEvents sends the events for the errors logged since the last call and
+// the number of errors that were suppressed.
+func (f *LogEventForwarder) EmitEvents(wfSender wavefront.Sender) error {
+	f.mu.Lock()
+	pending := f.pending
+	suppressed := f.suppressed
+	f.pending = nil
+	f.suppressed = map[string]float64{}
+	f.expire()
+	f.mu.Unlock()
+
+	for _, e := range pending {
+		if err := f.send(e, wfSender); err != nil {
+			return err
+		}
+	}
+
+	for message, count := range suppressed {
+		if err := wfSender.SendDeltaCounter(logEventsSuppressedMetric, count, f.host, map[string]string{"message": message}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *LogEventForwarder) send(e logEvent, wfSender wavefront.Sender) error {
+	tags := map[string]string{"component": e.entry.Source, "level": e.entry.Level}
+	if e.entry.Session != "" {
+		tags["session"] = e.entry.Session
+	}
+
+	details := e.entry.Message
+	if e.entry.Session != "" {
+		details += " in session " + e.entry.Session
+	}
+	if e.err != "" {
+		details += ": " + e.err
+	}
+
+	severity := "warn"
+	if e.entry.Level == "fatal" {
+		severity = "severe"
+	}
+
+	return wfSender.SendEvent(
+		e.entry.Message,
+		millis(e.entry.Timestamp), 0,
+		f.host,
+		tags,
+		event.Severity(severity),
+		event.Type("garden-error"),
+		event.Details(details),
+	)
+}
+
+// expire forgets the errors and rate windows that are too old to suppress
+// anything, so that unique error texts do not accumulate forever.
+func (f *LogEventForwarder) expire() {
+	var newest time.Time
+	for _, last := range f.lastSeen {
+		if last.After(newest) {
+			newest = last
+		}
+	}
+
+	for key, last := range f.lastSeen {
+		if newest.Sub(last) >= f.dedupWindow {
+			delete(f.lastSeen, key)
+		}
+	}
+	for message, window := range f.windows {
+		if newest.Sub(window.start) >= f.rateInterval {
+			delete(f.windows, message)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package metricsadapter_test
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/masters-of-cats/metricsadapter"
+	fakes "github.com/masters-of-cats/metricsadapter/metrics-adapterfakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LogEventForwarder", func() {
+	var (
+		forwarder *metricsadapter.LogEventForwarder
+		wfSender  *fakes.FakeSender
+		emitErr   error
+	)
+
+	logError := func(seconds int, message, session, errorText string) {
+		entry, err := metricsadapter.ParseLogEntry(fmt.Sprintf(
+			`{"timestamp":"%d.0","source":"guardian","message":"%s","log_level":2,"data":{"session":"%s","error":"%s"}}`,
+			seconds, message, session, errorText,
+		))
+		Expect(err).NotTo(HaveOccurred())
+		forwarder.HandleLogEntry(entry)
+	}
+
+	eventNames := func() []string {
+		var names []string
+		for i := 0; i < wfSender.SendEventCallCount(); i++ {
+			name, _, _, _, _, _ := wfSender.SendEventArgsForCall(i)
+			names = append(names, name)
+		}
+		return names
+	}
+
+	suppressed := func() map[string]float64 {
+		counts := map[string]float64{}
+		for i := 0; i < wfSender.SendDeltaCounterCallCount(); i++ {
+			name, value, _, tags := wfSender.SendDeltaCounterArgsForCall(i)
+			Expect(name).To(Equal("garden.log.events_suppressed"))
+			counts[tags["message"]] = value
+		}
+		return counts
+	}
+
+	BeforeEach(func() {
+		wfSender = new(fakes.FakeSender)
+		forwarder = metricsadapter.NewLogEventForwarder("cactus", metricsadapter.LogEventsConfig{
+			DedupWindow:  time.Minute,
+			RateLimit:    2,
+			RateInterval: time.Minute,
+		})
+	})
+
+	JustBeforeEach(func() {
+		emitErr = forwarder.EmitEvents(wfSender)
+	})
+
+	Context("when an error is logged", func() {
+		BeforeEach(func() {
+			logError(100, "guardian.create.failed", "12.3", "no space left on device")
+			forwarder.HandleLogEntry(metricsadapter.LogEntry{Message: "guardian.create.starting", Level: "info"})
+		})
+
+		It("sends an event with the message, session and error", func() {
+			Expect(emitErr).NotTo(HaveOccurred())
+			Expect(wfSender.SendEventCallCount()).To(Equal(1))
+
+			name, start, _, source, tags, setters := wfSender.SendEventArgsForCall(0)
+			Expect(name).To(Equal("guardian.create.failed"))
+			Expect(start).To(Equal(int64(100000)))
+			Expect(source).To(Equal("cactus"))
+			Expect(tags).To(Equal(map[string]string{"component": "guardian", "level": "error", "session": "12.3"}))
+
+			annotations := map[string]interface{}{"annotations": map[string]string{}}
+			for _, setter := range setters {
+				setter(annotations)
+			}
+			Expect(annotations["annotations"]).To(HaveKeyWithValue("details", "guardian.create.failed in session 12.3: no space left on device"))
+		})
+
+		It("sends every event only once", func() {
+			Expect(forwarder.EmitEvents(wfSender)).To(Succeed())
+			Expect(wfSender.SendEventCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("when the same error repeats", func() {
+		BeforeEach(func() {
+			logError(100, "guardian.create.failed", "1", "boom")
+			logError(110, "guardian.create.failed", "2", "boom")
+			logError(200, "guardian.create.failed", "3", "boom")
+		})
+
+		It("drops the repetitions within the dedup window and counts them", func() {
+			Expect(eventNames()).To(HaveLen(2))
+			Expect(suppressed()).To(Equal(map[string]float64{"guardian.create.failed": 1}))
+		})
+	})
+
+	Context("when a message is logged with different errors", func() {
+		BeforeEach(func() {
+			for i := 0; i < 4; i++ {
+				logError(100+i, "guardian.create.failed", "1", fmt.Sprintf("error %d", i))
+			}
+			logError(104, "guardian.destroy.failed", "1", "boom")
+			logError(170, "guardian.create.failed", "1", "error 5")
+		})
+
+		It("limits the events per message and interval", func() {
+			Expect(eventNames()).To(Equal([]string{
+				"guardian.create.failed",
+				"guardian.create.failed",
+				"guardian.destroy.failed",
+				"guardian.create.failed",
+			}))
+			Expect(suppressed()).To(Equal(map[string]float64{"guardian.create.failed": 2}))
+		})
+	})
+
+	Context("when sending fails", func() {
+		BeforeEach(func() {
+			logError(100, "guardian.create.failed", "1", "boom")
+			wfSender.SendEventReturns(errors.New("wf-error"))
+		})
+
+		It("returns the error", func() {
+			Expect(emitErr).To(MatchError("wf-error"))
+		})
+	})
+})
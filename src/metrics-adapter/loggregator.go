@@ -0,0 +1,186 @@
+package metricsadapter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	loggregator "code.cloudfoundry.org/go-loggregator"
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	defaultLoggregatorAddress = "localhost:3458"
+	defaultLoggregatorSource  = "garden"
+
+	loggregatorTimeout = 10 * time.Second
+)
+
+// LoggregatorSender is a wavefront.Sender that sends metrics as Loggregator
+// v2 envelopes to the forwarder agent on this VM over gRPC with mutual TLS,
+// from where they reach the firehose. Metrics become gauge envelopes and
+// delta counters counter envelopes, with the configured source and instance
+// ids, the tags as envelope tags and the source of the metric as the host
+// tag. Distributions, spans and events are dropped.
+//
+// Envelopes are buffered and sent in batches on Flush; batches that could not
+// be sent are kept for the next one.
+type LoggregatorSender struct {
+	sourceID   string
+	instanceID string
+	batchSize  int
+
+	conn   *grpc.ClientConn
+	client loggregator_v2.IngressClient
+
+	mu        sync.Mutex
+	envelopes []*loggregator_v2.Envelope
+	failures  int64
+}
+
+func NewLoggregatorSender(cfg SinkConfig) (*LoggregatorSender, error) {
+	tlsConfig, err := loggregator.NewIngressTLSConfig(cfg.CACert, cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	address := cfg.Address
+	if address == "" {
+		address = defaultLoggregatorAddress
+	}
+
+	// the connection is established in the background and again after it
+	// fails
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		return nil, err
+	}
+
+	sourceID := cfg.SourceID
+	if sourceID == "" {
+		sourceID = defaultLoggregatorSource
+	}
+
+	return &LoggregatorSender{
+		sourceID:   sourceID,
+		instanceID: cfg.InstanceID,
+		batchSize:  batchSize(cfg),
+		conn:       conn,
+		client:     loggregator_v2.NewIngressClient(conn),
+	}, nil
+}
+
+func (s *LoggregatorSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	t := time.Now()
+	if ts != 0 {
+		t = time.Unix(ts, 0)
+	}
+
+	envelope := s.envelope(t, source, tags)
+	envelope.Message = &loggregator_v2.Envelope_Gauge{Gauge: &loggregator_v2.Gauge{
+		Metrics: map[string]*loggregator_v2.GaugeValue{name: {Value: value}},
+	}}
+	s.add(envelope)
+	return nil
+}
+
+// SendDeltaCounter sends the increment rounded to a whole number, the only
+// kind of delta Loggregator counters have.
+func (s *LoggregatorSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	delta := math.Round(value)
+	if delta <= 0 {
+		return nil
+	}
+
+	envelope := s.envelope(time.Now(), source, tags)
+	envelope.Message = &loggregator_v2.Envelope_Counter{Counter: &loggregator_v2.Counter{
+		Name:  strings.TrimPrefix(name, deltaPrefix),
+		Delta: uint64(delta),
+	}}
+	s.add(envelope)
+	return nil
+}
+
+func (s *LoggregatorSender) SendDistribution(string, []histogram.Centroid, map[histogram.Granularity]bool, int64, string, map[string]string) error {
+	return nil
+}
+
+func (s *LoggregatorSender) SendSpan(string, int64, int64, string, string, string, []string, []string, []wavefront.SpanTag, []wavefront.SpanLog) error {
+	return nil
+}
+
+func (s *LoggregatorSender) SendEvent(string, int64, int64, string, map[string]string, ...event.Option) error {
+	return nil
+}
+
+func (s *LoggregatorSender) envelope(t time.Time, source string, tags map[string]string) *loggregator_v2.Envelope {
+	envelopeTags := make(map[string]string, len(tags)+1)
+	for key, value := range tags {
+		envelopeTags[key] = value
+	}
+	if source != "" {
+		envelopeTags["host"] = source
+	}
+
+	return &loggregator_v2.Envelope{
+		Timestamp:  t.UnixNano(),
+		SourceId:   s.sourceID,
+		InstanceId: s.instanceID,
+		Tags:       envelopeTags,
+	}
+}
+
+func (s *LoggregatorSender) add(envelope *loggregator_v2.Envelope) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.envelopes = append(s.envelopes, envelope)
+	if overflow := len(s.envelopes) - maxBufferedLines; overflow > 0 {
+		s.envelopes = s.envelopes[overflow:]
+		s.failures += int64(overflow)
+	}
+}
+
+func (s *LoggregatorSender) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.envelopes) > 0 {
+		n := s.batchSize
+		if n > len(s.envelopes) {
+			n = len(s.envelopes)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), loggregatorTimeout)
+		_, err := s.client.Send(ctx, &loggregator_v2.EnvelopeBatch{Batch: s.envelopes[:n]})
+		cancel()
+		if err != nil {
+			s.failures++
+			return errors.New("sending to loggregator: " + err.Error())
+		}
+		s.envelopes = s.envelopes[n:]
+	}
+
+	return nil
+}
+
+func (s *LoggregatorSender) GetFailureCount() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures
+}
+
+func (s *LoggregatorSender) Start() {}
+
+func (s *LoggregatorSender) Close() {
+	s.Flush()
+	s.conn.Close()
+}
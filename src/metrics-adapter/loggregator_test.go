@@ -0,0 +1,222 @@
+package metricsadapter_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+type certAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCertAuthority() certAuthority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return certAuthority{cert: cert, key: key}
+}
+
+// issue writes a certificate for name signed by the CA and its key to dir
+// and returns their paths.
+func (ca certAuthority) issue(dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).NotTo(HaveOccurred())
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	Expect(ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)).To(Succeed())
+	return certPath, keyPath
+}
+
+func (ca certAuthority) write(dir string) string {
+	path := filepath.Join(dir, "ca.crt")
+	Expect(ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600)).To(Succeed())
+	return path
+}
+
+// fakeAgent is a stand-in for the forwarder agent that records the envelopes
+// it receives.
+type fakeAgent struct {
+	mu        sync.Mutex
+	envelopes []*loggregator_v2.Envelope
+}
+
+func (a *fakeAgent) Sender(loggregator_v2.Ingress_SenderServer) error { return nil }
+
+func (a *fakeAgent) BatchSender(loggregator_v2.Ingress_BatchSenderServer) error { return nil }
+
+func (a *fakeAgent) Send(_ context.Context, batch *loggregator_v2.EnvelopeBatch) (*loggregator_v2.SendResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.envelopes = append(a.envelopes, batch.Batch...)
+	return &loggregator_v2.SendResponse{}, nil
+}
+
+func (a *fakeAgent) Envelopes() []*loggregator_v2.Envelope {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*loggregator_v2.Envelope{}, a.envelopes...)
+}
+
+var _ = Describe("LoggregatorSender", func() {
+	var (
+		dir    string
+		agent  *fakeAgent
+		server *grpc.Server
+		cfg    metricsadapter.SinkConfig
+		sender *metricsadapter.LoggregatorSender
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "loggregator")
+		Expect(err).NotTo(HaveOccurred())
+
+		ca := newCertAuthority()
+		caPath := ca.write(dir)
+		serverCert, serverKey := ca.issue(dir, "metron")
+		clientCert, clientKey := ca.issue(dir, "metrics-adapter")
+
+		keyPair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+		Expect(err).NotTo(HaveOccurred())
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(ca.cert)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		agent = &fakeAgent{}
+		server = grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{keyPair},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+		})))
+		loggregator_v2.RegisterIngressServer(server, agent)
+		go server.Serve(listener)
+
+		cfg = metricsadapter.SinkConfig{
+			Type:       metricsadapter.SinkLoggregator,
+			Address:    listener.Addr().String(),
+			SourceID:   "garden",
+			InstanceID: "cell-guid",
+			CACert:     caPath,
+			Cert:       clientCert,
+			Key:        clientKey,
+			BatchSize:  500,
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		sender, err = metricsadapter.NewLoggregatorSender(cfg)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		sender.Close()
+		server.Stop()
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("sends metrics as gauge envelopes", func() {
+		Expect(sender.SendMetric("garden.memory", 42.5, 1589299485, "cactus", map[string]string{"handle": "h"})).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+
+		envelopes := agent.Envelopes()
+		Expect(envelopes).To(HaveLen(1))
+		Expect(envelopes[0].Timestamp).To(Equal(int64(1589299485 * time.Second)))
+		Expect(envelopes[0].SourceId).To(Equal("garden"))
+		Expect(envelopes[0].InstanceId).To(Equal("cell-guid"))
+		Expect(envelopes[0].Tags).To(Equal(map[string]string{"handle": "h", "host": "cactus"}))
+		Expect(envelopes[0].GetGauge().Metrics).To(HaveKey("garden.memory"))
+		Expect(envelopes[0].GetGauge().Metrics["garden.memory"].Value).To(Equal(42.5))
+	})
+
+	It("sends delta counters as counter envelopes", func() {
+		Expect(sender.SendDeltaCounter("∆garden.container.oom_kills", 2, "cactus", nil)).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+
+		envelopes := agent.Envelopes()
+		Expect(envelopes).To(HaveLen(1))
+		Expect(envelopes[0].GetCounter().Name).To(Equal("garden.container.oom_kills"))
+		Expect(envelopes[0].GetCounter().Delta).To(BeEquivalentTo(2))
+	})
+
+	Context("when the batch size is smaller than what was sent", func() {
+		BeforeEach(func() {
+			cfg.BatchSize = 2
+		})
+
+		It("sends several batches", func() {
+			for i := 0; i < 5; i++ {
+				Expect(sender.SendMetric("garden.memory", float64(i), 0, "cactus", nil)).To(Succeed())
+			}
+			Expect(sender.Flush()).To(Succeed())
+			Expect(agent.Envelopes()).To(HaveLen(5))
+		})
+	})
+
+	Context("when the agent does not trust the client certificate", func() {
+		BeforeEach(func() {
+			cfg.Cert, cfg.Key = newCertAuthority().issue(dir, "impostor")
+		})
+
+		It("fails and keeps the envelopes", func() {
+			Expect(sender.SendMetric("garden.memory", 42, 0, "cactus", nil)).To(Succeed())
+			Expect(sender.Flush()).To(MatchError(ContainSubstring("sending to loggregator")))
+			Expect(sender.GetFailureCount()).To(BeEquivalentTo(1))
+			Expect(agent.Envelopes()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,132 @@
+package metricsadapter
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const (
+	logLinesMetric    = "garden.log.lines"
+	logDurationMetric = "garden.log.duration"
+
+	// a .starting line without a matching .finished line after this long
+	// belongs to a request that failed or that garden will never finish
+	maxOperationAge = time.Hour
+)
+
+type logLineKey struct {
+	source  string
+	message string
+	level   string
+}
+
+type operationKey struct {
+	session   string
+	operation string
+}
+
+// LogCollector derives metrics from garden's lager log. It counts lines by
+// source, message and level, and measures the duration of every operation
+// logged as a pair of .starting and .finished lines in the same session, e.g.
+// garden-server.create. Line counts are cumulative; durations are reported as
+// distributions of the operations finished since the last emit.
+type LogCollector struct {
+	host string
+
+	mu        sync.Mutex
+	lines     map[logLineKey]float64
+	started   map[operationKey]time.Time
+	durations map[string][]float64
+}
+
+func NewLogCollector(host string) *LogCollector {
+	return &LogCollector{
+		host:      host,
+		lines:     map[logLineKey]float64{},
+		started:   map[operationKey]time.Time{},
+		durations: map[string][]float64{},
+	}
+}
+
+func (c *LogCollector) HandleLogEntry(entry LogEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lines[logLineKey{source: entry.Source, message: entry.Message, level: entry.Level}]++
+
+	key := operationKey{session: entry.Session, operation: entry.Operation()}
+	switch entry.Action() {
+	case "starting":
+		c.started[key] = entry.Timestamp
+	case "finished":
+		start, ok := c.started[key]
+		if !ok {
+			return
+		}
+		delete(c.started, key)
+		c.durations[key.operation] = append(c.durations[key.operation], entry.Timestamp.Sub(start).Seconds())
+	case "failed":
+		delete(c.started, key)
+	}
+}
+
+func (c *LogCollector) Collect() (Series, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for key, start := range c.started {
+		if now.Sub(start) > maxOperationAge {
+			delete(c.started, key)
+		}
+	}
+
+	s := &sample{timestamp: now.Unix(), host: c.host}
+	for key, count := range c.lines {
+		s.add(logLinesMetric, count, "source:"+key.source, "message:"+key.message, "level:"+key.level)
+	}
+
+	return Series{Series: s.metrics}, nil
+}
+
+// EmitDistributions sends the durations of the operations that finished since
+// the last call as one distribution per operation.
+func (c *LogCollector) EmitDistributions(wfSender wavefront.Sender) error {
+	c.mu.Lock()
+	durations := c.durations
+	c.durations = map[string][]float64{}
+	c.mu.Unlock()
+
+	timestamp := time.Now().Unix()
+	granularity := map[histogram.Granularity]bool{histogram.MINUTE: true}
+	for operation, values := range durations {
+		tags := map[string]string{"operation": operation}
+		if err := wfSender.SendDistribution(logDurationMetric, centroids(values), granularity, timestamp, c.host, tags); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// centroids groups values by the millisecond, which bounds the size of a
+// distribution without losing precision that matters for request latencies.
+func centroids(values []float64) []histogram.Centroid {
+	counts := map[float64]int{}
+	for _, value := range values {
+		counts[math.Round(value*1000)/1000]++
+	}
+
+	result := make([]histogram.Centroid, 0, len(counts))
+	for value, count := range counts {
+		result = append(result, histogram.Centroid{Value: value, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Value < result[j].Value })
+
+	return result
+}
@@ -0,0 +1,105 @@
+package metricsadapter_test
+
+import (
+	"errors"
+
+	"github.com/masters-of-cats/metricsadapter"
+	fakes "github.com/masters-of-cats/metricsadapter/metrics-adapterfakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+)
+
+var _ = Describe("LogCollector", func() {
+	var (
+		collector *metricsadapter.LogCollector
+		wfSender  *fakes.FakeSender
+	)
+
+	handle := func(lines ...string) {
+		for _, line := range lines {
+			entry, err := metricsadapter.ParseLogEntry(line)
+			Expect(err).NotTo(HaveOccurred())
+			collector.HandleLogEntry(entry)
+		}
+	}
+
+	BeforeEach(func() {
+		collector = metricsadapter.NewLogCollector("cactus")
+		wfSender = new(fakes.FakeSender)
+	})
+
+	Describe("Collect", func() {
+		BeforeEach(func() {
+			handle(
+				`{"timestamp":"1.0","source":"guardian","message":"guardian.create.starting","log_level":1,"data":{}}`,
+				`{"timestamp":"2.0","source":"guardian","message":"guardian.create.starting","log_level":1,"data":{}}`,
+				`{"timestamp":"3.0","source":"guardian","message":"guardian.create.failed","log_level":2,"data":{}}`,
+			)
+		})
+
+		It("counts lines by source, message and level", func() {
+			series, err := collector.Collect()
+			Expect(err).NotTo(HaveOccurred())
+
+			counts := map[string]float64{}
+			for _, m := range series.Series {
+				Expect(m.Metric).To(Equal("garden.log.lines"))
+				Expect(m.Host).To(Equal("cactus"))
+				Expect(m.Tags[0]).To(Equal("source:guardian"))
+				counts[m.Tags[1]+" "+m.Tags[2]] = m.Points[0][1]
+			}
+			Expect(counts).To(Equal(map[string]float64{
+				"message:guardian.create.starting level:info": 2,
+				"message:guardian.create.failed level:error":  1,
+			}))
+		})
+	})
+
+	Describe("EmitDistributions", func() {
+		var emitErr error
+
+		BeforeEach(func() {
+			handle(
+				`{"timestamp":"10.0","source":"garden","message":"garden.garden-server.create.starting","log_level":1,"data":{"session":"1"}}`,
+				`{"timestamp":"10.5","source":"garden","message":"garden.garden-server.create.starting","log_level":1,"data":{"session":"2"}}`,
+				`{"timestamp":"11.0","source":"garden","message":"garden.garden-server.create.finished","log_level":1,"data":{"session":"2"}}`,
+				`{"timestamp":"12.0","source":"garden","message":"garden.garden-server.create.finished","log_level":1,"data":{"session":"1"}}`,
+				`{"timestamp":"12.0","source":"garden","message":"garden.garden-server.destroy.starting","log_level":1,"data":{"session":"3"}}`,
+				`{"timestamp":"13.0","source":"garden","message":"garden.garden-server.destroy.failed","log_level":2,"data":{"session":"3"}}`,
+				`{"timestamp":"14.0","source":"garden","message":"garden.garden-server.destroy.finished","log_level":1,"data":{"session":"3"}}`,
+			)
+		})
+
+		JustBeforeEach(func() {
+			emitErr = collector.EmitDistributions(wfSender)
+		})
+
+		It("sends the durations of the finished operations", func() {
+			Expect(emitErr).NotTo(HaveOccurred())
+			Expect(wfSender.SendDistributionCallCount()).To(Equal(1))
+
+			name, centroids, granularity, _, source, tags := wfSender.SendDistributionArgsForCall(0)
+			Expect(name).To(Equal("garden.log.duration"))
+			Expect(centroids).To(Equal([]histogram.Centroid{{Value: 0.5, Count: 1}, {Value: 2, Count: 1}}))
+			Expect(granularity).To(Equal(map[histogram.Granularity]bool{histogram.MINUTE: true}))
+			Expect(source).To(Equal("cactus"))
+			Expect(tags).To(Equal(map[string]string{"operation": "garden-server.create"}))
+		})
+
+		It("sends every duration only once", func() {
+			Expect(collector.EmitDistributions(wfSender)).To(Succeed())
+			Expect(wfSender.SendDistributionCallCount()).To(Equal(1))
+		})
+
+		Context("when sending fails", func() {
+			BeforeEach(func() {
+				wfSender.SendDistributionReturns(errors.New("wf-error"))
+			})
+
+			It("returns the error", func() {
+				Expect(emitErr).To(MatchError("wf-error"))
+			})
+		})
+	})
+})
@@ -0,0 +1,220 @@
+package metricsadapter
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const (
+	logSpansDroppedMetric = "garden.log.spans_dropped"
+
+	// the most finished spans kept between two emits, and the most span logs
+	// kept per span
+	maxPendingSpans = 1000
+	maxSpanLogs     = 100
+)
+
+type logSpan struct {
+	session   string
+	operation string
+	source    string
+	traceID   string
+	spanID    string
+	parentID  string
+	start     time.Time
+	duration  time.Duration
+	failed    bool
+	logs      []wavefront.SpanLog
+}
+
+// LogTracer reconstructs garden's requests from the sessions of its lager log
+// and reports them as Wavefront spans. Every session that logs a .starting and
+// a .finished or .failed line becomes a span. Lager nests sessions by
+// appending to the id of the parent, so the span of session 12.3.4 is a child
+// of the span of 12.3, or of 12, whichever is the closest that is in
+// progress. The other lines of a session become logs of its span, or of the
+// closest span in progress above it.
+type LogTracer struct {
+	host string
+
+	mu      sync.Mutex
+	open    map[string]*logSpan
+	pending []*logSpan
+	dropped float64
+}
+
+func NewLogTracer(host string) *LogTracer {
+	return &LogTracer{
+		host: host,
+		open: map[string]*logSpan{},
+	}
+}
+
+func (t *LogTracer) HandleLogEntry(entry LogEntry) {
+	if entry.Session == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch entry.Action() {
+	case "starting":
+		t.start(entry)
+		return
+	case "finished", "failed":
+		if span, ok := t.open[entry.Session]; ok && span.operation == entry.Operation() {
+			span.failed = entry.Action() == "failed"
+			if span.failed {
+				span.addLog(entry)
+			}
+			t.finish(span, entry.Timestamp)
+			return
+		}
+	}
+
+	if span := t.closestOpenSpan(entry.Session); span != nil {
+		span.addLog(entry)
+	}
+}
+
+func (t *LogTracer) start(entry LogEntry) {
+	span := &logSpan{
+		session:   entry.Session,
+		operation: entry.Operation(),
+		source:    entry.Source,
+		spanID:    spanUUID(entry.Session, entry.Timestamp),
+		start:     entry.Timestamp,
+	}
+
+	span.traceID = span.spanID
+	if parent := t.closestOpenSpan(parentSession(entry.Session)); parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	}
+
+	t.open[entry.Session] = span
+}
+
+func (t *LogTracer) finish(span *logSpan, end time.Time) {
+	delete(t.open, span.session)
+	span.duration = end.Sub(span.start)
+
+	if len(t.pending) >= maxPendingSpans {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, span)
+}
+
+// closestOpenSpan returns the span in progress for the session or for the
+// closest of its ancestors.
+func (t *LogTracer) closestOpenSpan(session string) *logSpan {
+	for ; session != ""; session = parentSession(session) {
+		if span, ok := t.open[session]; ok {
+			return span
+		}
+	}
+	return nil
+}
+
+// EmitSpans sends the spans that finished since the last call.
+func (t *LogTracer) EmitSpans(wfSender wavefront.Sender) error {
+	t.mu.Lock()
+	pending := t.pending
+	dropped := t.dropped
+	t.pending = nil
+	t.dropped = 0
+
+	now := time.Now()
+	for session, span := range t.open {
+		if now.Sub(span.start) > maxOperationAge {
+			delete(t.open, session)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, span := range pending {
+		if err := t.send(span, wfSender); err != nil {
+			return err
+		}
+	}
+
+	if dropped > 0 {
+		return wfSender.SendDeltaCounter(logSpansDroppedMetric, dropped, t.host, map[string]string{})
+	}
+
+	return nil
+}
+
+func (t *LogTracer) send(span *logSpan, wfSender wavefront.Sender) error {
+	tags := []wavefront.SpanTag{
+		{Key: "application", Value: "garden"},
+		{Key: "service", Value: span.source},
+		{Key: "session", Value: span.session},
+	}
+	if span.failed {
+		tags = append(tags, wavefront.SpanTag{Key: "error", Value: "true"})
+	}
+
+	var parents []string
+	if span.parentID != "" {
+		parents = []string{span.parentID}
+	}
+
+	return wfSender.SendSpan(
+		span.operation,
+		millis(span.start), span.duration.Nanoseconds()/int64(time.Millisecond),
+		t.host,
+		span.traceID, span.spanID,
+		parents, nil,
+		tags,
+		span.logs,
+	)
+}
+
+func (s *logSpan) addLog(entry LogEntry) {
+	if len(s.logs) >= maxSpanLogs {
+		return
+	}
+
+	fields := map[string]string{"message": entry.Message, "level": entry.Level}
+	for key, value := range entry.Data {
+		if key != "session" {
+			fields[key] = fmt.Sprint(value)
+		}
+	}
+
+	s.logs = append(s.logs, wavefront.SpanLog{
+		Timestamp: entry.Timestamp.UnixNano() / int64(time.Microsecond),
+		Fields:    fields,
+	})
+}
+
+// parentSession returns the id of the session a lager session was created
+// from, e.g. "12.3" for "12.3.4", or an empty string for a root session.
+func parentSession(session string) string {
+	dot := strings.LastIndex(session, ".")
+	if dot < 0 {
+		return ""
+	}
+	return session[:dot]
+}
+
+// spanUUID derives a span id from the session and its start. Session ids are
+// reused when garden restarts, the start time tells the sessions apart.
+func spanUUID(session string, start time.Time) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s/%d", session, start.UnixNano())))
+	sum[6] = sum[6]&0x0f | 0x50 // version 5
+	sum[8] = sum[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
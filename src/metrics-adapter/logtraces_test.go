@@ -0,0 +1,148 @@
+package metricsadapter_test
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/masters-of-cats/metricsadapter"
+	fakes "github.com/masters-of-cats/metricsadapter/metrics-adapterfakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+type sentSpan struct {
+	name           string
+	startMillis    int64
+	durationMillis int64
+	traceID        string
+	spanID         string
+	parents        []string
+	tags           []wavefront.SpanTag
+	logs           []wavefront.SpanLog
+}
+
+var _ = Describe("LogTracer", func() {
+	var (
+		tracer   *metricsadapter.LogTracer
+		wfSender *fakes.FakeSender
+		emitErr  error
+	)
+
+	logLine := func(millis int, message, session string, level int, data string) {
+		if data != "" {
+			data = "," + data
+		}
+		entry, err := metricsadapter.ParseLogEntry(fmt.Sprintf(
+			`{"timestamp":"%d.%03d","source":"guardian","message":"guardian.%s","log_level":%d,"data":{"session":"%s"%s}}`,
+			millis/1000, millis%1000, message, level, session, data,
+		))
+		Expect(err).NotTo(HaveOccurred())
+		tracer.HandleLogEntry(entry)
+	}
+
+	spans := func() map[string]sentSpan {
+		sent := map[string]sentSpan{}
+		for i := 0; i < wfSender.SendSpanCallCount(); i++ {
+			name, start, duration, source, traceID, spanID, parents, _, tags, logs := wfSender.SendSpanArgsForCall(i)
+			Expect(source).To(Equal("cactus"))
+			sent[name] = sentSpan{name, start, duration, traceID, spanID, parents, tags, logs}
+		}
+		return sent
+	}
+
+	BeforeEach(func() {
+		wfSender = new(fakes.FakeSender)
+		tracer = metricsadapter.NewLogTracer("cactus")
+	})
+
+	JustBeforeEach(func() {
+		emitErr = tracer.EmitSpans(wfSender)
+	})
+
+	Context("when a request logs nested sessions", func() {
+		BeforeEach(func() {
+			logLine(1000, "create.starting", "12.3", 1, `"handle":"h"`)
+			logLine(1100, "create.volume-creator.starting", "12.3.1", 1, "")
+			logLine(1200, "create.volume-creator.image-pulled", "12.3.1", 1, `"layers":3`)
+			logLine(1500, "create.volume-creator.finished", "12.3.1", 1, "")
+			logLine(1600, "create.net-setup", "12.3.2", 1, "")
+			logLine(2500, "create.finished", "12.3", 1, "")
+		})
+
+		It("sends a span per session", func() {
+			Expect(emitErr).NotTo(HaveOccurred())
+			Expect(spans()).To(HaveLen(2))
+
+			create := spans()["create"]
+			Expect(create.startMillis).To(Equal(int64(1000)))
+			Expect(create.durationMillis).To(Equal(int64(1500)))
+			Expect(create.parents).To(BeEmpty())
+			Expect(create.traceID).To(Equal(create.spanID))
+			Expect(create.tags).To(ConsistOf(
+				wavefront.SpanTag{Key: "application", Value: "garden"},
+				wavefront.SpanTag{Key: "service", Value: "guardian"},
+				wavefront.SpanTag{Key: "session", Value: "12.3"},
+			))
+
+			volume := spans()["create.volume-creator"]
+			Expect(volume.startMillis).To(Equal(int64(1100)))
+			Expect(volume.durationMillis).To(Equal(int64(400)))
+			Expect(volume.traceID).To(Equal(create.traceID))
+			Expect(volume.parents).To(Equal([]string{create.spanID}))
+			Expect(volume.spanID).To(MatchRegexp(`^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+		})
+
+		It("attaches the intermediate messages as span logs", func() {
+			Expect(spans()["create.volume-creator"].logs).To(Equal([]wavefront.SpanLog{{
+				Timestamp: 1200000,
+				Fields:    map[string]string{"message": "guardian.create.volume-creator.image-pulled", "level": "info", "layers": "3"},
+			}}))
+			Expect(spans()["create"].logs).To(Equal([]wavefront.SpanLog{{
+				Timestamp: 1600000,
+				Fields:    map[string]string{"message": "guardian.create.net-setup", "level": "info"},
+			}}))
+		})
+
+		It("sends every span only once", func() {
+			Expect(tracer.EmitSpans(wfSender)).To(Succeed())
+			Expect(wfSender.SendSpanCallCount()).To(Equal(2))
+		})
+	})
+
+	Context("when a request fails", func() {
+		BeforeEach(func() {
+			logLine(1000, "destroy.starting", "7", 1, "")
+			logLine(1300, "destroy.failed", "7", 2, `"error":"boom"`)
+		})
+
+		It("marks the span as an error and logs the failure", func() {
+			destroy := spans()["destroy"]
+			Expect(destroy.tags).To(ContainElement(wavefront.SpanTag{Key: "error", Value: "true"}))
+			Expect(destroy.logs).To(HaveLen(1))
+			Expect(destroy.logs[0].Fields).To(HaveKeyWithValue("error", "boom"))
+		})
+	})
+
+	Context("when a request is still in progress", func() {
+		BeforeEach(func() {
+			logLine(1000, "run.starting", "8", 1, "")
+		})
+
+		It("does not send it", func() {
+			Expect(wfSender.SendSpanCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when sending fails", func() {
+		BeforeEach(func() {
+			logLine(1000, "run.starting", "8", 1, "")
+			logLine(1100, "run.finished", "8", 1, "")
+			wfSender.SendSpanReturns(errors.New("wf-error"))
+		})
+
+		It("returns the error", func() {
+			Expect(emitErr).To(MatchError("wf-error"))
+		})
+	})
+})
@@ -2,8 +2,11 @@ package metricsadapter
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
@@ -35,6 +38,29 @@ type Metric struct {
 
 type MetricPoints [][2]float64
 
+type Collector interface {
+	Collect() (Series, error)
+}
+
+type CollectorFunc func() (Series, error)
+
+func (f CollectorFunc) Collect() (Series, error) {
+	return f()
+}
+
+func newMetric(name string, timestamp int64, value float64, host string, tags ...string) Metric {
+	if tags == nil {
+		tags = []string{}
+	}
+
+	return Metric{
+		Metric: name,
+		Points: MetricPoints{[2]float64{float64(timestamp), value}},
+		Host:   host,
+		Tags:   tags,
+	}
+}
+
 func fromGardenDebugMetrics(m GardenDebugMetrics, host string) Series {
 	now := time.Now().Unix()
 	return Series{
@@ -61,8 +87,12 @@ func CollectMetrics(url, host string) (Series, error) {
 		return Series{}, err
 	}
 
+	return parseGardenDebugMetrics(body, host)
+}
+
+func parseGardenDebugMetrics(body []byte, host string) (Series, error) {
 	var gardenDebugMetrics GardenDebugMetrics
-	err = json.Unmarshal(body, &gardenDebugMetrics)
+	err := json.Unmarshal(body, &gardenDebugMetrics)
 	if err != nil {
 		return Series{}, err
 	}
@@ -70,6 +100,67 @@ func CollectMetrics(url, host string) (Series, error) {
 	return fromGardenDebugMetrics(gardenDebugMetrics, host), nil
 }
 
+// DebugCollector collects what CollectMetrics does, and keeps the size of
+// the last response of garden's debug server.
+type DebugCollector struct {
+	host          string
+	url           string
+	responseBytes int64
+}
+
+func NewDebugCollector(host, url string) *DebugCollector {
+	return &DebugCollector{host: host, url: url}
+}
+
+func (c *DebugCollector) Collect() (Series, error) {
+	body, err := c.Fetch()
+	if err != nil {
+		return Series{}, err
+	}
+	return c.Parse(body)
+}
+
+// Fetch reads the metrics of garden's debug server.
+func (c *DebugCollector) Fetch() ([]byte, error) {
+	body, err := getResponseBody(c.url)
+	atomic.StoreInt64(&c.responseBytes, int64(len(body)))
+	return body, err
+}
+
+// Parse turns the metrics of garden's debug server into series.
+func (c *DebugCollector) Parse(body []byte) (Series, error) {
+	return parseGardenDebugMetrics(body, c.host)
+}
+
+func (c *DebugCollector) LastResponseBytes() int64 {
+	return atomic.LoadInt64(&c.responseBytes)
+}
+
+// CollectAll collects from every collector, even when some of them fail. It
+// returns the series of every collector together with an error describing
+// the ones that failed. A collector that fails can still return series, such
+// as the health of its target that Scrape returns.
+func CollectAll(collectors ...Collector) (Series, error) {
+	var (
+		series Series
+		errs   []string
+	)
+
+	for _, c := range collectors {
+		s, err := c.Collect()
+		series.Series = append(series.Series, s.Series...)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return series, fmt.Errorf("collecting metrics: %s", strings.Join(errs, "; "))
+	}
+
+	return series, nil
+}
+
 func getResponseBody(url string) ([]byte, error) {
 	response, err := http.Get(url)
 	if err != nil {
@@ -85,7 +176,7 @@ func EmitMetrics(metrics Series, wfSender wavefront.Sender) error {
 
 	for _, m := range metrics.Series {
 		for _, p := range m.Points {
-			if err := wfSender.SendMetric(m.Metric, p[1], int64(p[0]), m.Host, nil); err != nil {
+			if err := wfSender.SendMetric(m.Metric, p[1], int64(p[0]), m.Host, tagMap(m.Tags)); err != nil {
 				return err
 			}
 		}
@@ -93,3 +184,23 @@ func EmitMetrics(metrics Series, wfSender wavefront.Sender) error {
 
 	return nil
 }
+
+// tagMap converts "key:value" tags to the map wavefront expects. Tags without a
+// value are sent with the value "true".
+func tagMap(tags []string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) == 1 {
+			m[kv[0]] = "true"
+			continue
+		}
+		m[kv[0]] = kv[1]
+	}
+
+	return m
+}
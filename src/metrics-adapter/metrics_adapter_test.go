@@ -146,6 +146,17 @@ var _ = Describe("MetricsAdapter", func() {
 			Expect(actualTags).To(BeNil())
 		})
 
+		When("metrics have tags", func() {
+			BeforeEach(func() {
+				emittedMetrics.Series[0].Tags = []string{"device:sda", "primary"}
+			})
+
+			It("sends them as point tags", func() {
+				_, _, _, _, actualTags := wfSender.SendMetricArgsForCall(0)
+				Expect(actualTags).To(Equal(map[string]string{"device": "sda", "primary": "true"}))
+			})
+		})
+
 		When("the wavefront sender fails", func() {
 			BeforeEach(func() {
 				wfSender.SendMetricReturns(errors.New("wf-error"))
@@ -156,4 +167,70 @@ var _ = Describe("MetricsAdapter", func() {
 			})
 		})
 	})
+
+	Describe("CollectAll", func() {
+		var (
+			collectors []metricsadapter.Collector
+			collected  metricsadapter.Series
+			collectErr error
+		)
+
+		collectorOf := func(names ...string) metricsadapter.Collector {
+			return metricsadapter.CollectorFunc(func() (metricsadapter.Series, error) {
+				var series metricsadapter.Series
+				for _, name := range names {
+					series.Series = append(series.Series, metricsadapter.Metric{Metric: name})
+				}
+				return series, nil
+			})
+		}
+
+		BeforeEach(func() {
+			collectors = []metricsadapter.Collector{collectorOf("a", "b"), collectorOf("c")}
+		})
+
+		JustBeforeEach(func() {
+			collected, collectErr = metricsadapter.CollectAll(collectors...)
+		})
+
+		It("concatenates the series of every collector", func() {
+			Expect(collectErr).NotTo(HaveOccurred())
+			Expect(collected.Series).To(HaveLen(3))
+			Expect(collected.Series[2].Metric).To(Equal("c"))
+		})
+
+		When("a collector fails", func() {
+			BeforeEach(func() {
+				failing := metricsadapter.CollectorFunc(func() (metricsadapter.Series, error) {
+					return metricsadapter.Series{}, errors.New("debug server down")
+				})
+				collectors = []metricsadapter.Collector{failing, collectorOf("c")}
+			})
+
+			It("returns the series of the other collectors", func() {
+				Expect(collected.Series).To(HaveLen(1))
+				Expect(collected.Series[0].Metric).To(Equal("c"))
+			})
+
+			Context("when it is scraped", func() {
+				BeforeEach(func() {
+					failing := collectors[0]
+					collectors[0] = metricsadapter.CollectorFunc(func() (metricsadapter.Series, error) {
+						return metricsadapter.Scrape("cactus", "garden-debug", failing)
+					})
+				})
+
+				It("keeps the health of its target", func() {
+					Expect(collectErr).To(MatchError(ContainSubstring("debug server down")))
+					Expect(collected.Series[0].Metric).To(Equal("metrics_adapter.up"))
+					Expect(collected.Series[0].Points[0][1]).To(Equal(0.0))
+					Expect(collected.Series[len(collected.Series)-1].Metric).To(Equal("c"))
+				})
+			})
+
+			It("returns the error", func() {
+				Expect(collectErr).To(MatchError(ContainSubstring("debug server down")))
+			})
+		})
+	})
 })
@@ -0,0 +1,229 @@
+package metricsadapter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const oomKillsMetric = "garden.container.oom_kills"
+
+var (
+	// oom-kill:constraint=CONSTRAINT_MEMCG,...,oom_memcg=/garden/h,task_memcg=/garden/h,task=java,pid=1234,uid=0
+	oomKillLine = regexp.MustCompile(`oom-kill:.*\boom_memcg=([^,]*),.*\btask=([^,]*),pid=(\d+)`)
+	// Task in /garden/h killed as a result of limit of /garden/h
+	oomTaskInLine = regexp.MustCompile(`Task in \S+ killed as a result of limit of (\S+)`)
+	// Memory cgroup out of memory: Killed process 1234 (java) total-vm:...
+	oomKilledProcessLine = regexp.MustCompile(`Kill(?:ed)? process (\d+) \(([^)]*)\)`)
+)
+
+type oomKill struct {
+	handle  string
+	process string
+	pid     string
+}
+
+// OOMWatcher reports containers whose processes were killed by the kernel's
+// OOM killer. Kills are detected from two sources: the kernel log, which names
+// the killed process, and the oom_kill counters of the container cgroups, which
+// also catch kills whose log lines were missed. Kills seen in the kernel log are
+// credited against the counters so that every kill is reported once.
+type OOMWatcher struct {
+	host         string
+	gardenCgroup string
+	reader       cgroupReader
+	sender       wavefront.Sender
+
+	mu      sync.Mutex
+	polled  bool
+	counts  map[string]float64
+	credits map[string]float64
+	pending oomKill
+}
+
+func NewOOMWatcher(host string, cfg OOMConfig, wfSender wavefront.Sender) *OOMWatcher {
+	return &OOMWatcher{
+		host:         host,
+		gardenCgroup: cfg.GardenCgroup,
+		reader:       newCgroupReader(cfg.Root),
+		sender:       wfSender,
+		counts:       map[string]float64{},
+		credits:      map[string]float64{},
+	}
+}
+
+// Poll reads the oom_kill counter of every container and reports the kills
+// that were not already reported from the kernel log. The first poll only
+// records the current counts; the containers that appear after it are
+// reported from 0, they are likely to be killed right after they start.
+func (w *OOMWatcher) Poll() error {
+	handles, err := w.reader.children(w.gardenCgroup)
+	if err != nil {
+		return fmt.Errorf("listing garden cgroups: %s", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seen := map[string]float64{}
+	for _, handle := range handles {
+		count, ok, err := w.reader.oomKills(filepath.Join(w.gardenCgroup, handle))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		seen[handle] = count
+
+		previous := w.counts[handle]
+		if !w.polled || count <= previous {
+			continue
+		}
+
+		kills := count - previous
+		unreported := kills - w.credits[handle]
+		w.credits[handle] -= kills
+		if w.credits[handle] < 0 {
+			w.credits[handle] = 0
+		}
+
+		if unreported > 0 {
+			if err := w.report(oomKill{handle: handle}, unreported); err != nil {
+				return err
+			}
+		}
+	}
+
+	for handle := range w.credits {
+		if _, ok := seen[handle]; !ok {
+			delete(w.credits, handle)
+		}
+	}
+	w.counts = seen
+	w.polled = true
+
+	return nil
+}
+
+// WatchKmsg follows a kernel log stream in /dev/kmsg format and reports every
+// OOM kill logged to it. It returns when the stream ends.
+func (w *OOMWatcher) WatchKmsg(kmsg io.Reader) error {
+	reader := bufio.NewReader(kmsg)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			if reportErr := w.handleKmsgLine(line); reportErr != nil {
+				return reportErr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		// /dev/kmsg returns EPIPE when records were overwritten before we read them
+		if errors.Is(err, syscall.EPIPE) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (w *OOMWatcher) handleKmsgLine(line string) error {
+	message := kmsgMessage(line)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if match := oomKillLine.FindStringSubmatch(message); match != nil {
+		w.pending = oomKill{handle: w.handleOf(match[1]), process: match[2], pid: match[3]}
+		return nil
+	}
+
+	if match := oomTaskInLine.FindStringSubmatch(message); match != nil {
+		w.pending = oomKill{handle: w.handleOf(match[1])}
+		return nil
+	}
+
+	match := oomKilledProcessLine.FindStringSubmatch(message)
+	if match == nil {
+		return nil
+	}
+
+	kill := oomKill{pid: match[1], process: match[2]}
+	if w.pending.pid == "" || w.pending.pid == kill.pid {
+		kill.handle = w.pending.handle
+	}
+	w.pending = oomKill{}
+
+	if kill.handle != "" {
+		w.credits[kill.handle]++
+	}
+	return w.report(kill, 1)
+}
+
+func (w *OOMWatcher) report(kill oomKill, count float64) error {
+	tags := map[string]string{}
+	if kill.handle != "" {
+		tags["handle"] = kill.handle
+	}
+
+	if err := w.sender.SendDeltaCounter(oomKillsMetric, count, w.host, tags); err != nil {
+		return err
+	}
+
+	details := fmt.Sprintf("%.0f process(es) in container %s were killed by the OOM killer", count, kill.handle)
+	if kill.process != "" {
+		details = fmt.Sprintf("process %s (pid %s) in container %s was killed by the OOM killer", kill.process, kill.pid, kill.handle)
+		tags["process"] = kill.process
+	}
+
+	now := nowMillis()
+	return w.sender.SendEvent(
+		"container OOM killed",
+		now, 0,
+		w.host,
+		tags,
+		event.Severity("warn"),
+		event.Type("oom-kill"),
+		event.Details(details),
+	)
+}
+
+// handleOf returns the handle of the container a memory cgroup path such as
+// /garden/<handle>/<subgroup> belongs to, or an empty string for cgroups
+// outside of garden's hierarchy.
+func (w *OOMWatcher) handleOf(cgroup string) string {
+	prefix := "/" + strings.Trim(w.gardenCgroup, "/") + "/"
+	if !strings.HasPrefix(cgroup, prefix) {
+		return ""
+	}
+
+	return strings.SplitN(strings.TrimPrefix(cgroup, prefix), "/", 2)[0]
+}
+
+// kmsgMessage strips the "<priority>,<sequence>,<timestamp>,<flags>;" prefix
+// of a /dev/kmsg record.
+func kmsgMessage(line string) string {
+	line = strings.TrimRight(line, "\n")
+	if semicolon := strings.Index(line, ";"); semicolon > 0 && strings.Count(line[:semicolon], ",") >= 2 {
+		return line[semicolon+1:]
+	}
+	return line
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
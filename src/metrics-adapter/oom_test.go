@@ -0,0 +1,217 @@
+package metricsadapter_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/masters-of-cats/metricsadapter"
+	fakes "github.com/masters-of-cats/metricsadapter/metrics-adapterfakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OOMWatcher", func() {
+	var (
+		root     string
+		wfSender *fakes.FakeSender
+		watcher  *metricsadapter.OOMWatcher
+	)
+
+	setOOMKills := func(handle string, count int) {
+		dir := filepath.Join(root, "garden", handle)
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		events := fmt.Sprintf("low 0\nhigh 0\nmax 3\noom %d\noom_kill %d\n", count, count)
+		Expect(ioutil.WriteFile(filepath.Join(dir, "memory.events"), []byte(events), 0644)).To(Succeed())
+	}
+
+	eventTags := func(i int) map[string]string {
+		_, _, _, _, tags, _ := wfSender.SendEventArgsForCall(i)
+		return tags
+	}
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "cgroup")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("memory\n"), 0644)).To(Succeed())
+		setOOMKills("handle-1", 0)
+		setOOMKills("handle-2", 2)
+
+		wfSender = new(fakes.FakeSender)
+		watcher = metricsadapter.NewOOMWatcher("cactus", metricsadapter.OOMConfig{
+			CgroupConfig: metricsadapter.CgroupConfig{Root: root, GardenCgroup: "garden"},
+		}, wfSender)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	Describe("Poll", func() {
+		BeforeEach(func() {
+			Expect(watcher.Poll()).To(Succeed())
+		})
+
+		It("does not report kills that happened before the first poll", func() {
+			Expect(wfSender.SendDeltaCounterCallCount()).To(Equal(0))
+			Expect(wfSender.SendEventCallCount()).To(Equal(0))
+		})
+
+		When("a container's oom_kill counter increases", func() {
+			BeforeEach(func() {
+				setOOMKills("handle-1", 2)
+				Expect(watcher.Poll()).To(Succeed())
+			})
+
+			It("counts the kills", func() {
+				Expect(wfSender.SendDeltaCounterCallCount()).To(Equal(1))
+				name, value, source, tags := wfSender.SendDeltaCounterArgsForCall(0)
+				Expect(name).To(Equal("garden.container.oom_kills"))
+				Expect(value).To(Equal(2.0))
+				Expect(source).To(Equal("cactus"))
+				Expect(tags).To(Equal(map[string]string{"handle": "handle-1"}))
+			})
+
+			It("sends an event naming the container", func() {
+				Expect(wfSender.SendEventCallCount()).To(Equal(1))
+				name, _, _, source, tags, _ := wfSender.SendEventArgsForCall(0)
+				Expect(name).To(Equal("container OOM killed"))
+				Expect(source).To(Equal("cactus"))
+				Expect(tags).To(Equal(map[string]string{"handle": "handle-1"}))
+			})
+
+			It("does not report the same kills again", func() {
+				Expect(watcher.Poll()).To(Succeed())
+				Expect(wfSender.SendDeltaCounterCallCount()).To(Equal(1))
+			})
+		})
+
+		When("a container that appeared after the first poll was killed", func() {
+			BeforeEach(func() {
+				setOOMKills("handle-3", 1)
+				Expect(watcher.Poll()).To(Succeed())
+			})
+
+			It("counts the kills", func() {
+				Expect(wfSender.SendDeltaCounterCallCount()).To(Equal(1))
+				_, value, _, tags := wfSender.SendDeltaCounterArgsForCall(0)
+				Expect(value).To(Equal(1.0))
+				Expect(tags).To(Equal(map[string]string{"handle": "handle-3"}))
+			})
+		})
+
+		When("the kill was already reported from the kernel log", func() {
+			BeforeEach(func() {
+				kmsg := "3,100,200,-;Memory cgroup out of memory: Killed process 1234 (java) total-vm:100kB\n"
+				Expect(watcher.WatchKmsg(strings.NewReader(
+					"6,99,199,-;oom-kill:constraint=CONSTRAINT_MEMCG,nodemask=(null),cpuset=handle-1,mems_allowed=0,oom_memcg=/garden/handle-1,task_memcg=/garden/handle-1,task=java,pid=1234,uid=0\n" + kmsg,
+				))).To(Succeed())
+				setOOMKills("handle-1", 1)
+				Expect(watcher.Poll()).To(Succeed())
+			})
+
+			It("reports it only once", func() {
+				Expect(wfSender.SendDeltaCounterCallCount()).To(Equal(1))
+				Expect(wfSender.SendEventCallCount()).To(Equal(1))
+				Expect(eventTags(0)).To(HaveKeyWithValue("process", "java"))
+			})
+		})
+
+		When("garden's cgroup does not exist", func() {
+			BeforeEach(func() {
+				Expect(os.RemoveAll(filepath.Join(root, "garden"))).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				Expect(watcher.Poll()).To(MatchError(ContainSubstring("listing garden cgroups")))
+			})
+		})
+	})
+
+	Describe("WatchKmsg", func() {
+		var (
+			kmsg     string
+			watchErr error
+		)
+
+		JustBeforeEach(func() {
+			watchErr = watcher.WatchKmsg(strings.NewReader(kmsg))
+		})
+
+		Context("with a kernel that logs oom-kill summaries", func() {
+			BeforeEach(func() {
+				kmsg = strings.Join([]string{
+					"6,1,100,-;eth0: link up",
+					"4,2,200,-;java invoked oom-killer: gfp_mask=0x6000c0(GFP_KERNEL), order=0, oom_score_adj=0",
+					" SUBSYSTEM=memory",
+					"6,3,300,-;oom-kill:constraint=CONSTRAINT_MEMCG,nodemask=(null),cpuset=handle-1,mems_allowed=0,oom_memcg=/garden/handle-1,task_memcg=/garden/handle-1/app,task=java,pid=1234,uid=2000",
+					"3,4,400,-;Memory cgroup out of memory: Killed process 1234 (java) total-vm:4000kB, anon-rss:2000kB, file-rss:0kB, shmem-rss:0kB, UID:2000 pgtables:100kB oom_score_adj:0",
+				}, "\n") + "\n"
+			})
+
+			It("does not return an error", func() {
+				Expect(watchErr).NotTo(HaveOccurred())
+			})
+
+			It("counts the kill for the container", func() {
+				Expect(wfSender.SendDeltaCounterCallCount()).To(Equal(1))
+				name, value, _, tags := wfSender.SendDeltaCounterArgsForCall(0)
+				Expect(name).To(Equal("garden.container.oom_kills"))
+				Expect(value).To(Equal(1.0))
+				Expect(tags).To(HaveKeyWithValue("handle", "handle-1"))
+			})
+
+			It("sends an event naming the container and the killed process", func() {
+				Expect(wfSender.SendEventCallCount()).To(Equal(1))
+				Expect(eventTags(0)).To(Equal(map[string]string{"handle": "handle-1", "process": "java"}))
+
+				_, _, _, _, _, setters := wfSender.SendEventArgsForCall(0)
+				annotations := map[string]interface{}{"annotations": map[string]string{}}
+				for _, setter := range setters {
+					setter(annotations)
+				}
+				Expect(annotations["annotations"]).To(HaveKeyWithValue("details", "process java (pid 1234) in container handle-1 was killed by the OOM killer"))
+			})
+		})
+
+		Context("with an older kernel", func() {
+			BeforeEach(func() {
+				kmsg = strings.Join([]string{
+					"[12345.678] Task in /garden/handle-2 killed as a result of limit of /garden/handle-2",
+					"[12345.679] Memory cgroup out of memory: Kill process 4321 (ruby) score 1000 or sacrifice child",
+				}, "\n") + "\n"
+			})
+
+			It("sends an event naming the container and the killed process", func() {
+				Expect(wfSender.SendEventCallCount()).To(Equal(1))
+				Expect(eventTags(0)).To(Equal(map[string]string{"handle": "handle-2", "process": "ruby"}))
+			})
+		})
+
+		Context("when a process outside of garden is killed", func() {
+			BeforeEach(func() {
+				kmsg = "3,4,400,-;Out of memory: Killed process 99 (monit) total-vm:100kB\n"
+			})
+
+			It("reports the kill without a handle", func() {
+				Expect(wfSender.SendEventCallCount()).To(Equal(1))
+				Expect(eventTags(0)).To(Equal(map[string]string{"process": "monit"}))
+			})
+		})
+
+		Context("when sending fails", func() {
+			BeforeEach(func() {
+				kmsg = "3,4,400,-;Memory cgroup out of memory: Killed process 1234 (java)\n"
+				wfSender.SendDeltaCounterReturns(errors.New("wf-error"))
+			})
+
+			It("returns the error", func() {
+				Expect(watchErr).To(MatchError("wf-error"))
+			})
+		})
+	})
+})
@@ -0,0 +1,404 @@
+package metricsadapter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const (
+	otlpScope = "github.com/masters-of-cats/metricsadapter"
+
+	// aggregation temporalities of OTLP sums and histograms
+	otlpDelta = 1
+)
+
+type otlpKind int
+
+const (
+	otlpGauge otlpKind = iota
+	otlpMonotonicSum
+	otlpHistogram
+)
+
+// otlpPoint is a data point waiting to be exported.
+type otlpPoint struct {
+	kind      otlpKind
+	name      string
+	source    string
+	tags      map[string]string
+	start     time.Time
+	time      time.Time
+	value     float64
+	centroids []histogram.Centroid
+}
+
+// OTLPSender is a wavefront.Sender that exports metrics to an OpenTelemetry
+// collector with OTLP over HTTP in the protobuf encoding. The source of a
+// metric and the configured resource attributes, e.g. the BOSH identity of
+// the VM, become the attributes of its resource, with the source as
+// host.name, and the tags become the attributes of its data point. Metrics
+// are gauges, delta counters monotonic sums with delta temporality and
+// distributions histograms with delta temporality, one bucket per centroid.
+// Spans and events are dropped.
+//
+// Data points are buffered and exported in one request per Flush; if the
+// request fails they are kept for the next one.
+type OTLPSender struct {
+	url        string
+	headers    map[string]string
+	resource   map[string]string
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	points    []otlpPoint
+	lastFlush time.Time
+	failures  int64
+}
+
+func NewOTLPSender(cfg SinkConfig) (*OTLPSender, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("url %q must be http or https", cfg.URL)
+	}
+	if !strings.HasSuffix(base.Path, "/v1/metrics") {
+		base.Path = strings.TrimSuffix(base.Path, "/") + "/v1/metrics"
+	}
+
+	return &OTLPSender{
+		url:        base.String(),
+		headers:    cfg.Headers,
+		resource:   cfg.Resource,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		lastFlush:  time.Now(),
+	}, nil
+}
+
+func (s *OTLPSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	t := time.Now()
+	if ts != 0 {
+		t = time.Unix(ts, 0)
+	}
+	s.add(otlpPoint{kind: otlpGauge, name: name, source: source, tags: tags, time: t, value: value})
+	return nil
+}
+
+func (s *OTLPSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	if value <= 0 {
+		return nil
+	}
+	s.add(otlpPoint{kind: otlpMonotonicSum, name: strings.TrimPrefix(name, deltaPrefix), source: source, tags: tags, time: time.Now(), value: value})
+	return nil
+}
+
+func (s *OTLPSender) SendDistribution(name string, centroids []histogram.Centroid, _ map[histogram.Granularity]bool, ts int64, source string, tags map[string]string) error {
+	if len(centroids) == 0 {
+		return nil
+	}
+	t := time.Now()
+	if ts != 0 {
+		t = time.Unix(ts, 0)
+	}
+	s.add(otlpPoint{kind: otlpHistogram, name: name, source: source, tags: tags, time: t, centroids: centroids})
+	return nil
+}
+
+func (s *OTLPSender) SendSpan(string, int64, int64, string, string, string, []string, []string, []wavefront.SpanTag, []wavefront.SpanLog) error {
+	return nil
+}
+
+func (s *OTLPSender) SendEvent(string, int64, int64, string, map[string]string, ...event.Option) error {
+	return nil
+}
+
+func (s *OTLPSender) add(point otlpPoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.points = append(s.points, point)
+	if overflow := len(s.points) - maxBufferedLines; overflow > 0 {
+		s.points = s.points[overflow:]
+		s.failures += int64(overflow)
+	}
+}
+
+func (s *OTLPSender) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for i := range s.points {
+		if s.points[i].kind != otlpGauge && s.points[i].start.IsZero() {
+			s.points[i].start = s.lastFlush
+		}
+	}
+	s.lastFlush = now
+
+	if len(s.points) == 0 {
+		return nil
+	}
+
+	if err := s.export(s.points); err != nil {
+		s.failures++
+		return err
+	}
+	s.points = nil
+	return nil
+}
+
+func (s *OTLPSender) export(points []otlpPoint) error {
+	request, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(otlpRequest(s.resource, points)))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	for key, value := range s.headers {
+		request.Header.Set(key, value)
+	}
+
+	response, err := s.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("exporting to otlp: %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (s *OTLPSender) GetFailureCount() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures
+}
+
+func (s *OTLPSender) Start() {}
+
+func (s *OTLPSender) Close() {
+	s.Flush()
+}
+
+// otlpRequest encodes an ExportMetricsServiceRequest with one resource per
+// source and one metric per name and kind.
+func otlpRequest(resource map[string]string, points []otlpPoint) []byte {
+	var sources []string
+	bySource := map[string][]otlpPoint{}
+	for _, point := range points {
+		if _, ok := bySource[point.source]; !ok {
+			sources = append(sources, point.source)
+		}
+		bySource[point.source] = append(bySource[point.source], point)
+	}
+
+	var request protoMessage
+	for _, source := range sources {
+		attributes := map[string]string{}
+		for key, value := range resource {
+			attributes[key] = value
+		}
+		if source != "" {
+			attributes["host.name"] = source
+		}
+
+		var res protoMessage
+		res.attributes(1, attributes)
+
+		var scope protoMessage
+		scope.string(1, otlpScope)
+
+		var scopeMetrics protoMessage
+		scopeMetrics.message(1, scope)
+		for _, metric := range otlpMetrics(bySource[source]) {
+			scopeMetrics.message(2, metric)
+		}
+
+		var resourceMetrics protoMessage
+		resourceMetrics.message(1, res)
+		resourceMetrics.message(2, scopeMetrics)
+
+		request.message(1, resourceMetrics)
+	}
+	return request
+}
+
+func otlpMetrics(points []otlpPoint) []protoMessage {
+	type key struct {
+		name string
+		kind otlpKind
+	}
+
+	var keys []key
+	grouped := map[key][]otlpPoint{}
+	for _, point := range points {
+		k := key{point.name, point.kind}
+		if _, ok := grouped[k]; !ok {
+			keys = append(keys, k)
+		}
+		grouped[k] = append(grouped[k], point)
+	}
+
+	metrics := make([]protoMessage, 0, len(keys))
+	for _, k := range keys {
+		var data protoMessage
+		for _, point := range grouped[k] {
+			if k.kind == otlpHistogram {
+				data.message(1, otlpHistogramPoint(point))
+			} else {
+				data.message(1, otlpNumberPoint(point))
+			}
+		}
+
+		var metric protoMessage
+		metric.string(1, k.name)
+		switch k.kind {
+		case otlpGauge:
+			metric.message(5, data)
+		case otlpMonotonicSum:
+			data.varint(2, otlpDelta)
+			data.varint(3, 1)
+			metric.message(7, data)
+		case otlpHistogram:
+			data.varint(2, otlpDelta)
+			metric.message(9, data)
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+func otlpNumberPoint(point otlpPoint) protoMessage {
+	var p protoMessage
+	if !point.start.IsZero() {
+		p.fixed64(2, uint64(point.start.UnixNano()))
+	}
+	p.fixed64(3, uint64(point.time.UnixNano()))
+	p.double(4, point.value)
+	p.attributes(7, point.tags)
+	return p
+}
+
+// otlpHistogramPoint turns the centroids of a distribution into a histogram
+// with the centroid values as bucket bounds, so that each centroid falls into
+// the bucket ending at its value and the overflow bucket stays empty.
+func otlpHistogramPoint(point otlpPoint) protoMessage {
+	centroids := append([]histogram.Centroid{}, point.centroids...)
+	sort.Slice(centroids, func(i, j int) bool { return centroids[i].Value < centroids[j].Value })
+
+	var (
+		count  uint64
+		sum    float64
+		counts protoMessage
+		bounds protoMessage
+	)
+	for _, centroid := range centroids {
+		count += uint64(centroid.Count)
+		sum += centroid.Value * float64(centroid.Count)
+		counts.rawFixed64(uint64(centroid.Count))
+		bounds.rawFixed64(math.Float64bits(centroid.Value))
+	}
+	counts.rawFixed64(0)
+
+	var p protoMessage
+	p.fixed64(2, uint64(point.start.UnixNano()))
+	p.fixed64(3, uint64(point.time.UnixNano()))
+	p.fixed64(4, count)
+	p.double(5, sum)
+	p.bytes(6, counts)
+	p.bytes(7, bounds)
+	p.attributes(9, point.tags)
+	p.double(11, centroids[0].Value)
+	p.double(12, centroids[len(centroids)-1].Value)
+	return p
+}
+
+// protoMessage is the protobuf wire encoding of a message, enough of it to
+// encode OTLP without generated code.
+type protoMessage []byte
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func (m *protoMessage) tag(field, wireType int) {
+	m.rawVarint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (m *protoMessage) rawVarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	*m = append(*m, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (m *protoMessage) rawFixed64(v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	*m = append(*m, buf[:]...)
+}
+
+func (m *protoMessage) varint(field int, v uint64) {
+	m.tag(field, wireVarint)
+	m.rawVarint(v)
+}
+
+func (m *protoMessage) fixed64(field int, v uint64) {
+	m.tag(field, wireFixed64)
+	m.rawFixed64(v)
+}
+
+func (m *protoMessage) double(field int, v float64) {
+	m.fixed64(field, math.Float64bits(v))
+}
+
+func (m *protoMessage) bytes(field int, b []byte) {
+	m.tag(field, wireBytes)
+	m.rawVarint(uint64(len(b)))
+	*m = append(*m, b...)
+}
+
+func (m *protoMessage) string(field int, s string) {
+	m.bytes(field, []byte(s))
+}
+
+func (m *protoMessage) message(field int, message protoMessage) {
+	m.bytes(field, message)
+}
+
+// attributes encodes attributes as repeated KeyValues with string values,
+// sorted by key.
+func (m *protoMessage) attributes(field int, attributes map[string]string) {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var value protoMessage
+		value.string(1, attributes[key])
+
+		var kv protoMessage
+		kv.string(1, key)
+		kv.message(2, value)
+		m.message(field, kv)
+	}
+}
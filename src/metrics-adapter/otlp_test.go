@@ -0,0 +1,252 @@
+package metricsadapter_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+)
+
+// protoFields decodes the fields of a protobuf message by number, with
+// varints and fixed64s as uint64 and length-delimited fields as []byte.
+func protoFields(message []byte) map[int][]interface{} {
+	fields := map[int][]interface{}{}
+	for len(message) > 0 {
+		tag, n := binary.Uvarint(message)
+		Expect(n).To(BeNumerically(">", 0))
+		message = message[n:]
+
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(message)
+			Expect(n).To(BeNumerically(">", 0))
+			fields[field] = append(fields[field], v)
+			message = message[n:]
+		case 1:
+			fields[field] = append(fields[field], binary.LittleEndian.Uint64(message))
+			message = message[8:]
+		case 2:
+			length, n := binary.Uvarint(message)
+			Expect(n).To(BeNumerically(">", 0))
+			fields[field] = append(fields[field], message[n:n+int(length)])
+			message = message[n+int(length):]
+		default:
+			Fail("unexpected wire type")
+		}
+	}
+	return fields
+}
+
+func protoMessages(fields map[int][]interface{}, field int) []map[int][]interface{} {
+	var messages []map[int][]interface{}
+	for _, v := range fields[field] {
+		messages = append(messages, protoFields(v.([]byte)))
+	}
+	return messages
+}
+
+func protoString(fields map[int][]interface{}, field int) string {
+	Expect(fields[field]).To(HaveLen(1))
+	return string(fields[field][0].([]byte))
+}
+
+func protoDouble(fields map[int][]interface{}, field int) float64 {
+	Expect(fields[field]).To(HaveLen(1))
+	return math.Float64frombits(fields[field][0].(uint64))
+}
+
+func protoAttributes(fields map[int][]interface{}, field int) map[string]string {
+	attributes := map[string]string{}
+	for _, kv := range protoMessages(fields, field) {
+		value := protoMessages(kv, 2)[0]
+		attributes[protoString(kv, 1)] = protoString(value, 1)
+	}
+	return attributes
+}
+
+func packedFixed64(fields map[int][]interface{}, field int) []uint64 {
+	Expect(fields[field]).To(HaveLen(1))
+	packed := fields[field][0].([]byte)
+	var values []uint64
+	for i := 0; i < len(packed); i += 8 {
+		values = append(values, binary.LittleEndian.Uint64(packed[i:]))
+	}
+	return values
+}
+
+var _ = Describe("OTLPSender", func() {
+	var (
+		server *httptest.Server
+		status int
+
+		mu       sync.Mutex
+		requests []*http.Request
+		bodies   [][]byte
+
+		sender *metricsadapter.OTLPSender
+	)
+
+	BeforeEach(func() {
+		status = http.StatusOK
+		requests, bodies = nil, nil
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+
+			mu.Lock()
+			defer mu.Unlock()
+			requests = append(requests, r)
+			bodies = append(bodies, body)
+			w.WriteHeader(status)
+		}))
+
+		var err error
+		sender, err = metricsadapter.NewOTLPSender(metricsadapter.SinkConfig{
+			Type:     metricsadapter.SinkOTLP,
+			URL:      server.URL,
+			Headers:  map[string]string{"Authorization": "Bearer token"},
+			Resource: map[string]string{"bosh.deployment": "cf", "bosh.instance_group": "diego-cell"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// metrics decodes the metrics of the only resource of the only request.
+	metrics := func() (map[string]string, map[string]map[int][]interface{}) {
+		Expect(bodies).To(HaveLen(1))
+		resourceMetrics := protoMessages(protoFields(bodies[0]), 1)
+		Expect(resourceMetrics).To(HaveLen(1))
+
+		resource := protoAttributes(protoMessages(resourceMetrics[0], 1)[0], 1)
+		scopeMetrics := protoMessages(resourceMetrics[0], 2)
+		Expect(scopeMetrics).To(HaveLen(1))
+
+		byName := map[string]map[int][]interface{}{}
+		for _, metric := range protoMessages(scopeMetrics[0], 2) {
+			byName[protoString(metric, 1)] = metric
+		}
+		return resource, byName
+	}
+
+	It("posts protobuf to the metrics path of the receiver", func() {
+		Expect(sender.SendMetric("garden.memory", 42, 1589299485, "cactus", nil)).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Method).To(Equal(http.MethodPost))
+		Expect(requests[0].URL.Path).To(Equal("/v1/metrics"))
+		Expect(requests[0].Header.Get("Content-Type")).To(Equal("application/x-protobuf"))
+		Expect(requests[0].Header.Get("Authorization")).To(Equal("Bearer token"))
+	})
+
+	It("encodes requests as the OTLP protos do", func() {
+		Expect(sender.SendMetric("garden.memory", 42.5, 1589299485, "cactus", map[string]string{"handle": "h"})).To(Succeed())
+		Expect(sender.SendMetric("garden.memory", 7, 1589299485, "cactus", nil)).To(Succeed())
+		Expect(sender.SendMetric("garden.numGoroutines", 100, 1589299486, "cactus", nil)).To(Succeed())
+		Expect(sender.SendMetric("host.cpu.load1", 0.25, 1589299485, "", nil)).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+
+		// the same ExportMetricsServiceRequest built with the types of
+		// go.opentelemetry.io/proto/otlp v0.19.0, and marshalled with the
+		// fields in the order of their numbers, as protoc does
+		golden, err := ioutil.ReadFile(filepath.Join("testdata", "otlp", "gauges.pb"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bodies).To(HaveLen(1))
+		Expect(bodies[0]).To(Equal(golden))
+	})
+
+	It("makes the host and the configured identity resource attributes", func() {
+		Expect(sender.SendMetric("garden.memory", 42, 1589299485, "cactus", nil)).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+
+		resource, _ := metrics()
+		Expect(resource).To(Equal(map[string]string{
+			"host.name":           "cactus",
+			"bosh.deployment":     "cf",
+			"bosh.instance_group": "diego-cell",
+		}))
+	})
+
+	It("exports metrics as gauges with the tags as attributes", func() {
+		Expect(sender.SendMetric("garden.memory", 42.5, 1589299485, "cactus", map[string]string{"handle": "h"})).To(Succeed())
+		Expect(sender.SendMetric("garden.memory", 7, 1589299485, "cactus", map[string]string{"handle": "i"})).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+
+		_, byName := metrics()
+		gauge := protoMessages(byName["garden.memory"], 5)
+		Expect(gauge).To(HaveLen(1))
+
+		points := protoMessages(gauge[0], 1)
+		Expect(points).To(HaveLen(2))
+		Expect(points[0][3]).To(ConsistOf(uint64(1589299485 * int64(time.Second))))
+		Expect(protoDouble(points[0], 4)).To(Equal(42.5))
+		Expect(protoAttributes(points[0], 7)).To(Equal(map[string]string{"handle": "h"}))
+		Expect(protoDouble(points[1], 4)).To(Equal(7.0))
+	})
+
+	It("exports delta counters as monotonic delta sums", func() {
+		Expect(sender.SendDeltaCounter("∆garden.container.oom_kills", 2, "cactus", map[string]string{"handle": "h"})).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+
+		_, byName := metrics()
+		sum := protoMessages(byName["garden.container.oom_kills"], 7)
+		Expect(sum).To(HaveLen(1))
+		Expect(sum[0][2]).To(ConsistOf(uint64(1)), "delta temporality")
+		Expect(sum[0][3]).To(ConsistOf(uint64(1)), "monotonic")
+
+		point := protoMessages(sum[0], 1)[0]
+		Expect(protoDouble(point, 4)).To(Equal(2.0))
+		Expect(point[2][0].(uint64)).To(BeNumerically("<=", point[3][0].(uint64)), "start before end")
+	})
+
+	It("exports distributions as histograms", func() {
+		Expect(sender.SendDistribution("garden.log.duration", []histogram.Centroid{{Value: 30, Count: 1}, {Value: 10, Count: 2}},
+			map[histogram.Granularity]bool{histogram.MINUTE: true}, 1589299485, "cactus", map[string]string{"operation": "create"})).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+
+		_, byName := metrics()
+		hist := protoMessages(byName["garden.log.duration"], 9)
+		Expect(hist).To(HaveLen(1))
+		Expect(hist[0][2]).To(ConsistOf(uint64(1)), "delta temporality")
+
+		point := protoMessages(hist[0], 1)[0]
+		Expect(point[4]).To(ConsistOf(uint64(3)), "count")
+		Expect(protoDouble(point, 5)).To(Equal(50.0))
+		Expect(packedFixed64(point, 6)).To(Equal([]uint64{2, 1, 0}))
+		Expect(packedFixed64(point, 7)).To(Equal([]uint64{math.Float64bits(10), math.Float64bits(30)}))
+		Expect(protoAttributes(point, 9)).To(Equal(map[string]string{"operation": "create"}))
+		Expect(protoDouble(point, 11)).To(Equal(10.0))
+		Expect(protoDouble(point, 12)).To(Equal(30.0))
+	})
+
+	Context("when the receiver fails", func() {
+		BeforeEach(func() {
+			status = http.StatusServiceUnavailable
+		})
+
+		It("keeps the points for the next flush", func() {
+			Expect(sender.SendMetric("garden.memory", 42, 1589299485, "cactus", nil)).To(Succeed())
+			Expect(sender.Flush()).To(MatchError(ContainSubstring("503")))
+			Expect(sender.GetFailureCount()).To(BeEquivalentTo(1))
+
+			status = http.StatusOK
+			bodies = nil
+			Expect(sender.Flush()).To(Succeed())
+			_, byName := metrics()
+			Expect(byName).To(HaveKey("garden.memory"))
+		})
+	})
+})
@@ -0,0 +1,202 @@
+package metricsadapter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProcessCollector reports the resource usage of the garden process itself,
+// as seen by the kernel rather than by the go runtime. The process is found
+// through its pidfile or, failing that, by its name.
+type ProcessCollector struct {
+	host     string
+	procRoot string
+	pidfile  string
+	name     string
+}
+
+func NewProcessCollector(host string, cfg ProcessConfig) *ProcessCollector {
+	return &ProcessCollector{
+		host:     host,
+		procRoot: cfg.ProcRoot,
+		pidfile:  cfg.Pidfile,
+		name:     cfg.Name,
+	}
+}
+
+func (c *ProcessCollector) Collect() (Series, error) {
+	pid, err := c.findPid()
+	if err != nil {
+		return Series{}, err
+	}
+
+	s := &sample{timestamp: time.Now().Unix(), host: c.host}
+	dir := filepath.Join(c.procRoot, pid)
+
+	if err := readProcessStat(s, filepath.Join(dir, "stat")); err != nil {
+		return Series{}, err
+	}
+
+	if err := readProcessStatus(s, filepath.Join(dir, "status")); err != nil {
+		return Series{}, err
+	}
+
+	fds, err := ioutil.ReadDir(filepath.Join(dir, "fd"))
+	if err != nil {
+		return Series{}, err
+	}
+	s.add("garden.process.fds", float64(len(fds)))
+
+	limit, ok, err := readOpenFilesLimit(filepath.Join(dir, "limits"))
+	if err != nil {
+		return Series{}, err
+	}
+	if ok {
+		s.add("garden.process.fd_limit", limit)
+		s.add("garden.process.fd_headroom", limit-float64(len(fds)))
+	}
+
+	return Series{Series: s.metrics}, nil
+}
+
+func (c *ProcessCollector) findPid() (string, error) {
+	if c.pidfile != "" {
+		contents, err := ioutil.ReadFile(c.pidfile)
+		if err == nil {
+			pid := strings.TrimSpace(string(contents))
+			if _, err := strconv.Atoi(pid); err != nil {
+				return "", fmt.Errorf("invalid pid in %s: %q", c.pidfile, pid)
+			}
+			return pid, nil
+		}
+		if c.name == "" {
+			return "", err
+		}
+	}
+
+	entries, err := ioutil.ReadDir(c.procRoot)
+	if err != nil {
+		return "", err
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		comm, err := ioutil.ReadFile(filepath.Join(c.procRoot, entry.Name(), "comm"))
+		if err != nil {
+			// the process exited while we were looking
+			continue
+		}
+		if strings.TrimSpace(string(comm)) == c.name {
+			pids = append(pids, pid)
+		}
+	}
+
+	if len(pids) == 0 {
+		return "", fmt.Errorf("no process named %q found", c.name)
+	}
+
+	sort.Ints(pids)
+	return strconv.Itoa(pids[0]), nil
+}
+
+// readProcessStat reads the cpu times from /proc/<pid>/stat. The process name
+// in the second field may contain spaces and parentheses, so the fields are
+// counted from the last closing parenthesis.
+func readProcessStat(s *sample, path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	stat := string(contents)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	// fields[0] is the state, the third field of the file
+	const utime, stime = 14 - 3, 15 - 3
+	if len(fields) <= stime {
+		return fmt.Errorf("%s: unexpected format", path)
+	}
+
+	var totalTicks float64
+	for _, cpu := range []struct {
+		name  string
+		field int
+	}{
+		{"garden.process.cpu.user", utime},
+		{"garden.process.cpu.system", stime},
+	} {
+		ticks, err := strconv.ParseFloat(fields[cpu.field], 64)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		totalTicks += ticks
+		s.add(cpu.name, ticks/userHZ)
+	}
+	s.add("garden.process.cpu.total", totalTicks/userHZ)
+
+	return nil
+}
+
+func readProcessStatus(s *sample, path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "VmRSS:":
+			if err := s.parseAndAdd("garden.process.rss", fields[1], 1024); err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+		case "Threads:":
+			if err := s.parseAndAdd("garden.process.threads", fields[1], 1); err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// readOpenFilesLimit returns the soft limit on open files from
+// /proc/<pid>/limits, unless it is unlimited.
+func readOpenFilesLimit(path string) (float64, bool, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+		if len(fields) == 0 || fields[0] == "unlimited" {
+			return 0, false, nil
+		}
+
+		limit, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("%s: %s", path, err)
+		}
+		return limit, true, nil
+	}
+
+	return 0, false, nil
+}
@@ -0,0 +1,142 @@
+package metricsadapter_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ProcessCollector", func() {
+	var (
+		cfg        metricsadapter.ProcessConfig
+		series     metricsadapter.Series
+		collectErr error
+	)
+
+	BeforeEach(func() {
+		cfg = metricsadapter.ProcessConfig{ProcRoot: "testdata/proc", Name: "gdn"}
+	})
+
+	JustBeforeEach(func() {
+		series, collectErr = metricsadapter.NewProcessCollector("cactus", cfg).Collect()
+	})
+
+	values := func() map[string]float64 {
+		values := map[string]float64{}
+		for _, m := range series.Series {
+			Expect(m.Host).To(Equal("cactus"))
+			values[m.Metric] = m.Points[0][1]
+		}
+		return values
+	}
+
+	writePidfile := func(pid string) string {
+		pidfile, err := ioutil.TempFile("", "pidfile")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = pidfile.WriteString(pid + "\n")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pidfile.Close()).To(Succeed())
+		return pidfile.Name()
+	}
+
+	It("does not return an error", func() {
+		Expect(collectErr).NotTo(HaveOccurred())
+	})
+
+	It("reports the resource usage of the process found by name", func() {
+		Expect(values()).To(Equal(map[string]float64{
+			"garden.process.cpu.user":    15,
+			"garden.process.cpu.system":  2.5,
+			"garden.process.cpu.total":   17.5,
+			"garden.process.rss":         81920 * 1024,
+			"garden.process.threads":     42,
+			"garden.process.fds":         6,
+			"garden.process.fd_limit":    16,
+			"garden.process.fd_headroom": 10,
+		}))
+	})
+
+	Context("when a pidfile is configured", func() {
+		BeforeEach(func() {
+			cfg.Name = ""
+			cfg.Pidfile = writePidfile("4243")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(cfg.Pidfile)).To(Succeed())
+		})
+
+		It("reports the process from the pidfile", func() {
+			Expect(values()).To(HaveKeyWithValue("garden.process.cpu.total", 0.3))
+			Expect(values()).To(HaveKeyWithValue("garden.process.threads", 1.0))
+		})
+
+		It("does not report a limit when open files are unlimited", func() {
+			Expect(values()).NotTo(HaveKey("garden.process.fd_limit"))
+			Expect(values()).NotTo(HaveKey("garden.process.fd_headroom"))
+		})
+	})
+
+	Context("when the pidfile does not exist", func() {
+		BeforeEach(func() {
+			cfg.Pidfile = "/does/not/exist"
+		})
+
+		It("falls back to the process name", func() {
+			Expect(collectErr).NotTo(HaveOccurred())
+			Expect(values()).To(HaveKeyWithValue("garden.process.threads", 42.0))
+		})
+
+		Context("and no name is configured", func() {
+			BeforeEach(func() {
+				cfg.Name = ""
+			})
+
+			It("returns an error", func() {
+				Expect(collectErr).To(HaveOccurred())
+			})
+		})
+	})
+
+	Context("when the pidfile is not valid", func() {
+		BeforeEach(func() {
+			cfg.Pidfile = writePidfile("garden")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(cfg.Pidfile)).To(Succeed())
+		})
+
+		It("returns an error", func() {
+			Expect(collectErr).To(MatchError(ContainSubstring("invalid pid")))
+		})
+	})
+
+	Context("when no process has the name", func() {
+		BeforeEach(func() {
+			cfg.Name = "guardian"
+		})
+
+		It("returns an error", func() {
+			Expect(collectErr).To(MatchError(`no process named "guardian" found`))
+		})
+	})
+
+	Context("when the process has exited", func() {
+		BeforeEach(func() {
+			cfg.Name = ""
+			cfg.Pidfile = writePidfile("99999")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(cfg.Pidfile)).To(Succeed())
+		})
+
+		It("returns an error", func() {
+			Expect(collectErr).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,256 @@
+package metricsadapter
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const (
+	snapshotPrefix     = "garden-pprof-"
+	snapshotSuffix     = ".tar.gz"
+	snapshotTimeFormat = "20060102T150405.000Z"
+)
+
+// Profiler captures goroutine, heap and cpu profiles of garden from its debug
+// server when the collected metrics meet one of the configured conditions, so
+// that the evidence of a spike is still around when someone looks into it.
+// The profiles of a capture are stored together as a tarball in the snapshot
+// directory, which keeps at most max_snapshots captures no older than max_age,
+// and a Wavefront event names the tarball. Captures are at least cooldown
+// apart.
+type Profiler struct {
+	host       string
+	pprofURL   string
+	cfg        ProfileConfig
+	sender     wavefront.Sender
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	capturing   bool
+	lastCapture time.Time
+}
+
+// NewProfiler returns a profiler for the garden debug server that serves the
+// given debug endpoint.
+func NewProfiler(host, debugEndpoint string, cfg ProfileConfig, wfSender wavefront.Sender) (*Profiler, error) {
+	pprof, err := pprofURL(debugEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Profiler{
+		host:       host,
+		pprofURL:   pprof,
+		cfg:        cfg,
+		sender:     wfSender,
+		httpClient: &http.Client{Timeout: cfg.CPUDuration + time.Minute},
+	}, nil
+}
+
+// Check captures profiles when any condition holds for the series, unless a
+// capture is in progress or the last one is more recent than the cooldown. It
+// returns the path of the snapshot, or an empty string when nothing was
+// captured.
+func (p *Profiler) Check(series Series) (string, error) {
+	reasons := p.reasons(series)
+	if len(reasons) == 0 {
+		return "", nil
+	}
+
+	p.mu.Lock()
+	if p.capturing || (!p.lastCapture.IsZero() && time.Since(p.lastCapture) < p.cfg.Cooldown) {
+		p.mu.Unlock()
+		return "", nil
+	}
+	p.capturing = true
+	p.lastCapture = time.Now()
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.capturing = false
+		p.mu.Unlock()
+	}()
+
+	path, err := p.capture()
+	if err != nil {
+		return "", fmt.Errorf("capturing profiles: %s", err)
+	}
+
+	if err := p.rotate(); err != nil {
+		return path, fmt.Errorf("rotating profiles: %s", err)
+	}
+
+	return path, p.sender.SendEvent(
+		"garden profiled",
+		nowMillis(), 0,
+		p.host,
+		map[string]string{"snapshot": path},
+		event.Severity("info"),
+		event.Type("pprof-capture"),
+		event.Details(fmt.Sprintf("%s; profiles saved to %s", strings.Join(reasons, "; "), path)),
+	)
+}
+
+func (p *Profiler) reasons(series Series) []string {
+	var reasons []string
+	for _, condition := range p.cfg.Conditions {
+		for _, m := range series.Series {
+			if m.Metric != condition.Metric || !hasTags(m.Tags, condition.Tags) || len(m.Points) == 0 {
+				continue
+			}
+
+			value := m.Points[len(m.Points)-1][1]
+			if condition.Above != nil && value > *condition.Above {
+				reasons = append(reasons, fmt.Sprintf("%s is %g, above %g", m.Metric, value, *condition.Above))
+			}
+			if condition.Below != nil && value < *condition.Below {
+				reasons = append(reasons, fmt.Sprintf("%s is %g, below %g", m.Metric, value, *condition.Below))
+			}
+		}
+	}
+	return reasons
+}
+
+func (p *Profiler) capture() (string, error) {
+	if err := os.MkdirAll(p.cfg.Directory, 0755); err != nil {
+		return "", err
+	}
+
+	name := snapshotPrefix + time.Now().UTC().Format(snapshotTimeFormat) + snapshotSuffix
+	path := filepath.Join(p.cfg.Directory, name)
+
+	tmp, err := ioutil.TempFile(p.cfg.Directory, ".capture")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gz := gzip.NewWriter(tmp)
+	archive := tar.NewWriter(gz)
+
+	profiles := []struct {
+		name  string
+		query string
+	}{
+		{"goroutine.txt", "goroutine?debug=2"},
+		{"heap.pb.gz", "heap"},
+		{"cpu.pb.gz", fmt.Sprintf("profile?seconds=%d", int(p.cfg.CPUDuration.Seconds()))},
+	}
+	for _, profile := range profiles {
+		contents, err := p.fetch(profile.query)
+		if err != nil {
+			return "", err
+		}
+
+		header := &tar.Header{Name: profile.name, Mode: 0644, Size: int64(len(contents)), ModTime: time.Now()}
+		if err := archive.WriteHeader(header); err != nil {
+			return "", err
+		}
+		if _, err := archive.Write(contents); err != nil {
+			return "", err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	return path, os.Rename(tmp.Name(), path)
+}
+
+func (p *Profiler) fetch(query string) ([]byte, error) {
+	response, err := p.httpClient.Get(p.pprofURL + query)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", query, response.Status)
+	}
+
+	return ioutil.ReadAll(response.Body)
+}
+
+// rotate deletes the snapshots beyond the newest max_snapshots and the ones
+// older than max_age.
+func (p *Profiler) rotate() error {
+	entries, err := ioutil.ReadDir(p.cfg.Directory)
+	if err != nil {
+		return err
+	}
+
+	var snapshots []os.FileInfo
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), snapshotPrefix) && strings.HasSuffix(entry.Name(), snapshotSuffix) {
+			snapshots = append(snapshots, entry)
+		}
+	}
+	// the names sort by capture time
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name() > snapshots[j].Name() })
+
+	var errs []string
+	for i, snapshot := range snapshots {
+		if i < p.cfg.MaxSnapshots && time.Since(snapshot.ModTime()) <= p.cfg.MaxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(p.cfg.Directory, snapshot.Name())); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// pprofURL returns the base url of the pprof handlers of the debug server that
+// serves the given debug endpoint, e.g. http://127.0.0.1:17013/debug/vars.
+func pprofURL(debugEndpoint string) (string, error) {
+	u, err := url.Parse(debugEndpoint)
+	if err != nil {
+		return "", err
+	}
+	u.Path = "/debug/pprof/"
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+func hasTags(tags, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, tag := range tags {
+			if tag == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
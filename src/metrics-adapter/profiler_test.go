@@ -0,0 +1,202 @@
+package metricsadapter_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/masters-of-cats/metricsadapter"
+	fakes "github.com/masters-of-cats/metricsadapter/metrics-adapterfakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Profiler", func() {
+	var (
+		dir       string
+		server    *httptest.Server
+		requests  []string
+		cfg       metricsadapter.ProfileConfig
+		wfSender  *fakes.FakeSender
+		profiler  *metricsadapter.Profiler
+		series    metricsadapter.Series
+		snapshot  string
+		checkErr  error
+		threshold float64
+	)
+
+	goroutines := func(value float64) metricsadapter.Series {
+		return metricsadapter.Series{Series: metricsadapter.Metrics{{
+			Metric: "garden.numGoroutines",
+			Points: metricsadapter.MetricPoints{{1, value}},
+			Tags:   []string{},
+		}}}
+	}
+
+	archiveContents := func(path string) map[string]string {
+		file, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+
+		gz, err := gzip.NewReader(file)
+		Expect(err).NotTo(HaveOccurred())
+		archive := tar.NewReader(gz)
+
+		contents := map[string]string{}
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				return contents
+			}
+			Expect(err).NotTo(HaveOccurred())
+			body, err := ioutil.ReadAll(archive)
+			Expect(err).NotTo(HaveOccurred())
+			contents[header.Name] = string(body)
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "profiles")
+		Expect(err).NotTo(HaveOccurred())
+
+		requests = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.URL.RequestURI())
+			switch r.URL.Path {
+			case "/debug/pprof/goroutine":
+				w.Write([]byte("goroutine 1 [running]:"))
+			case "/debug/pprof/heap":
+				w.Write([]byte("heap-profile"))
+			case "/debug/pprof/profile":
+				w.Write([]byte("cpu-profile"))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+
+		threshold = 1000
+		cfg = metricsadapter.ProfileConfig{
+			Directory:    filepath.Join(dir, "snapshots"),
+			CPUDuration:  2 * time.Second,
+			Cooldown:     time.Hour,
+			MaxSnapshots: 2,
+			MaxAge:       time.Hour,
+			Conditions:   []metricsadapter.ProfileCondition{{Metric: "garden.numGoroutines", Above: &threshold}},
+		}
+		wfSender = new(fakes.FakeSender)
+		series = goroutines(1500)
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		profiler, err = metricsadapter.NewProfiler("cactus", server.URL+"/debug/vars", cfg, wfSender)
+		Expect(err).NotTo(HaveOccurred())
+		snapshot, checkErr = profiler.Check(series)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("captures the profiles from the debug server", func() {
+		Expect(checkErr).NotTo(HaveOccurred())
+		Expect(requests).To(Equal([]string{
+			"/debug/pprof/goroutine?debug=2",
+			"/debug/pprof/heap",
+			"/debug/pprof/profile?seconds=2",
+		}))
+		Expect(filepath.Dir(snapshot)).To(Equal(cfg.Directory))
+		Expect(archiveContents(snapshot)).To(Equal(map[string]string{
+			"goroutine.txt": "goroutine 1 [running]:",
+			"heap.pb.gz":    "heap-profile",
+			"cpu.pb.gz":     "cpu-profile",
+		}))
+	})
+
+	It("sends an event pointing to the snapshot", func() {
+		Expect(wfSender.SendEventCallCount()).To(Equal(1))
+		name, _, _, source, tags, setters := wfSender.SendEventArgsForCall(0)
+		Expect(name).To(Equal("garden profiled"))
+		Expect(source).To(Equal("cactus"))
+		Expect(tags).To(Equal(map[string]string{"snapshot": snapshot}))
+
+		annotations := map[string]interface{}{"annotations": map[string]string{}}
+		for _, setter := range setters {
+			setter(annotations)
+		}
+		Expect(annotations["annotations"]).To(HaveKeyWithValue("details", "garden.numGoroutines is 1500, above 1000; profiles saved to "+snapshot))
+	})
+
+	It("does not capture again during the cooldown", func() {
+		path, err := profiler.Check(series)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(BeEmpty())
+		Expect(requests).To(HaveLen(3))
+	})
+
+	Context("when no condition holds", func() {
+		BeforeEach(func() {
+			series = goroutines(500)
+		})
+
+		It("does not capture", func() {
+			Expect(checkErr).NotTo(HaveOccurred())
+			Expect(snapshot).To(BeEmpty())
+			Expect(requests).To(BeEmpty())
+			Expect(wfSender.SendEventCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when there are older snapshots", func() {
+		BeforeEach(func() {
+			cfg.Cooldown = 0
+			Expect(os.MkdirAll(cfg.Directory, 0755)).To(Succeed())
+			for _, name := range []string{"garden-pprof-20200101T000000.000Z.tar.gz", "garden-pprof-20200102T000000.000Z.tar.gz", "unrelated.txt"} {
+				Expect(ioutil.WriteFile(filepath.Join(cfg.Directory, name), nil, 0644)).To(Succeed())
+			}
+
+			expired := filepath.Join(cfg.Directory, "garden-pprof-20200101T000000.000Z.tar.gz")
+			Expect(os.Chtimes(expired, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour))).To(Succeed())
+		})
+
+		snapshots := func() []string {
+			matches, err := filepath.Glob(filepath.Join(cfg.Directory, "garden-pprof-*"))
+			Expect(err).NotTo(HaveOccurred())
+			return matches
+		}
+
+		It("deletes the snapshots older than the retention", func() {
+			Expect(snapshots()).To(ConsistOf(
+				filepath.Join(cfg.Directory, "garden-pprof-20200102T000000.000Z.tar.gz"),
+				snapshot,
+			))
+			Expect(filepath.Join(cfg.Directory, "unrelated.txt")).To(BeAnExistingFile())
+		})
+
+		It("keeps only the newest snapshots", func() {
+			time.Sleep(2 * time.Millisecond)
+			newest, err := profiler.Check(series)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snapshots()).To(ConsistOf(snapshot, newest))
+		})
+	})
+
+	Context("when the debug server fails", func() {
+		BeforeEach(func() {
+			server.Config.Handler = http.NotFoundHandler()
+		})
+
+		It("returns an error and does not send an event", func() {
+			Expect(checkErr).To(MatchError(ContainSubstring("404")))
+			Expect(wfSender.SendEventCallCount()).To(Equal(0))
+		})
+	})
+})
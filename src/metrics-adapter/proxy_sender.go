@@ -0,0 +1,177 @@
+package metricsadapter
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const (
+	proxyDialTimeout  = 10 * time.Second
+	proxyWriteTimeout = 10 * time.Second
+)
+
+// proxySender is a wavefront.Sender for one Wavefront proxy that only writes
+// to it on Flush. The SDK's proxy sender also flushes on a ticker and when
+// its buffer is full, so what a FailoverSender has sent to it since the last
+// flush would not be what it lost when flushing fails. Like the SDK's, it
+// connects when it is sent to, so that sending to a proxy that is down
+// fails.
+type proxySender struct {
+	address       string
+	defaultSource string
+
+	mu       sync.Mutex
+	conn     net.Conn
+	buffer   bytes.Buffer
+	failures int64
+}
+
+func newProxySender(address string) (*proxySender, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "wavefront_proxy_sender"
+	}
+	return &proxySender{address: address, defaultSource: hostname}, nil
+}
+
+func (s *proxySender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	line, err := wavefront.MetricLine(name, value, ts, source, tags, s.defaultSource)
+	if err != nil {
+		return err
+	}
+	return s.write(line)
+}
+
+func (s *proxySender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	if name == "" {
+		return errors.New("empty metric name")
+	}
+	if value <= 0 {
+		return nil
+	}
+	if !strings.HasPrefix(name, deltaPrefix) {
+		name = deltaPrefix + name
+	}
+	return s.SendMetric(name, value, 0, source, tags)
+}
+
+func (s *proxySender) SendDistribution(name string, centroids []histogram.Centroid, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string) error {
+	line, err := wavefront.HistoLine(name, centroids, hgs, ts, source, tags, s.defaultSource)
+	if err != nil {
+		return err
+	}
+	return s.write(line)
+}
+
+func (s *proxySender) SendSpan(name string, startMillis, durationMillis int64, source, traceID, spanID string, parents, followsFrom []string, tags []wavefront.SpanTag, spanLogs []wavefront.SpanLog) error {
+	line, err := wavefront.SpanLine(name, startMillis, durationMillis, source, traceID, spanID, parents, followsFrom, tags, spanLogs, s.defaultSource)
+	if err != nil {
+		return err
+	}
+	if len(spanLogs) > 0 {
+		logs, err := wavefront.SpanLogJSON(traceID, spanID, spanLogs)
+		if err != nil {
+			return err
+		}
+		line += logs
+	}
+	return s.write(line)
+}
+
+func (s *proxySender) SendEvent(name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) error {
+	line, err := wavefront.EventLine(name, startMillis, endMillis, source, tags, setters...)
+	if err != nil {
+		return err
+	}
+	return s.write(line)
+}
+
+func (s *proxySender) write(line string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.connect(); err != nil {
+		return err
+	}
+	s.buffer.WriteString(line)
+	return nil
+}
+
+// Flush writes what was sent since the last flush to the proxy. What could
+// not be written is dropped, it is for the caller to send it again.
+func (s *proxySender) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buffer.Len() == 0 {
+		return nil
+	}
+	defer s.buffer.Reset()
+
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(proxyWriteTimeout))
+	if _, err := s.conn.Write(s.buffer.Bytes()); err != nil {
+		s.failures++
+		s.disconnect()
+		return err
+	}
+	return nil
+}
+
+func (s *proxySender) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", s.address, proxyDialTimeout)
+	if err != nil {
+		s.failures++
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *proxySender) disconnect() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *proxySender) GetFailureCount() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures
+}
+
+func (s *proxySender) Start() {}
+
+func (s *proxySender) Close() {
+	s.Flush()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnect()
+}
@@ -0,0 +1,240 @@
+package metricsadapter
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ResponseCollector is a collector that parses a single response it reads
+// from garden. Recording one keeps the raw response, which a replay parses
+// again, so that a change to the parsing can be tried on what was recorded.
+type ResponseCollector interface {
+	Collector
+	Fetch() ([]byte, error)
+	Parse(response []byte) (Series, error)
+}
+
+// Recording is what a collector returned from one call to Collect: the raw
+// response of a ResponseCollector, or the series of any other collector.
+type Recording struct {
+	Time      time.Time `json:"time"`
+	Collector string    `json:"collector"`
+	Response  []byte    `json:"response,omitempty"`
+	Series    Series    `json:"series"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Recorder saves the responses of collectors to an archive of gzipped JSON
+// lines, one recording per line, so that they can be replayed later.
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	gz      *gzip.Writer
+	encoder *json.Encoder
+}
+
+// NewRecorder creates the archive at path, replacing any existing file.
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(file)
+	return &Recorder{file: file, gz: gz, encoder: json.NewEncoder(gz)}, nil
+}
+
+// Wrap returns a collector that records every response of the given one
+// under the given name. It is a ResponseSizer when the given one is.
+func (r *Recorder) Wrap(name string, collector Collector) Collector {
+	var wrapped Collector
+	if responseCollector, ok := collector.(ResponseCollector); ok {
+		wrapped = CollectorFunc(func() (Series, error) {
+			response, err := responseCollector.Fetch()
+
+			recording := Recording{Time: time.Now(), Collector: name, Response: response}
+			if err != nil {
+				recording.Error = err.Error()
+			}
+			if recordErr := r.record(recording); recordErr != nil {
+				return Series{}, recordErr
+			}
+
+			if err != nil {
+				return Series{}, err
+			}
+			return responseCollector.Parse(response)
+		})
+	} else {
+		wrapped = CollectorFunc(func() (Series, error) {
+			series, err := collector.Collect()
+
+			recording := Recording{Time: time.Now(), Collector: name, Series: series}
+			if err != nil {
+				recording.Error = err.Error()
+			}
+			if recordErr := r.record(recording); recordErr != nil {
+				return series, recordErr
+			}
+
+			return series, err
+		})
+	}
+
+	if sizer, ok := collector.(ResponseSizer); ok {
+		return sizedCollector{Collector: wrapped, ResponseSizer: sizer}
+	}
+	return wrapped
+}
+
+func (r *Recorder) record(recording Recording) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.encoder.Encode(recording); err != nil {
+		return err
+	}
+
+	// keep the archive readable up to the last recording if we are killed
+	return r.gz.Flush()
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.gz.Close(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// Replay reads an archive written by a Recorder and calls emit once per
+// recorded poll with the recordings of the poll, which ReplayCollector turns
+// back into collectors so that they go through the same pipeline as live
+// ones. A poll ends when a collector is recorded again. The polls are
+// replayed at the pace they were recorded, sped up by speed, or as fast as
+// possible when speed is 0.
+func Replay(archive io.Reader, speed float64, emit func([]Recording) error) error {
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	var (
+		poll     []Recording
+		seen     = map[string]bool{}
+		lastPoll time.Time
+	)
+
+	flush := func() error {
+		if len(poll) == 0 {
+			return nil
+		}
+		if speed > 0 && !lastPoll.IsZero() {
+			time.Sleep(time.Duration(float64(poll[0].Time.Sub(lastPoll)) / speed))
+		}
+		lastPoll = poll[0].Time
+
+		err := emit(poll)
+		poll, seen = nil, map[string]bool{}
+		return err
+	}
+
+	decoder := json.NewDecoder(gz)
+	for {
+		var recording Recording
+		err := decoder.Decode(&recording)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// an archive that was not closed ends with a partial recording
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if seen[recording.Collector] {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		seen[recording.Collector] = true
+		poll = append(poll, recording)
+	}
+
+	return flush()
+}
+
+// ReplayCollector returns a collector that returns what was recorded. A
+// recorded response is parsed by collector, which must be a ResponseCollector
+// like the one that read it, and the series parsed from it are stamped with
+// the time it was recorded at; the recorded series are returned as they are
+// otherwise, and keep their recorded timestamps. Scrape stamps the health of
+// either with the time of the recording as well, so that a replay is on the
+// clock of the recording only.
+func ReplayCollector(recording Recording, collector Collector) Collector {
+	responseCollector, ok := collector.(ResponseCollector)
+	if !ok {
+		return replayedSeries{recording: recording}
+	}
+
+	return replayedResponse{recording: recording, parser: responseCollector}
+}
+
+// replayed is a collector that returns what was recorded at a time.
+type replayed interface {
+	recordedAt() time.Time
+}
+
+// replayedSeries returns recorded series.
+type replayedSeries struct {
+	recording Recording
+}
+
+func (r replayedSeries) Collect() (Series, error) {
+	if r.recording.Error != "" {
+		return r.recording.Series, errors.New(r.recording.Error)
+	}
+	return r.recording.Series, nil
+}
+
+func (r replayedSeries) recordedAt() time.Time {
+	return r.recording.Time
+}
+
+// replayedResponse parses a recorded response again.
+type replayedResponse struct {
+	recording Recording
+	parser    ResponseCollector
+}
+
+func (r replayedResponse) Collect() (Series, error) {
+	if r.recording.Error != "" {
+		return Series{}, errors.New(r.recording.Error)
+	}
+
+	series, err := r.parser.Parse(r.recording.Response)
+	timestamp := float64(r.recording.Time.Unix())
+	for _, metric := range series.Series {
+		for i := range metric.Points {
+			metric.Points[i][0] = timestamp
+		}
+	}
+	return series, err
+}
+
+func (r replayedResponse) recordedAt() time.Time {
+	return r.recording.Time
+}
+
+func (r replayedResponse) LastResponseBytes() int64 {
+	return int64(len(r.recording.Response))
+}
@@ -0,0 +1,235 @@
+package metricsadapter_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Recorder", func() {
+	var (
+		dir      string
+		path     string
+		recorder *metricsadapter.Recorder
+		replayed map[string]metricsadapter.Collector
+		polls    [][]metricsadapter.Series
+		errs     [][]error
+	)
+
+	replay := func(speed float64) error {
+		archive, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer archive.Close()
+
+		polls, errs = nil, nil
+		return metricsadapter.Replay(archive, speed, func(recordings []metricsadapter.Recording) error {
+			var (
+				pollSeries []metricsadapter.Series
+				pollErrs   []error
+			)
+			for _, recording := range recordings {
+				s, err := metricsadapter.ReplayCollector(recording, replayed[recording.Collector]).Collect()
+				pollSeries = append(pollSeries, s)
+				pollErrs = append(pollErrs, err)
+			}
+			polls = append(polls, pollSeries)
+			errs = append(errs, pollErrs)
+			return nil
+		})
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "record")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "archive.gz")
+
+		recorder, err = metricsadapter.NewRecorder(path)
+		Expect(err).NotTo(HaveOccurred())
+		replayed = map[string]metricsadapter.Collector{}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	Context("when collectors are recorded", func() {
+		var (
+			server *ghttp.Server
+			host   metricsadapter.Series
+		)
+
+		BeforeEach(func() {
+			server = ghttp.NewServer()
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, `{"numGoroutines": 1}`),
+				ghttp.RespondWith(http.StatusOK, `{"numGoroutines": 2}`),
+			)
+
+			host = metricsadapter.Series{Series: metricsadapter.Metrics{{
+				Metric: "host.cpu.load1",
+				Points: metricsadapter.MetricPoints{{1589299485, 1}},
+				Host:   "cactus",
+				Tags:   []string{"handle:h"},
+			}}}
+			calls := 0
+
+			debug := recorder.Wrap("garden-debug", metricsadapter.NewDebugCollector("cactus", server.URL()))
+			hostCollector := recorder.Wrap("host", metricsadapter.CollectorFunc(func() (metricsadapter.Series, error) {
+				calls++
+				if calls == 2 {
+					return metricsadapter.Series{}, errors.New("no procfs")
+				}
+				return host, nil
+			}))
+
+			for i := 0; i < 2; i++ {
+				_, err := metricsadapter.CollectAll(debug, hostCollector)
+				if i == 0 {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(err).To(MatchError("collecting metrics: no procfs"))
+				}
+			}
+
+			replayed["garden-debug"] = metricsadapter.NewDebugCollector("replayed", "http://127.0.0.1:1")
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("keeps the raw responses of the collectors that read one", func() {
+			Expect(recorder.Close()).To(Succeed())
+
+			archive, err := os.Open(path)
+			Expect(err).NotTo(HaveOccurred())
+			defer archive.Close()
+
+			var responses []string
+			Expect(metricsadapter.Replay(archive, 0, func(recordings []metricsadapter.Recording) error {
+				responses = append(responses, string(recordings[0].Response))
+				return nil
+			})).To(Succeed())
+			Expect(responses).To(Equal([]string{`{"numGoroutines": 1}`, `{"numGoroutines": 2}`}))
+		})
+
+		It("replays them poll by poll, parsing the responses again", func() {
+			Expect(recorder.Close()).To(Succeed())
+			Expect(replay(0)).To(Succeed())
+
+			Expect(polls).To(HaveLen(2))
+			for i, poll := range polls {
+				Expect(poll[0].Series[0].Metric).To(Equal("garden.numGoroutines"))
+				Expect(poll[0].Series[0].Points[0][1]).To(Equal(float64(i + 1)))
+				Expect(poll[0].Series[0].Host).To(Equal("replayed"))
+			}
+
+			Expect(polls[0][1]).To(Equal(host))
+			Expect(errs[1][0]).NotTo(HaveOccurred())
+			Expect(errs[1][1]).To(MatchError("no procfs"))
+		})
+
+		It("tells the size of the replayed responses", func() {
+			Expect(recorder.Close()).To(Succeed())
+
+			archive, err := os.Open(path)
+			Expect(err).NotTo(HaveOccurred())
+			defer archive.Close()
+
+			Expect(metricsadapter.Replay(archive, 0, func(recordings []metricsadapter.Recording) error {
+				sizer, ok := metricsadapter.ReplayCollector(recordings[0], replayed["garden-debug"]).(metricsadapter.ResponseSizer)
+				Expect(ok).To(BeTrue())
+				Expect(sizer.LastResponseBytes()).To(BeEquivalentTo(len(recordings[0].Response)))
+				return nil
+			})).To(Succeed())
+		})
+
+		It("can replay an archive that was not closed", func() {
+			Expect(replay(0)).To(Succeed())
+			Expect(polls).To(HaveLen(2))
+		})
+	})
+
+	Describe("ReplayCollector", func() {
+		var recordedAt time.Time
+
+		BeforeEach(func() {
+			Expect(recorder.Close()).To(Succeed())
+			recordedAt = time.Date(2020, 5, 12, 16, 0, 0, 0, time.UTC)
+		})
+
+		It("stamps what it returns, and the health of the target, with the time of the recording", func() {
+			response := metricsadapter.Recording{Time: recordedAt, Collector: "garden-debug", Response: []byte(`{"numGoroutines": 1}`)}
+			series := metricsadapter.Recording{Time: recordedAt, Collector: "host", Series: metricsadapter.Series{Series: metricsadapter.Metrics{{
+				Metric: "host.cpu.load1",
+				Points: metricsadapter.MetricPoints{{float64(recordedAt.Unix()), 1}},
+				Host:   "cactus",
+			}}}}
+
+			for _, collector := range []metricsadapter.Collector{
+				metricsadapter.ReplayCollector(response, metricsadapter.NewDebugCollector("cactus", "http://127.0.0.1:1")),
+				metricsadapter.ReplayCollector(series, nil),
+			} {
+				scraped, err := metricsadapter.Scrape("cactus", "replayed", collector)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(scraped.Series)).To(BeNumerically(">", 3))
+				for _, metric := range scraped.Series {
+					Expect(metric.Points[0][0]).To(Equal(float64(recordedAt.Unix())), metric.Metric)
+				}
+			}
+		})
+	})
+
+	Describe("Replay", func() {
+		BeforeEach(func() {
+			Expect(recorder.Close()).To(Succeed())
+
+			var buffer bytes.Buffer
+			gz := gzip.NewWriter(&buffer)
+			_, err := gz.Write([]byte(`{"time":"2020-05-12T16:00:00Z","collector":"garden-debug","series":{"series":[]}}
+{"time":"2020-05-12T16:00:01Z","collector":"garden-debug","series":{"series":[]}}
+{"time":"2020-05-12T16:00:02Z","collector":"garden-debug","series":{"series":[]}}
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gz.Close()).To(Succeed())
+			Expect(ioutil.WriteFile(path, buffer.Bytes(), 0644)).To(Succeed())
+		})
+
+		It("keeps the pace of the recording, sped up", func() {
+			start := time.Now()
+			Expect(replay(10)).To(Succeed())
+			Expect(polls).To(HaveLen(3))
+			Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+
+		It("returns the error of emit", func() {
+			archive, err := os.Open(path)
+			Expect(err).NotTo(HaveOccurred())
+			defer archive.Close()
+
+			Expect(metricsadapter.Replay(archive, 0, func([]metricsadapter.Recording) error {
+				return errors.New("emit-error")
+			})).To(MatchError("emit-error"))
+		})
+	})
+
+	Context("when the archive is not gzipped", func() {
+		It("returns an error", func() {
+			Expect(recorder.Close()).To(Succeed())
+			Expect(ioutil.WriteFile(path, []byte("{}"), 0644)).To(Succeed())
+			Expect(replay(0)).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,55 @@
+package metricsadapter
+
+import (
+	"sync"
+	"time"
+)
+
+// ReloadStatus keeps track of the reloads of the config. It is a Collector of
+//
+//   - metrics_adapter.config.reloads: reloads, tagged with result:success or
+//     result:failure
+//   - metrics_adapter.config.last_reload_successful: 0 from a failed reload
+//     until the next one succeeds, while the previous config keeps running
+type ReloadStatus struct {
+	host string
+
+	mu        sync.Mutex
+	successes int64
+	failures  int64
+	lastErr   error
+}
+
+func NewReloadStatus(host string) *ReloadStatus {
+	return &ReloadStatus{host: host}
+}
+
+func (r *ReloadStatus) Succeeded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.successes++
+	r.lastErr = nil
+}
+
+func (r *ReloadStatus) Failed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures++
+	r.lastErr = err
+}
+
+func (r *ReloadStatus) Collect() (Series, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	successful := 1.0
+	if r.lastErr != nil {
+		successful = 0
+	}
+
+	s := &sample{timestamp: time.Now().Unix(), host: r.host}
+	s.add("metrics_adapter.config.reloads", float64(r.successes), "result:success")
+	s.add("metrics_adapter.config.reloads", float64(r.failures), "result:failure")
+	s.add("metrics_adapter.config.last_reload_successful", successful)
+	return Series{Series: s.metrics}, nil
+}
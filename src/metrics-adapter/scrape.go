@@ -0,0 +1,58 @@
+package metricsadapter
+
+import "time"
+
+const upMetric = "metrics_adapter.up"
+
+// ResponseSizer is a collector that reads a response from garden, and tells
+// the size of the last one it read.
+type ResponseSizer interface {
+	LastResponseBytes() int64
+}
+
+// Scrape collects from the collector of a target, and adds the health of the
+// target to what it collected, even when collecting fails:
+//
+//   - metrics_adapter.up: 1 when collecting succeeded, 0 when it failed
+//   - metrics_adapter.scrape_duration_seconds: how long collecting took
+//   - metrics_adapter.scrape_response_bytes: size of the response read, for
+//     collectors that are ResponseSizers
+//   - metrics_adapter.series_count: number of series collected
+//
+// all tagged target:<target>, at the time collecting started, or the time
+// what a replayed collector returns was recorded at. The series of a
+// collector that fails are dropped, only its health is returned.
+func Scrape(host, target string, collector Collector) (Series, error) {
+	started := time.Now()
+	series, err := collector.Collect()
+	duration := time.Since(started)
+
+	if r, ok := collector.(replayed); ok {
+		started = r.recordedAt()
+	}
+
+	up := 1.0
+	if err != nil {
+		up = 0
+		series = Series{}
+	}
+
+	tag := "target:" + target
+	s := &sample{timestamp: started.Unix(), host: host}
+	s.add(upMetric, up, tag)
+	s.add("metrics_adapter.scrape_duration_seconds", duration.Seconds(), tag)
+	if sizer, ok := collector.(ResponseSizer); ok {
+		s.add("metrics_adapter.scrape_response_bytes", float64(sizer.LastResponseBytes()), tag)
+	}
+	s.add("metrics_adapter.series_count", float64(len(series.Series)), tag)
+
+	series.Series = append(series.Series, s.metrics...)
+	return series, err
+}
+
+// sizedCollector keeps the size of the responses of a collector that is
+// wrapped by another one.
+type sizedCollector struct {
+	Collector
+	ResponseSizer
+}
@@ -0,0 +1,91 @@
+package metricsadapter_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Scrape", func() {
+	var server *ghttp.Server
+
+	values := func(series metricsadapter.Series) map[string]float64 {
+		values := map[string]float64{}
+		for _, m := range series.Series {
+			values[m.Metric] = m.Points[0][1]
+		}
+		return values
+	}
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		server.AppendHandlers(ghttp.RespondWith(http.StatusOK, `{"numGoRoutines": 19}`))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("adds the health of the target to what the collector collected", func() {
+		series, err := metricsadapter.Scrape("cactus", "garden-debug", metricsadapter.NewDebugCollector("cactus", server.URL()))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(series.Series).To(HaveLen(6))
+		for _, m := range series.Series[2:] {
+			Expect(m.Host).To(Equal("cactus"))
+			Expect(m.Tags).To(Equal([]string{"target:garden-debug"}))
+		}
+
+		Expect(values(series)).To(HaveKeyWithValue("garden.numGoroutines", 19.0))
+		Expect(values(series)).To(HaveKeyWithValue("metrics_adapter.up", 1.0))
+		Expect(values(series)).To(HaveKeyWithValue("metrics_adapter.scrape_response_bytes", float64(len(`{"numGoRoutines": 19}`))))
+		Expect(values(series)).To(HaveKeyWithValue("metrics_adapter.series_count", 2.0))
+		Expect(values(series)).To(HaveKey("metrics_adapter.scrape_duration_seconds"))
+	})
+
+	It("keeps the response size of a recorded collector", func() {
+		dir, err := ioutil.TempDir("", "recording")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		recorder, err := metricsadapter.NewRecorder(filepath.Join(dir, "recording.gz"))
+		Expect(err).NotTo(HaveOccurred())
+		defer recorder.Close()
+
+		series, err := metricsadapter.Scrape("cactus", "garden-debug", recorder.Wrap("garden-debug", metricsadapter.NewDebugCollector("cactus", server.URL())))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(values(series)).To(HaveKey("metrics_adapter.scrape_response_bytes"))
+	})
+
+	Context("when collecting fails", func() {
+		It("returns the error with the target down and no series", func() {
+			series, err := metricsadapter.Scrape("cactus", "cgroup", metricsadapter.CollectorFunc(func() (metricsadapter.Series, error) {
+				return metricsadapter.Series{Series: metricsadapter.Metrics{{Metric: "cgroup.partial"}}}, errors.New("no cgroups")
+			}))
+			Expect(err).To(MatchError("no cgroups"))
+
+			Expect(values(series)).To(Equal(map[string]float64{
+				"metrics_adapter.up":                      0,
+				"metrics_adapter.scrape_duration_seconds": values(series)["metrics_adapter.scrape_duration_seconds"],
+				"metrics_adapter.series_count":            0,
+			}))
+		})
+
+		It("reports the size of what garden's debug server responded, none when it is down", func() {
+			url := server.URL()
+			server.Close()
+
+			series, err := metricsadapter.Scrape("cactus", "garden-debug", metricsadapter.NewDebugCollector("cactus", url))
+			Expect(err).To(HaveOccurred())
+			Expect(values(series)).To(HaveKeyWithValue("metrics_adapter.up", 0.0))
+			Expect(values(series)).To(HaveKeyWithValue("metrics_adapter.scrape_response_bytes", 0.0))
+		})
+	})
+})
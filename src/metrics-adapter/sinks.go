@@ -0,0 +1,65 @@
+package metricsadapter
+
+import (
+	"errors"
+	"os"
+
+	"code.cloudfoundry.org/lager"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const (
+	SinkWavefront   = "wavefront"
+	SinkStdout      = "stdout"
+	SinkFile        = "file"
+	SinkGraphite    = "graphite"
+	SinkInfluxDB    = "influxdb"
+	SinkOTLP        = "otlp"
+	SinkLoggregator = "loggregator"
+)
+
+// NewSink returns the sender for a sink.
+func NewSink(logger lager.Logger, cfg SinkConfig) (wavefront.Sender, error) {
+	switch cfg.Type {
+	case SinkWavefront:
+		if len(cfg.Endpoints) > 0 {
+			return NewFailoverSender(logger, cfg)
+		}
+		return NewWavefrontProxySender(cfg.Port)
+	case SinkStdout:
+		return NewWriterSender(os.Stdout, cfg.Format)
+	case SinkFile:
+		file, err := NewRotatingFile(cfg.Path, cfg.MaxSize, cfg.MaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		return NewWriterSender(file, cfg.Format)
+	case SinkGraphite:
+		return NewGraphiteSender(cfg)
+	case SinkInfluxDB:
+		return NewInfluxSender(cfg)
+	case SinkOTLP:
+		return NewOTLPSender(cfg)
+	case SinkLoggregator:
+		return NewLoggregatorSender(cfg)
+	default:
+		return nil, errors.New("unknown sink type " + cfg.Type)
+	}
+}
+
+// NewWavefrontProxySender returns a sender for the Wavefront proxy listening on
+// port on this host, which accepts metrics, distributions, spans and events on
+// the same port.
+func NewWavefrontProxySender(port int) (wavefront.Sender, error) {
+	if port == 0 {
+		return nil, errors.New("wavefront proxy port must be set")
+	}
+
+	return wavefront.NewProxySender(&wavefront.ProxyConfiguration{
+		Host:             "localhost",
+		MetricsPort:      port,
+		DistributionPort: port,
+		EventsPort:       port,
+		TracingPort:      port,
+	})
+}
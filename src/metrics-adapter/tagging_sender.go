@@ -0,0 +1,81 @@
+package metricsadapter
+
+import (
+	"sync"
+
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+// TaggingSender adds tags to everything it sends before passing it on. The
+// tags of what is sent win over the added tags with the same key.
+type TaggingSender struct {
+	wavefront.Sender
+
+	mu   sync.RWMutex
+	tags map[string]string
+}
+
+func NewTaggingSender(sender wavefront.Sender, tags map[string]string) *TaggingSender {
+	return &TaggingSender{Sender: sender, tags: tags}
+}
+
+// SetTags replaces the tags added from now on.
+func (t *TaggingSender) SetTags(tags map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tags = tags
+}
+
+func (t *TaggingSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	return t.Sender.SendMetric(name, value, ts, source, t.tagged(tags))
+}
+
+func (t *TaggingSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	return t.Sender.SendDeltaCounter(name, value, source, t.tagged(tags))
+}
+
+func (t *TaggingSender) SendDistribution(name string, centroids []histogram.Centroid, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string) error {
+	return t.Sender.SendDistribution(name, centroids, hgs, ts, source, t.tagged(tags))
+}
+
+func (t *TaggingSender) SendSpan(name string, startMillis, durationMillis int64, source, traceID, spanID string, parents, followsFrom []string, tags []wavefront.SpanTag, spanLogs []wavefront.SpanLog) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	has := map[string]bool{}
+	for _, tag := range tags {
+		has[tag.Key] = true
+	}
+	spanTags := append([]wavefront.SpanTag{}, tags...)
+	for key, value := range t.tags {
+		if !has[key] {
+			spanTags = append(spanTags, wavefront.SpanTag{Key: key, Value: value})
+		}
+	}
+
+	return t.Sender.SendSpan(name, startMillis, durationMillis, source, traceID, spanID, parents, followsFrom, spanTags, spanLogs)
+}
+
+func (t *TaggingSender) SendEvent(name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) error {
+	return t.Sender.SendEvent(name, startMillis, endMillis, source, t.tagged(tags), setters...)
+}
+
+func (t *TaggingSender) tagged(tags map[string]string) map[string]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if len(t.tags) == 0 {
+		return tags
+	}
+
+	merged := make(map[string]string, len(t.tags)+len(tags))
+	for key, value := range t.tags {
+		merged[key] = value
+	}
+	for key, value := range tags {
+		merged[key] = value
+	}
+	return merged
+}
@@ -0,0 +1,46 @@
+package metricsadapter_test
+
+import (
+	"github.com/masters-of-cats/metricsadapter"
+	fakes "github.com/masters-of-cats/metricsadapter/metrics-adapterfakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+var _ = Describe("TaggingSender", func() {
+	var (
+		fakeSender *fakes.FakeSender
+		sender     *metricsadapter.TaggingSender
+	)
+
+	BeforeEach(func() {
+		fakeSender = new(fakes.FakeSender)
+		sender = metricsadapter.NewTaggingSender(fakeSender, map[string]string{"deployment": "cf", "az": "z1"})
+	})
+
+	It("adds its tags under the tags of what is sent", func() {
+		Expect(sender.SendMetric("garden.memory", 1, 1000, "cactus", map[string]string{"az": "z3", "handle": "h"})).To(Succeed())
+
+		_, _, _, _, tags := fakeSender.SendMetricArgsForCall(0)
+		Expect(tags).To(Equal(map[string]string{"deployment": "cf", "az": "z3", "handle": "h"}))
+	})
+
+	It("adds its tags to spans", func() {
+		Expect(sender.SendSpan("create", 0, 1, "cactus", "t", "s", nil, nil, []wavefront.SpanTag{{Key: "az", Value: "z3"}}, nil)).To(Succeed())
+
+		_, _, _, _, _, _, _, _, tags, _ := fakeSender.SendSpanArgsForCall(0)
+		Expect(tags).To(ConsistOf(
+			wavefront.SpanTag{Key: "az", Value: "z3"},
+			wavefront.SpanTag{Key: "deployment", Value: "cf"},
+		))
+	})
+
+	It("adds the tags it is given from then on", func() {
+		sender.SetTags(map[string]string{"team": "garden"})
+		Expect(sender.SendDeltaCounter("garden.oom", 1, "cactus", nil)).To(Succeed())
+
+		_, _, _, tags := fakeSender.SendDeltaCounterArgsForCall(0)
+		Expect(tags).To(Equal(map[string]string{"team": "garden"}))
+	})
+})
@@ -0,0 +1,315 @@
+package metricsadapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+const (
+	FormatWavefront = "wavefront"
+	FormatSeries    = "series"
+	FormatNDJSON    = "ndjson"
+
+	// the prefix the Wavefront SDK gives delta counters
+	deltaPrefix = "∆"
+)
+
+// WriterSender is a wavefront.Sender that writes what it is sent instead of
+// sending it, to see what the adapter would emit. It writes in one of three
+// formats:
+//
+//   - wavefront: the line format the Wavefront proxy accepts
+//   - series: the Series JSON this adapter started out with, one object per
+//     flush; it only has room for metrics, so distributions, spans and events
+//     are left out
+//   - ndjson: one JSON object per metric, distribution, span or event
+type WriterSender struct {
+	format string
+
+	mu       sync.Mutex
+	out      io.Writer
+	series   Series
+	failures int64
+}
+
+func NewWriterSender(out io.Writer, format string) (*WriterSender, error) {
+	switch format {
+	case FormatWavefront, FormatSeries, FormatNDJSON:
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	return &WriterSender{format: format, out: out}, nil
+}
+
+func (s *WriterSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	switch s.format {
+	case FormatWavefront:
+		line, err := wavefront.MetricLine(name, value, ts, source, tags, "")
+		if err != nil {
+			return err
+		}
+		return s.write(line)
+	case FormatSeries:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.series.Series = append(s.series.Series, newMetric(name, ts, value, source, tagList(tags)...))
+		return nil
+	default:
+		return s.writeJSON(map[string]interface{}{
+			"type": "metric", "name": name, "value": value, "timestamp": ts, "source": source, "tags": tags,
+		})
+	}
+}
+
+func (s *WriterSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	if !strings.HasPrefix(name, deltaPrefix) {
+		name = deltaPrefix + name
+	}
+	if value <= 0 {
+		return nil
+	}
+	return s.SendMetric(name, value, 0, source, tags)
+}
+
+func (s *WriterSender) SendDistribution(name string, centroids []histogram.Centroid, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string) error {
+	switch s.format {
+	case FormatWavefront:
+		line, err := wavefront.HistoLine(name, centroids, hgs, ts, source, tags, "")
+		if err != nil {
+			return err
+		}
+		return s.write(line)
+	case FormatSeries:
+		return nil
+	default:
+		var granularities []string
+		for hg := range hgs {
+			granularities = append(granularities, hg.String())
+		}
+		sort.Strings(granularities)
+
+		return s.writeJSON(map[string]interface{}{
+			"type": "distribution", "name": name, "centroids": centroids, "granularities": granularities,
+			"timestamp": ts, "source": source, "tags": tags,
+		})
+	}
+}
+
+func (s *WriterSender) SendSpan(name string, startMillis, durationMillis int64, source, traceID, spanID string, parents, followsFrom []string, tags []wavefront.SpanTag, spanLogs []wavefront.SpanLog) error {
+	switch s.format {
+	case FormatWavefront:
+		line, err := wavefront.SpanLine(name, startMillis, durationMillis, source, traceID, spanID, parents, followsFrom, tags, spanLogs, "")
+		if err != nil {
+			return err
+		}
+		if len(spanLogs) > 0 {
+			logs, err := wavefront.SpanLogJSON(traceID, spanID, spanLogs)
+			if err != nil {
+				return err
+			}
+			line += logs + "\n"
+		}
+		return s.write(line)
+	case FormatSeries:
+		return nil
+	default:
+		return s.writeJSON(map[string]interface{}{
+			"type": "span", "name": name, "start": startMillis, "duration": durationMillis, "source": source,
+			"traceId": traceID, "spanId": spanID, "parents": parents, "followsFrom": followsFrom,
+			"tags": tags, "logs": spanLogs,
+		})
+	}
+}
+
+func (s *WriterSender) SendEvent(name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) error {
+	switch s.format {
+	case FormatWavefront:
+		line, err := wavefront.EventLine(name, startMillis, endMillis, source, tags, setters...)
+		if err != nil {
+			return err
+		}
+		return s.write(line)
+	case FormatSeries:
+		return nil
+	default:
+		annotations := map[string]string{}
+		for _, set := range setters {
+			set(map[string]interface{}{"annotations": annotations})
+		}
+
+		return s.writeJSON(map[string]interface{}{
+			"type": "event", "name": name, "start": startMillis, "end": endMillis, "source": source,
+			"tags": tags, "annotations": annotations,
+		})
+	}
+}
+
+// Flush writes the metrics sent since the last flush in the series format;
+// the other formats are written as they are sent.
+func (s *WriterSender) Flush() error {
+	if s.format != FormatSeries {
+		return nil
+	}
+
+	s.mu.Lock()
+	series := s.series
+	s.series = Series{}
+	s.mu.Unlock()
+
+	if len(series.Series) == 0 {
+		return nil
+	}
+	return s.writeJSON(series)
+}
+
+func (s *WriterSender) GetFailureCount() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures
+}
+
+// Start is a no-op, the writer sender has no background flushing.
+func (s *WriterSender) Start() {}
+
+func (s *WriterSender) Close() {
+	s.Flush()
+
+	if closer, ok := s.out.(io.Closer); ok && s.out != os.Stdout {
+		closer.Close()
+	}
+}
+
+func (s *WriterSender) writeJSON(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.write(string(line) + "\n")
+}
+
+func (s *WriterSender) write(line string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := io.WriteString(s.out, line); err != nil {
+		s.failures++
+		return err
+	}
+	return nil
+}
+
+// tagList converts tags back to the key:value strings of Series.
+func tagList(tags map[string]string) []string {
+	list := make([]string, 0, len(tags))
+	for key, value := range tags {
+		list = append(list, key+":"+value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// RotatingFile is a file that is rotated like logrotate would, when writing
+// to it would make it larger than maxSize: path.1 becomes path.2 and so on,
+// path becomes path.1, and only maxFiles rotated files are kept. When the
+// rotation fails, path is opened again and the next write rotates again.
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewRotatingFile(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err == nil {
+		err = f.shift()
+	}
+
+	// whether the rotation failed or not, the writes go on to path
+	if openErr := f.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// shift renames path and the rotated files one up, dropping the oldest.
+func (f *RotatingFile) shift() error {
+	if f.maxFiles == 0 {
+		return os.Remove(f.path)
+	}
+
+	for i := f.maxFiles - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.path+".1")
+}
@@ -0,0 +1,190 @@
+package metricsadapter_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/masters-of-cats/metricsadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+)
+
+var _ = Describe("WriterSender", func() {
+	var (
+		out    *bytes.Buffer
+		format string
+		sender *metricsadapter.WriterSender
+	)
+
+	BeforeEach(func() {
+		out = new(bytes.Buffer)
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		sender, err = metricsadapter.NewWriterSender(out, format)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	sendAll := func() {
+		Expect(sender.SendMetric("garden.memory", 42, 1589299485, "cactus", map[string]string{"handle": "h"})).To(Succeed())
+		Expect(sender.SendDeltaCounter("garden.container.oom_kills", 1, "cactus", map[string]string{})).To(Succeed())
+		Expect(sender.SendDistribution("garden.log.duration", []histogram.Centroid{{Value: 0.5, Count: 2}},
+			map[histogram.Granularity]bool{histogram.MINUTE: true}, 1589299485, "cactus", map[string]string{"operation": "create"})).To(Succeed())
+		Expect(sender.SendEvent("garden canary failed", 1589299485000, 0, "cactus", map[string]string{"phase": "run"}, event.Severity("warn"))).To(Succeed())
+		Expect(sender.Flush()).To(Succeed())
+	}
+
+	Context("in the wavefront format", func() {
+		BeforeEach(func() {
+			format = metricsadapter.FormatWavefront
+		})
+
+		It("writes the lines the proxy accepts", func() {
+			sendAll()
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			Expect(lines).To(HaveLen(4))
+			Expect(lines[0]).To(Equal(`"garden.memory" 42 1589299485 source="cactus" "handle"="h"`))
+			Expect(lines[1]).To(Equal(`"∆garden.container.oom_kills" 1 source="cactus"`))
+			Expect(lines[2]).To(Equal(`!M 1589299485 #2 0.5 "garden.log.duration" source="cactus" "operation"="create"`))
+			Expect(lines[3]).To(HavePrefix(`@Event 1589299485000 1589299485001 "garden canary failed" severity="warn" host="cactus"`))
+		})
+	})
+
+	Context("in the series format", func() {
+		BeforeEach(func() {
+			format = metricsadapter.FormatSeries
+		})
+
+		It("writes the metrics of every flush as one Series object", func() {
+			sendAll()
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			Expect(lines).To(HaveLen(1))
+
+			var series metricsadapter.Series
+			Expect(json.Unmarshal([]byte(lines[0]), &series)).To(Succeed())
+			Expect(series.Series).To(Equal(metricsadapter.Metrics{
+				{Metric: "garden.memory", Points: metricsadapter.MetricPoints{{1589299485, 42}}, Host: "cactus", Tags: []string{"handle:h"}},
+				{Metric: "∆garden.container.oom_kills", Points: metricsadapter.MetricPoints{{0, 1}}, Host: "cactus", Tags: []string{}},
+			}))
+		})
+
+		It("writes nothing when nothing was sent", func() {
+			Expect(sender.Flush()).To(Succeed())
+			Expect(out.Len()).To(BeZero())
+		})
+	})
+
+	Context("in the ndjson format", func() {
+		BeforeEach(func() {
+			format = metricsadapter.FormatNDJSON
+		})
+
+		It("writes an object per point", func() {
+			sendAll()
+			var objects []map[string]interface{}
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				var object map[string]interface{}
+				Expect(json.Unmarshal([]byte(line), &object)).To(Succeed())
+				objects = append(objects, object)
+			}
+
+			Expect(objects).To(HaveLen(4))
+			Expect(objects[0]).To(Equal(map[string]interface{}{
+				"type": "metric", "name": "garden.memory", "value": 42.0, "timestamp": 1589299485.0,
+				"source": "cactus", "tags": map[string]interface{}{"handle": "h"},
+			}))
+			Expect(objects[2]).To(HaveKeyWithValue("type", "distribution"))
+			Expect(objects[2]).To(HaveKeyWithValue("granularities", []interface{}{"!M"}))
+			Expect(objects[3]).To(HaveKeyWithValue("type", "event"))
+			Expect(objects[3]).To(HaveKeyWithValue("annotations", map[string]interface{}{"severity": "warn"}))
+		})
+	})
+
+	Context("with an unknown format", func() {
+		It("returns an error", func() {
+			_, err := metricsadapter.NewWriterSender(out, "xml")
+			Expect(err).To(MatchError(`unknown format "xml"`))
+		})
+	})
+})
+
+var _ = Describe("RotatingFile", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "rotating")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "metrics.log")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	contents := func(path string) string {
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		return string(contents)
+	}
+
+	It("rotates the file when it would grow beyond the maximum size", func() {
+		file, err := metricsadapter.NewRotatingFile(path, 10, 2)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+
+		for _, line := range []string{"line-1\n", "line-2\n", "line-3\n", "line-4\n"} {
+			_, err := file.Write([]byte(line))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Expect(contents(path)).To(Equal("line-4\n"))
+		Expect(contents(path + ".1")).To(Equal("line-3\n"))
+		Expect(contents(path + ".2")).To(Equal("line-2\n"))
+		Expect(path + ".3").NotTo(BeAnExistingFile())
+	})
+
+	Context("when the rotation fails", func() {
+		It("keeps writing to the file and rotates it with the next write", func() {
+			// a rotated file that is a directory fails the rename
+			Expect(os.MkdirAll(filepath.Join(path+".1", "dir"), 0755)).To(Succeed())
+
+			file, err := metricsadapter.NewRotatingFile(path, 10, 1)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			_, err = file.Write([]byte("line-1\n"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = file.Write([]byte("line-2\n"))
+			Expect(err).To(HaveOccurred())
+
+			Expect(os.RemoveAll(path + ".1")).To(Succeed())
+			_, err = file.Write([]byte("line-3\n"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(contents(path)).To(Equal("line-3\n"))
+			Expect(contents(path + ".1")).To(Equal("line-1\n"))
+		})
+	})
+
+	It("appends to an existing file", func() {
+		Expect(ioutil.WriteFile(path, []byte("old\n"), 0644)).To(Succeed())
+		file, err := metricsadapter.NewRotatingFile(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = file.Write([]byte("new\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(file.Close()).To(Succeed())
+
+		Expect(contents(path)).To(Equal("old\nnew\n"))
+	})
+})